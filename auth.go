@@ -0,0 +1,175 @@
+package mailsender
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+//The SASL mechanisms that can be used to authenticate to the mail server
+const (
+	AuthPlain       = "PLAIN"
+	AuthLogin       = "LOGIN"
+	AuthCRAMMD5     = "CRAM-MD5"
+	AuthXOAuth2     = "XOAUTH2"
+	AuthOAuthBearer = "OAUTHBEARER"
+)
+
+//ErrNoAuthMechanism is returned when the server advertises none of the
+//mechanisms that can be used with a password
+var ErrNoAuthMechanism = errors.New("The server offers no supported authentication mechanism")
+
+//IsAuthMechanism tells if mechanism is one of the supported ones
+func IsAuthMechanism(mechanism string) bool {
+	switch strings.ToUpper(mechanism) {
+	case AuthPlain, AuthLogin, AuthCRAMMD5, AuthXOAuth2, AuthOAuthBearer:
+		return true
+	}
+	return false
+}
+
+//NewAuth creates the smtp.Auth for mechanism. For XOAUTH2 and
+//OAUTHBEARER the secret is the OAuth2 access token, for the others
+//it is the password.
+func NewAuth(mechanism string, username string, secret string, host string) (smtp.Auth, error) {
+	switch strings.ToUpper(mechanism) {
+	case AuthPlain:
+		return smtp.PlainAuth("", username, secret, host), nil
+	case AuthLogin:
+		return LoginAuth(username, secret, host), nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(username, secret), nil
+	case AuthXOAuth2:
+		return XOAuth2Auth(username, secret), nil
+	case AuthOAuthBearer:
+		return OAuthBearerAuth(username, secret, host), nil
+	}
+	return nil, fmt.Errorf("Unknown authentication mechanism %s", mechanism)
+}
+
+//isLocalhost tells if the credentials can be sent unencrypted to host,
+//the same rule smtp.PlainAuth applies
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+type loginAuth struct {
+	username, password, host string
+}
+
+//LoginAuth returns an smtp.Auth implementing the LOGIN mechanism.
+//As smtp.PlainAuth, it only sends the credentials over TLS or to localhost.
+func LoginAuth(username string, password string, host string) smtp.Auth {
+	return &loginAuth{username: username, password: password, host: host}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return AuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("Unexpected LOGIN challenge %q", fromServer)
+}
+
+type oauthAuth struct {
+	mechanism string
+	response  string
+}
+
+//XOAuth2Auth returns an smtp.Auth implementing the XOAUTH2 mechanism
+//used by Gmail and Outlook, authenticating with an OAuth2 access token
+func XOAuth2Auth(username string, token string) smtp.Auth {
+	return &oauthAuth{
+		mechanism: AuthXOAuth2,
+		response:  "user=" + username + "\x01auth=Bearer " + token + "\x01\x01",
+	}
+}
+
+//OAuthBearerAuth returns an smtp.Auth implementing the OAUTHBEARER
+//mechanism of RFC 7628, authenticating with an OAuth2 access token
+func OAuthBearerAuth(username string, token string, host string) smtp.Auth {
+	return &oauthAuth{
+		mechanism: AuthOAuthBearer,
+		response:  "n,a=" + username + ",\x01host=" + host + "\x01auth=Bearer " + token + "\x01\x01",
+	}
+}
+
+func (a *oauthAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return a.mechanism, []byte(a.response), nil
+}
+
+func (a *oauthAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	//the server sends the error details as a challenge and waits for
+	//an empty response (a single 0x01 for OAUTHBEARER) before failing
+	if a.mechanism == AuthOAuthBearer {
+		return []byte("\x01"), nil
+	}
+	return []byte{}, nil
+}
+
+//passwordMechanisms are the mechanisms chosen automatically, in the
+//order of preference over an encrypted connection. Over an unencrypted
+//one CRAM-MD5 comes first as it does not reveal the password.
+var passwordMechanisms = []string{AuthPlain, AuthLogin, AuthCRAMMD5}
+
+type autoAuth struct {
+	username, password, host string
+	smtp.Auth
+}
+
+//AutoAuth returns an smtp.Auth using the best password based mechanism
+//among the ones the server advertises in its AUTH extension
+func AutoAuth(username string, password string, host string) smtp.Auth {
+	return &autoAuth{username: username, password: password, host: host}
+}
+
+func (a *autoAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	advertised := make(map[string]bool)
+	for _, mechanism := range server.Auth {
+		advertised[strings.ToUpper(mechanism)] = true
+	}
+
+	preference := passwordMechanisms
+	if !server.TLS {
+		preference = []string{AuthCRAMMD5, AuthPlain, AuthLogin}
+	}
+
+	for _, mechanism := range preference {
+		if advertised[mechanism] {
+			a.Auth, _ = NewAuth(mechanism, a.username, a.password, a.host)
+			return a.Auth.Start(server)
+		}
+	}
+	return "", nil, ErrNoAuthMechanism
+}
+
+//newAuth creates the authentication for the Impl methods: the pinned
+//mechanism when there is one and the automatic selection otherwise
+func (impl *Impl) newAuth(usermail string, pass string, host string) (smtp.Auth, error) {
+	if impl.AuthMechanism == "" {
+		return AutoAuth(usermail, pass, host), nil
+	}
+	return NewAuth(impl.AuthMechanism, usermail, pass, host)
+}
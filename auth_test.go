@@ -0,0 +1,94 @@
+package mailsender_test
+
+import (
+	"errors"
+	"net/mail"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+//newAuthServer starts a server offering STARTTLS and mechanisms, any of
+//them accepting src@server.com with "secret" as password or token
+func newAuthServer(mechanisms ...string) *mailsendertest.Server {
+	server := mailsendertest.NewUnstartedServer()
+	server.STARTTLS = true
+	server.Users = map[string]string{"src@server.com": "secret"}
+	server.Tokens = map[string]string{"src@server.com": "secret"}
+	server.Mechanisms = mechanisms
+	server.Start()
+	return server
+}
+
+func TestSendMailAuthMechanisms(t *testing.T) {
+	assert := assert.New(t)
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+	}
+
+	mechanisms := []string{mailsender.AuthPlain, mailsender.AuthLogin, mailsender.AuthCRAMMD5, mailsender.AuthXOAuth2, mailsender.AuthOAuthBearer}
+	for _, mechanism := range mechanisms {
+		server := newAuthServer(mechanism)
+
+		impl := mailsender.Impl{AuthMechanism: mechanism}
+		_, err := impl.SendMailStartTLS(server.Addr, server.ClientTLSConfig(), true, "src@server.com", "secret", ms)
+		assert.Nil(err, "No error expected for %s, got %v\n", mechanism, err)
+
+		_, err = impl.SendMailStartTLS(server.Addr, server.ClientTLSConfig(), true, "src@server.com", "wrong", ms)
+		assert.NotNil(err, "Error expected for %s with wrong credentials\n", mechanism)
+
+		//the automatic selection never picks the OAuth2 mechanisms
+		impl = mailsender.Impl{}
+		_, err = impl.SendMailStartTLS(server.Addr, server.ClientTLSConfig(), true, "src@server.com", "secret", ms)
+		expected := 2
+		if mechanism == mailsender.AuthXOAuth2 || mechanism == mailsender.AuthOAuthBearer {
+			assert.True(errors.Is(err, mailsender.ErrNoAuthMechanism), "Expected ErrNoAuthMechanism, got %v", err)
+			expected = 1
+		} else {
+			assert.Nil(err, "No error expected selecting %s, got %v\n", mechanism, err)
+		}
+
+		messages := server.Messages()
+		assert.Len(messages, expected)
+		for _, message := range messages {
+			assert.Equal("src@server.com", message.User)
+			assert.Equal(mechanism, message.Mechanism)
+		}
+		server.Close()
+	}
+}
+
+func TestAutoAuthPreference(t *testing.T) {
+	assert := assert.New(t)
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+	}
+	impl := mailsender.Impl{}
+
+	//without TLS CRAM-MD5 is preferred as it does not reveal the password
+	server := newAuthServer("LOGIN", "CRAM-MD5", "PLAIN")
+	_, err := impl.SendMail(server.Addr, "src@server.com", "secret", ms)
+	assert.Nil(err, "No error expected, got %v\n", err)
+	if messages := server.Messages(); assert.Len(messages, 1) {
+		assert.Equal(mailsender.AuthCRAMMD5, messages[0].Mechanism)
+	}
+	server.Close()
+
+	//PLAIN comes next, allowed without TLS only because the server is local
+	server = newAuthServer("LOGIN", "PLAIN")
+	_, err = impl.SendMail(server.Addr, "src@server.com", "secret", ms)
+	assert.Nil(err, "No error expected, got %v\n", err)
+	if messages := server.Messages(); assert.Len(messages, 1) {
+		assert.Equal(mailsender.AuthPlain, messages[0].Mechanism)
+	}
+	server.Close()
+
+	_, err = mailsender.NewAuth("DIGEST-MD5", "user", "pass", "localhost")
+	assert.NotNil(err, "Error expected for an unknown mechanism")
+	assert.True(mailsender.IsAuthMechanism("xoauth2"))
+	assert.False(mailsender.IsAuthMechanism("DIGEST-MD5"))
+}
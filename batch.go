@@ -0,0 +1,112 @@
+package mailsender
+
+import (
+	"context"
+	"sync"
+)
+
+//defaultBatchWorkers is the number of mails of a batch sent at the same
+//time when no other limit is given
+const defaultBatchWorkers = 4
+
+//SendFunc sends one mail, as Pool.SendContext does
+type SendFunc func(ctx context.Context, ms MailStruct) (*Result, error)
+
+//BatchResult is the outcome of sending one mail of a batch
+type BatchResult struct {
+	//Index is the position of the mail in the batch
+	Index     int
+	MessageID string
+	//Result is nil when the mail was not sent
+	Result *Result
+	Err    error
+}
+
+//SendBatch sends the mails with send, at most workers at the same time,
+//and returns their results in the order of the mails. A failed mail does
+//not stop the others. The mails not sent when ctx is done get its error.
+func SendBatch(ctx context.Context, send SendFunc, mails []MailStruct, workers int) []BatchResult {
+	in := make(chan MailStruct)
+	go func() {
+		defer close(in)
+		for _, ms := range mails {
+			in <- ms
+		}
+	}()
+
+	results := make([]BatchResult, len(mails))
+	for result := range SendStream(ctx, send, in, workers) {
+		results[result.Index] = result
+	}
+	return results
+}
+
+//SendStream sends the mails received on mails with send, at most workers
+//at the same time. The results are delivered as the mails are sent, so
+//not in order, and the returned channel is closed once mails is closed
+//and all of them are sent. Index counts the mails in the order received.
+func SendStream(ctx context.Context, send SendFunc, mails <-chan MailStruct, workers int) <-chan BatchResult {
+	if workers <= 0 {
+		workers = defaultBatchWorkers
+	}
+
+	type job struct {
+		index int
+		ms    MailStruct
+	}
+	jobs := make(chan job)
+	results := make(chan BatchResult)
+
+	go func() {
+		defer close(jobs)
+		index := 0
+		for ms := range mails {
+			jobs <- job{index: index, ms: ms}
+			index++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- sendOne(ctx, send, j.index, j.ms)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+//sendOne sends a mail of a batch. Its Message-ID is set beforehand so
+//that it is known even when the mail is not sent.
+func sendOne(ctx context.Context, send SendFunc, index int, ms MailStruct) BatchResult {
+	if ms.MessageID == "" {
+		ms.MessageID = GenerateMessageID(domainOf(ms.From.Address))
+	}
+	result := BatchResult{Index: index, MessageID: ms.MessageID}
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Result, result.Err = send(ctx, ms)
+	return result
+}
+
+//SendBatch sends the mails on the sessions of the pool, as many at the
+//same time as MaxOpen allows, and returns their results in order
+func (p *Pool) SendBatch(ctx context.Context, mails []MailStruct) []BatchResult {
+	return SendBatch(ctx, p.SendContext, mails, p.MaxOpen)
+}
+
+//SendStream sends the mails received on mails on the sessions of the
+//pool, as many at the same time as MaxOpen allows
+func (p *Pool) SendStream(ctx context.Context, mails <-chan MailStruct) <-chan BatchResult {
+	return SendStream(ctx, p.SendContext, mails, p.MaxOpen)
+}
@@ -0,0 +1,122 @@
+package mailsender_test
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendBatch(t *testing.T) {
+	assert := assert.New(t)
+	var running, maxRunning int32
+	send := func(ctx context.Context, ms mailsender.MailStruct) (*mailsender.Result, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if ms.Subject == "mail 3" {
+			return nil, errors.New("refused")
+		}
+		return &mailsender.Result{MessageID: ms.MessageID, Accepted: ms.To}, nil
+	}
+
+	mails := make([]mailsender.MailStruct, 10)
+	for i := range mails {
+		mails[i] = poolMail(i)
+	}
+	mails[5].MessageID = "fixed@server.com"
+
+	results := mailsender.SendBatch(context.Background(), send, mails, 3)
+	assert.Equal(10, len(results))
+	for i, result := range results {
+		assert.Equal(i, result.Index)
+		assert.NotEqual("", result.MessageID, "The Message-ID should be known for every mail")
+		if i == 3 {
+			assert.NotNil(result.Err)
+			assert.Nil(result.Result)
+			continue
+		}
+		assert.Nil(result.Err)
+		assert.Equal(result.MessageID, result.Result.MessageID)
+	}
+	assert.Equal("fixed@server.com", results[5].MessageID)
+	assert.True(atomic.LoadInt32(&maxRunning) <= 3, "At most 3 mails should be sent at the same time")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = mailsender.SendBatch(ctx, send, mails, 0)
+	for _, result := range results {
+		assert.Equal(context.Canceled, result.Err)
+	}
+}
+
+func TestPoolSendStream(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	server.RejectRecipient("nobody@server.com")
+
+	pool := &mailsender.Pool{Server: server.Addr, MaxOpen: 2}
+	defer pool.Close()
+
+	mails := make(chan mailsender.MailStruct)
+	go func() {
+		defer close(mails)
+		for i := 0; i < 10; i++ {
+			ms := poolMail(i)
+			if i == 7 {
+				ms.To = []mail.Address{{Address: "nobody@server.com"}}
+			}
+			mails <- ms
+		}
+	}()
+
+	seen := make(map[int]bool)
+	for result := range pool.SendStream(context.Background(), mails) {
+		seen[result.Index] = true
+		if result.Index == 7 {
+			assert.True(errors.Is(result.Err, mailsender.ErrAllRecipientsRejected))
+			continue
+		}
+		assert.Nil(result.Err, "No error expected, got %v", result.Err)
+	}
+	assert.Equal(10, len(seen))
+	assert.Equal(9, len(server.Messages()))
+	connections := server.Connections()
+	assert.True(connections <= 2, "At most 2 sessions expected, got %d", connections)
+}
+
+func TestPoolSender(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.Users = map[string]string{"src@server.com": "secret", "other@server.com": "other"}
+	server.Start()
+	defer server.Close()
+
+	sender := &mailsender.PoolSender{}
+	var msender mailsender.MailSender = sender
+	for i := 0; i < 3; i++ {
+		_, err := msender.SendMail(server.Addr, "src@server.com", "secret", poolMail(i))
+		assert.Nil(err, "No error expected, got %v", err)
+	}
+	_, err := sender.SendMailContext(context.Background(), server.Addr, "other@server.com", "other", poolMail(3))
+	assert.Nil(err, "No error expected, got %v", err)
+	assert.Nil(sender.Close())
+
+	assert.Equal(2, server.Connections(), "A session should be kept for each account")
+	messages := server.Messages()
+	assert.Equal("src@server.com", messages[2].User)
+	assert.Equal("other@server.com", messages[3].User)
+}
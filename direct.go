@@ -0,0 +1,253 @@
+package mailsender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+//ErrNullMX is returned for a domain publishing a null MX record, as
+//described in RFC 7505, meaning it accepts no mail
+var ErrNullMX = errors.New("The domain does not accept mail")
+
+//Resolver looks up the mail exchangers of a domain and the addresses of
+//a host. net.DefaultResolver implements it.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+//DirectSender delivers mails straight to the mail exchangers of the
+//domains of the recipients, without a relay. The recipients are grouped
+//by domain and each group is sent to the MX hosts of its domain in order
+//of preference, or to the domain itself when it has no MX record.
+//STARTTLS is used whenever the server offers it.
+type DirectSender struct {
+	//Resolver is used for the MX and address lookups,
+	//net.DefaultResolver when it is nil
+	Resolver Resolver
+	//Port is the port of the mail exchangers, 25 when it is empty
+	Port string
+	//LocalName is the host name sent with EHLO. Many servers refuse
+	//mails from a client calling itself localhost, the default.
+	LocalName string
+	//TLSConfig is used for STARTTLS, with ServerName set to the MX
+	//host. When it is nil the certificate of the server is not verified,
+	//as most of them are not valid for the name of their MX record.
+	TLSConfig *tls.Config
+	//Timeouts limits the phases of each session
+	Timeouts Timeouts
+}
+
+//Send delivers the mail to the mail exchangers of its recipients
+func (ds *DirectSender) Send(ms MailStruct) (*Result, error) {
+	return ds.SendContext(context.Background(), ms)
+}
+
+//SendContext delivers the mail to the mail exchangers of its recipients,
+//stopping when ctx is done. A domain that can not be reached does not
+//stop the delivery to the others, its recipients are listed in Rejected.
+//An error is returned only when no recipient accepted the mail.
+func (ds *DirectSender) SendContext(ctx context.Context, ms MailStruct) (*Result, error) {
+	recipients := ms.envelope()
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+	if err := ms.ValidateHeaders(); err != nil {
+		return nil, err
+	}
+	//every domain gets the same Date and Message-ID
+	setDefaults(&ms)
+
+	//each domain is sent the mail in its own session, while the Reader
+	//attachments can only be read once
+	groups := groupByDomain(recipients)
+	if len(groups) > 1 {
+		var err error
+		if ms, err = ms.Render(); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &Result{MessageID: ms.MessageID}
+	var errs []error
+	for _, group := range groups {
+		delivered, err := ds.deliver(ctx, group.domain, ms, group.recipients)
+		if delivered != nil {
+			result.Bytes += delivered.Bytes
+			result.Accepted = append(result.Accepted, delivered.Accepted...)
+			result.Rejected = append(result.Rejected, delivered.Rejected...)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			if delivered == nil {
+				for _, recipient := range group.recipients {
+					result.Rejected = append(result.Rejected, RecipientError{Address: recipient, Err: err})
+				}
+			}
+		}
+	}
+
+	if len(result.Accepted) == 0 {
+		return result, firstPermanent(errs)
+	}
+	return result, nil
+}
+
+//domainGroup holds the recipients of a domain
+type domainGroup struct {
+	domain     string
+	recipients []mail.Address
+}
+
+//groupByDomain groups the recipients by domain, keeping the order in
+//which the domains first appear
+func groupByDomain(recipients []mail.Address) []domainGroup {
+	var groups []domainGroup
+	index := make(map[string]int)
+	for _, recipient := range recipients {
+		domain := strings.ToLower(domainOf(recipient.Address))
+		i, ok := index[domain]
+		if !ok {
+			i = len(groups)
+			index[domain] = i
+			groups = append(groups, domainGroup{domain: domain})
+		}
+		groups[i].recipients = append(groups[i].recipients, recipient)
+	}
+	return groups
+}
+
+//firstPermanent returns the first permanent error, or the first error
+//when all of them are temporary so that the mail can be retried
+func firstPermanent(errs []error) error {
+	for _, err := range errs {
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Permanent() {
+			return err
+		}
+	}
+	return errs[0]
+}
+
+func (ds *DirectSender) resolver() Resolver {
+	if ds.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return ds.Resolver
+}
+
+//mxHosts returns the hosts accepting mail for domain in order of
+//preference, those of equal preference in random order. As required by RFC 5321 the domain itself is the only host
+//when it has no MX record.
+func (ds *DirectSender) mxHosts(ctx context.Context, domain string) ([]string, error) {
+	records, err := ds.resolver().LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, newSMTPError(StageDial, err)
+		}
+		records = nil
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+	if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+		return nil, &SMTPError{Stage: StageDial, Code: 556, EnhancedCode: "5.1.10", Message: ErrNullMX.Error(), Err: ErrNullMX}
+	}
+
+	hosts := make([]string, 0, len(records))
+	for _, record := range sortMX(records) {
+		hosts = append(hosts, strings.TrimSuffix(record.Host, "."))
+	}
+	return hosts, nil
+}
+
+//sortMX returns a copy of records sorted by preference, shuffling the
+//records of equal preference to spread the load among them, as
+//required by RFC 5321 section 5.1
+func sortMX(records []*net.MX) []*net.MX {
+	sorted := make([]*net.MX, len(records))
+	copy(sorted, records)
+	rand.Shuffle(len(sorted), func(i, j int) {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	})
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Pref < sorted[j].Pref
+	})
+	return sorted
+}
+
+//deliver sends the mail to the recipients of domain, trying its hosts
+//and their addresses in order until one of them takes the mail
+func (ds *DirectSender) deliver(ctx context.Context, domain string, ms MailStruct, recipients []mail.Address) (*Result, error) {
+	hosts, err := ds.mxHosts(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	port := ds.Port
+	if port == "" {
+		port = "25"
+	}
+
+	err = newSMTPError(StageDial, fmt.Errorf("No address found for %s", domain))
+	for _, host := range hosts {
+		addresses, lookupErr := ds.resolver().LookupHost(ctx, host)
+		if lookupErr != nil {
+			err = newSMTPError(StageDial, lookupErr)
+			continue
+		}
+		for _, address := range addresses {
+			var result *Result
+			result, err = ds.deliverTo(ctx, host, net.JoinHostPort(address, port), ms, recipients)
+			if !tryNextHost(ctx, err) {
+				return result, err
+			}
+		}
+	}
+	return nil, err
+}
+
+//deliverTo sends the mail to the recipients on the server at address.
+//When the TLS handshake fails the mail is sent unencrypted, as the
+//encryption is only opportunistic.
+func (ds *DirectSender) deliverTo(ctx context.Context, host string, address string, ms MailStruct, recipients []mail.Address) (*Result, error) {
+	var tlsconfig *tls.Config
+	if ds.TLSConfig == nil {
+		tlsconfig = CreateInsecureTLSConfig(host)
+	} else {
+		tlsconfig = ds.TLSConfig.Clone()
+		tlsconfig.ServerName = host
+	}
+
+	s, err := dialSession(ctx, address, TLSOpportunistic, tlsconfig, ds.Timeouts, ds.LocalName)
+	if smtpErr, ok := err.(*SMTPError); ok && smtpErr.Stage == StageTLS && ctx.Err() == nil {
+		s, err = dialSession(ctx, address, TLSNone, nil, ds.Timeouts, ds.LocalName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	return s.sendTo(ms, recipients)
+}
+
+//tryNextHost tells if the mail should be sent to the next host after
+//err: the server could not be reached or was not able to take the mail
+//before it was transferred
+func tryNextHost(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	smtpErr, ok := err.(*SMTPError)
+	if !ok || !smtpErr.Temporary() {
+		return false
+	}
+	return smtpErr.Stage != StageData
+}
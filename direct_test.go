@@ -0,0 +1,141 @@
+package mailsender_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+//fakeResolver answers the lookups from its maps. Unknown names are
+//reported as not found.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addresses, ok := r.hosts[host]; ok {
+		return addresses, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func newDirectSender(t *testing.T, server *mailsendertest.Server) *mailsender.DirectSender {
+	_, port, err := net.SplitHostPort(server.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := fakeResolver{
+		mx: map[string][]*net.MX{
+			//nothing listens on 127.0.0.2, so mx1 can not be reached
+			"a.com": {{Host: "mx1.a.com.", Pref: 10}, {Host: "mx2.a.com.", Pref: 20}},
+			"c.com": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"mx1.a.com": {"127.0.0.2"},
+			"mx2.a.com": {"127.0.0.1"},
+			"b.com":     {"127.0.0.1"},
+		},
+	}
+	return &mailsender.DirectSender{Resolver: resolver, Port: port, LocalName: "mail.server.com"}
+}
+
+func TestDirectSender(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.STARTTLS = true
+	server.Start()
+	defer server.Close()
+
+	ms := mailsender.MailStruct{
+		From:    mail.Address{Address: "src@server.com"},
+		To:      []mail.Address{{Address: "x@a.com"}, {Address: "y@b.com"}},
+		Bcc:     []mail.Address{{Address: "z@A.com"}},
+		Subject: "direct",
+		Body:    "body",
+	}
+	result, err := newDirectSender(t, server).Send(ms)
+	assert.Nil(err, "No error expected, got %v", err)
+	assert.Equal(3, len(result.Accepted))
+	assert.Equal(0, len(result.Rejected))
+
+	messages := server.Messages()
+	assert.Equal(2, len(messages), "One message per domain expected")
+	sort.Slice(messages, func(i, j int) bool { return messages[i].To[0] < messages[j].To[0] })
+	assert.Equal([]string{"x@a.com", "z@A.com"}, messages[0].To)
+	assert.Equal([]string{"y@b.com"}, messages[1].To)
+	for _, message := range messages {
+		assert.True(message.TLS, "STARTTLS should be used when offered")
+		assert.Equal("<"+result.MessageID+">", message.Header.Get("Message-ID"))
+		assert.NotContains(string(message.Raw), "z@A.com")
+	}
+}
+
+func TestDirectSenderReaderAttachment(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	ms := mailsender.MailStruct{
+		From:        mail.Address{Address: "src@server.com"},
+		To:          []mail.Address{{Address: "x@a.com"}, {Address: "y@b.com"}},
+		Subject:     "statement",
+		Body:        "body",
+		Attachments: []mailsender.Attachment{mailsender.AttachReader("statement.csv", strings.NewReader("date,amount\n"))},
+	}
+	_, err := newDirectSender(t, server).Send(ms)
+	assert.Nil(err, "No error expected, got %v", err)
+
+	messages := server.Messages()
+	assert.Equal(2, len(messages), "One message per domain expected")
+	for _, message := range messages {
+		attachment := message.Attachment("statement.csv")
+		if assert.NotNil(attachment, "Every domain should get the attachment") {
+			assert.Equal("date,amount\n", string(attachment.Data))
+		}
+	}
+}
+
+func TestDirectSenderFailures(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	ds := newDirectSender(t, server)
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "x@c.com"}, {Address: "y@b.com"}, {Address: "w@nowhere.com"}},
+	}
+	result, err := ds.Send(ms)
+	assert.Nil(err, "The mail reached b.com, got %v", err)
+	assert.Equal([]mail.Address{{Address: "y@b.com"}}, result.Accepted)
+	assert.Equal(2, len(result.Rejected))
+	assert.True(errors.Is(result.Rejected[0].Err, mailsender.ErrNullMX))
+
+	ms.To = []mail.Address{{Address: "x@c.com"}}
+	_, err = ds.Send(ms)
+	assert.True(errors.Is(err, mailsender.ErrNullMX), "mailsender.ErrNullMX expected, got %v", err)
+	assert.True(err.(*mailsender.SMTPError).Permanent())
+
+	ms.To = []mail.Address{{Address: "w@nowhere.com"}}
+	_, err = ds.Send(ms)
+	assert.NotNil(err, "Error expected for a domain without address")
+
+	_, err = ds.Send(mailsender.MailStruct{From: mail.Address{Address: "src@server.com"}})
+	assert.Equal(mailsender.ErrNoRecipients, err)
+}
@@ -0,0 +1,255 @@
+package mailsender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DefaultDKIMHeaders are the header fields signed when DKIMSigner.Headers
+//is empty
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "List-Unsubscribe",
+}
+
+//DKIMSigner adds a DKIM-Signature, as described in RFC 6376, to the
+//mails of a domain. The header and the body are canonicalized with the
+//relaxed algorithm. As the signature covers the whole body a signed
+//mail is built in memory before it is sent.
+type DKIMSigner struct {
+	//Domain is the signing domain, d= in the signature
+	Domain string
+	//Selector names the public key in the DNS, published at
+	//selector._domainkey.domain
+	Selector string
+	//Key is an *rsa.PrivateKey, signing with rsa-sha256, or an
+	//ed25519.PrivateKey, signing with ed25519-sha256 as in RFC 8463
+	Key crypto.Signer
+	//Headers lists the header fields to sign, DefaultDKIMHeaders when
+	//it is empty. From is always signed.
+	Headers []string
+}
+
+//ParseDKIMKey reads a PEM encoded private key: an RSA key in PKCS #1 or
+//PKCS #8 form or an Ed25519 key in PKCS #8 form
+func ParseDKIMKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM encoded key found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unsupported DKIM key type %T", key)
+}
+
+//algorithm returns the a= tag for the key
+func (d *DKIMSigner) algorithm() (string, error) {
+	switch d.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("Unsupported DKIM key type %T", d.Key)
+}
+
+//headers returns the names of the header fields to sign
+func (d *DKIMSigner) headers() []string {
+	names := d.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, "From") {
+			return names
+		}
+	}
+	return append([]string{"From"}, names...)
+}
+
+//Sign returns the DKIM-Signature header field, with its final CRLF, to
+//put in front of message. The lines of message may end with LF alone,
+//as they are sent with CRLF.
+func (d *DKIMSigner) Sign(message []byte) (string, error) {
+	if d.Domain == "" || d.Selector == "" || d.Key == nil {
+		return "", fmt.Errorf("The DKIM signer needs a domain, a selector and a key")
+	}
+	algorithm, err := d.algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	message = bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1)
+	message = bytes.Replace(message, []byte("\n"), []byte("\r\n"), -1)
+	header, body := message, []byte(nil)
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		header, body = message[:i+2], message[i+4:]
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+
+	fields := splitHeaderFields(header)
+	var signed []string
+	hash := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range d.headers() {
+		//the last instance of a field not signed yet, as in RFC 6376 5.4.2
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				io.WriteString(hash, relaxedHeader(fields[i])+"\r\n")
+				signed = append(signed, name)
+				break
+			}
+		}
+	}
+
+	tags := []string{
+		"v=1",
+		"a=" + algorithm,
+		"c=relaxed/relaxed",
+		"d=" + d.Domain,
+		"s=" + d.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"h=" + strings.Join(signed, ":"),
+		"bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	}
+	signature := "DKIM-Signature: " + strings.Join(tags, ";\r\n\t")
+	//the signature itself is signed with an empty b= and no final CRLF
+	io.WriteString(hash, relaxedHeader(signature))
+
+	var b []byte
+	if _, ok := d.Key.(ed25519.PrivateKey); ok {
+		b, err = d.Key.Sign(rand.Reader, hash.Sum(nil), crypto.Hash(0))
+	} else {
+		b, err = d.Key.Sign(rand.Reader, hash.Sum(nil), crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return signature + foldBase64(base64.StdEncoding.EncodeToString(b)) + "\r\n", nil
+}
+
+//signMessage writes message to w preceded by its DKIM-Signature
+func signMessage(w io.Writer, d *DKIMSigner, message []byte) error {
+	signature, err := d.Sign(message)
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, signature); err != nil {
+		return err
+	}
+	_, err = w.Write(message)
+	return err
+}
+
+//foldBase64 breaks a base64 value in lines short enough for a header
+func foldBase64(value string) string {
+	const width = 72
+	var folded strings.Builder
+	for len(value) > width {
+		folded.WriteString(value[:width] + "\r\n\t")
+		value = value[width:]
+	}
+	folded.WriteString(value)
+	return folded.String()
+}
+
+//splitHeaderFields splits a header block, ending with CRLF, in fields,
+//each of them with its continuation lines and without the final CRLF
+func splitHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSuffix(fields[i], "\r\n")
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return field
+}
+
+//relaxedHeader canonicalizes a header field with the relaxed algorithm
+//of RFC 6376 3.4.2: lower case name, unfolded value and runs of white
+//space reduced to a single space
+func relaxedHeader(field string) string {
+	i := strings.IndexByte(field, ':')
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(field)) + ":"
+	}
+	name := strings.ToLower(strings.TrimSpace(field[:i]))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	return name + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+//relaxedBody canonicalizes a body with the relaxed algorithm of RFC 6376
+//3.4.4: white space reduced at the end and inside the lines and the
+//empty lines at the end removed
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		var reduced strings.Builder
+		space := false
+		for _, r := range line {
+			if isWSP(r) {
+				space = true
+				continue
+			}
+			if space {
+				reduced.WriteByte(' ')
+				space = false
+			}
+			reduced.WriteRune(r)
+		}
+		lines[i] = reduced.String()
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,150 @@
+package mailsender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//verifyDKIM checks the DKIM-Signature at the top of message with the
+//public key, following RFC 6376 6.1.3
+func verifyDKIM(t *testing.T, message []byte, public crypto.PublicKey) bool {
+	//the lines are sent with CRLF
+	message = bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1)
+	message = bytes.Replace(message, []byte("\n"), []byte("\r\n"), -1)
+	header := string(message[:bytes.Index(message, []byte("\r\n\r\n"))+2])
+	body := message[bytes.Index(message, []byte("\r\n\r\n"))+4:]
+	fields := splitHeaderFields([]byte(header))
+	if !strings.HasPrefix(fields[0], "DKIM-Signature:") {
+		t.Fatalf("No DKIM-Signature: %s", fields[0])
+	}
+
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(strings.TrimPrefix(fields[0], "DKIM-Signature:"), ";") {
+		parts := strings.SplitN(tag, "=", 2)
+		tags[strings.TrimSpace(parts[0])] = regexp.MustCompile(`\s+`).ReplaceAllString(parts[1], "")
+	}
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return false
+	}
+
+	hash := sha256.New()
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				hash.Write([]byte(relaxedHeader(fields[i]) + "\r\n"))
+				break
+			}
+		}
+	}
+	unsigned := regexp.MustCompile(`b=[^;]*$`).ReplaceAllString(fields[0], "b=")
+	hash.Write([]byte(relaxedHeader(unsigned)))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return false
+	}
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return tags["a"] == "rsa-sha256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash.Sum(nil), signature) == nil
+	case ed25519.PublicKey:
+		return tags["a"] == "ed25519-sha256" && ed25519.Verify(key, hash.Sum(nil), signature)
+	}
+	return false
+}
+
+func dkimMail(signer *DKIMSigner) MailStruct {
+	return MailStruct{
+		From:     mail.Address{Name: "Sender", Address: "src@example.com"},
+		To:       []mail.Address{{Address: "to@server.com"}},
+		Subject:  "Signed   mail",
+		Body:     "Hello  \nthere\n\n\n",
+		HTMLBody: "<p>Hello</p>",
+		Headers:  map[string]string{"X-Ticket": "42"},
+		DKIM:     signer,
+	}
+}
+
+func TestDKIMSignRSA(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(err)
+	signer := &DKIMSigner{Domain: "example.com", Selector: "mail", Key: key}
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, dkimMail(signer)))
+	message := buf.Bytes()
+	assert.True(verifyDKIM(t, message, &key.PublicKey), "The signature should verify:\n%s", message)
+	assert.Contains(string(message), "d=example.com;\r\n\ts=mail;")
+	assert.Contains(string(message), "h=From:Subject:Date:To:Message-ID:MIME-Version:Content-Type;")
+	for _, line := range strings.Split(string(message), "\r\n") {
+		assert.True(len(line) <= 78, "Line too long: %s", line)
+	}
+
+	_, err = mail.ReadMessage(bytes.NewReader(message))
+	assert.Nil(err)
+
+	tampered := bytes.Replace(message, []byte("Signed   mail"), []byte("Signed mail!"), 1)
+	assert.False(verifyDKIM(t, tampered, &key.PublicKey), "A changed subject should break the signature")
+	tampered = bytes.Replace(message, []byte("<p>Hello</p>"), []byte("<p>Hi</p>"), 1)
+	assert.False(verifyDKIM(t, tampered, &key.PublicKey), "A changed body should break the signature")
+	//the relaxed canonicalization tolerates white space changes
+	relaxed := bytes.Replace(message, []byte("Subject: Signed   mail"), []byte("SUBJECT:  Signed mail "), 1)
+	assert.True(verifyDKIM(t, relaxed, &key.PublicKey))
+}
+
+func TestDKIMSignEd25519(t *testing.T) {
+	assert := assert.New(t)
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	signer := &DKIMSigner{Domain: "example.com", Selector: "ed", Key: private, Headers: []string{"Subject", "X-Ticket"}}
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, dkimMail(signer)))
+	assert.True(verifyDKIM(t, buf.Bytes(), public))
+	assert.Contains(buf.String(), "a=ed25519-sha256;")
+	assert.Contains(buf.String(), "h=From:Subject:X-Ticket;", "From should always be signed")
+}
+
+func TestDKIMCanonicalization(t *testing.T) {
+	assert := assert.New(t)
+	//the example of RFC 6376 3.4.5
+	assert.Equal("a:X", relaxedHeader("A: X"))
+	assert.Equal("b:Y Z", relaxedHeader("B : Y\t\r\n\tZ  "))
+	assert.Equal(" C\r\nD E\r\n", string(relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n"))))
+	assert.Nil(relaxedBody([]byte("\r\n\r\n")))
+}
+
+func TestParseDKIMKey(t *testing.T) {
+	assert := assert.New(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	assert.Nil(err)
+
+	key, err := ParseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	assert.Nil(err)
+	assert.IsType(&rsa.PrivateKey{}, key)
+	key, err = ParseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+	assert.Nil(err)
+	assert.IsType(ed25519.PrivateKey{}, key)
+	_, err = ParseDKIMKey([]byte("not a key"))
+	assert.NotNil(err)
+}
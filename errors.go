@@ -0,0 +1,110 @@
+package mailsender
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"regexp"
+)
+
+//Stage is the step of the SMTP session in which an error happened
+type Stage string
+
+//The stages of sending a mail
+const (
+	StageDial Stage = "dial"
+	StageTLS  Stage = "tls"
+	StageAuth Stage = "auth"
+	StageMail Stage = "mail"
+	StageRcpt Stage = "rcpt"
+	StageData Stage = "data"
+)
+
+//enhancedCodeRe matches the RFC 3463 enhanced status code at the start
+//of a server reply
+var enhancedCodeRe = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})\s*`)
+
+//SMTPError is returned by the send methods when the mail could not be sent.
+//Code and EnhancedCode hold the reply of the server and are empty when
+//the error did not come from a reply, as for a connection failure.
+type SMTPError struct {
+	Stage        Stage
+	Code         int
+	EnhancedCode string
+	Message      string
+	Err          error
+}
+
+//newSMTPError builds the SMTPError for an error that happened in stage,
+//reading the codes from the reply of the server if there is one
+func newSMTPError(stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	if smtpErr, ok := err.(*SMTPError); ok {
+		return smtpErr
+	}
+	smtpErr := &SMTPError{Stage: stage, Message: err.Error(), Err: err}
+	if tpErr, ok := err.(*textproto.Error); ok {
+		smtpErr.Code = tpErr.Code
+		smtpErr.Message = tpErr.Msg
+		if match := enhancedCodeRe.FindStringSubmatch(tpErr.Msg); match != nil {
+			smtpErr.EnhancedCode = match[1]
+			smtpErr.Message = tpErr.Msg[len(match[0]):]
+		}
+	}
+	return smtpErr
+}
+
+func (e *SMTPError) Error() string {
+	if e.Code == 0 {
+		return fmt.Sprintf("%s: %s", e.Stage, e.Message)
+	}
+	if e.EnhancedCode == "" {
+		return fmt.Sprintf("%s: %d %s", e.Stage, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %d %s %s", e.Stage, e.Code, e.EnhancedCode, e.Message)
+}
+
+//Unwrap returns the underlying error
+func (e *SMTPError) Unwrap() error {
+	return e.Err
+}
+
+//Temporary tells if sending the mail again later may succeed: the server
+//answered with a 4xx reply, as when greylisting, or the connection failed
+func (e *SMTPError) Temporary() bool {
+	if e.Code != 0 {
+		return e.Code >= 400 && e.Code < 500
+	}
+	if _, ok := e.Err.(net.Error); ok {
+		return true
+	}
+	return e.Stage == StageDial
+}
+
+//Permanent tells if the mail will never be accepted as it is, as for an
+//unknown recipient or refused credentials
+func (e *SMTPError) Permanent() bool {
+	return !e.Temporary()
+}
+
+//allRejectedError builds the error returned when no recipient was
+//accepted. It carries the reply of the first permanent rejection, or of
+//the first one when all of them are temporary, so it can be retried.
+func allRejectedError(rejected []RecipientError) error {
+	reply := rejected[0].Err.(*SMTPError)
+	for _, r := range rejected {
+		if smtpErr := r.Err.(*SMTPError); smtpErr.Permanent() {
+			reply = smtpErr
+			break
+		}
+	}
+	return &SMTPError{
+		Stage:        StageRcpt,
+		Code:         reply.Code,
+		EnhancedCode: reply.EnhancedCode,
+		Message:      reply.Message,
+		Err:          ErrAllRecipientsRejected,
+	}
+}
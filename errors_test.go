@@ -0,0 +1,39 @@
+package mailsender
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSMTPError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := newSMTPError(StageRcpt, &textproto.Error{Code: 550, Msg: "5.1.1 The email account does not exist"})
+	smtpErr, ok := err.(*SMTPError)
+	assert.True(ok)
+	assert.Equal(550, smtpErr.Code)
+	assert.Equal("5.1.1", smtpErr.EnhancedCode)
+	assert.Equal("The email account does not exist", smtpErr.Message)
+	assert.True(smtpErr.Permanent())
+	assert.Equal("rcpt: 550 5.1.1 The email account does not exist", err.Error())
+
+	err = newSMTPError(StageRcpt, &textproto.Error{Code: 451, Msg: "Greylisted, try again later"})
+	smtpErr = err.(*SMTPError)
+	assert.Empty(smtpErr.EnhancedCode)
+	assert.True(smtpErr.Temporary())
+	assert.Equal("rcpt: 451 Greylisted, try again later", err.Error())
+
+	err = newSMTPError(StageDial, &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	assert.True(err.(*SMTPError).Temporary())
+
+	err = newSMTPError(StageAuth, ErrNoAuthMechanism)
+	assert.True(err.(*SMTPError).Permanent())
+	assert.True(errors.Is(err, ErrNoAuthMechanism))
+
+	assert.Equal(err, newSMTPError(StageData, err), "An SMTPError should not be wrapped again")
+	assert.Nil(newSMTPError(StageData, nil))
+}
@@ -12,7 +12,7 @@ func main() {
 
 	ms := mailsender.MailStruct{
 		From:    mail.Address{Name: "User Name", Address: "user@server.com"},
-		To:      mail.Address{Name: "Destination", Address: "destination@destinationserver.com"},
+		To:      []mail.Address{{Name: "Destination", Address: "destination@destinationserver.com"}},
 		Subject: "Your subject",
 		Body:    "Just a test mail\nOn two lines",
 	}
@@ -30,15 +30,19 @@ func main() {
 		}
 
 		tlsconfig := mailsender.CreateTlsConfig(host)
-		n, err := impl.SendMailTls(servername, tlsconfig, "user@server.com", "password", ms)
+		result, err := impl.SendMailTLS(servername, tlsconfig, "user@server.com", "password", ms)
 	*/
 
-	n, err := impl.SendMail(servername, "user@server.com", "password", ms)
+	result, err := impl.SendMail(servername, "user@server.com", "password", ms)
 
 	if err != nil {
-		log.Println(err)
+		log.Fatal(err)
 	}
 
-	fmt.Printf("Sent %d bytes\n", n)
+	for _, rejected := range result.Rejected {
+		log.Printf("Rejected %s\n", rejected.Error())
+	}
+
+	fmt.Printf("Sent %d bytes\n", result.Bytes)
 
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"io/ioutil"
 	"log"
 	"os"
@@ -9,10 +10,14 @@ import (
 )
 
 func main() {
-	if _, err := os.Stat("config.json"); os.IsNotExist(err) {
+	//config.dev.json runs the service without a mail server
+	configFile := flag.String("config", "config.json", "the configuration file")
+	flag.Parse()
+
+	if _, err := os.Stat(*configFile); os.IsNotExist(err) {
 		log.Fatal("Config file not found\n")
 	}
-	confString, err := ioutil.ReadFile("config.json")
+	confString, err := ioutil.ReadFile(*configFile)
 	if err != nil {
 		log.Fatalf("Error reading config: %s\n", err.Error())
 	}
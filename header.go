@@ -0,0 +1,309 @@
+package mailsender
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//maxHeaderLength is the line length headers are folded at, as
+//recommended by RFC 5322
+const maxHeaderLength = 78
+
+//isASCII tells if s can be sent without any encoding
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+//maxEncodedWord is the length of the RFC 2047 encoded-words generated.
+//It is shorter than the 75 characters allowed so that a word still fits
+//on the first line of a header, after the header name.
+const maxEncodedWord = 60
+
+//encodeHeader encodes a non-ASCII header value as RFC 2047 encoded-words.
+//Q-encoding keeps mostly ASCII text readable, while B-encoding is
+//shorter when most of the characters have to be encoded.
+func encodeHeader(value string) string {
+	if isASCII(value) {
+		return value
+	}
+	encoded := 0
+	for _, r := range value {
+		if r >= utf8.RuneSelf {
+			encoded++
+		}
+	}
+	useB := encoded > utf8.RuneCountInString(value)/3
+
+	//split the value in words short enough to allow folding
+	var words []string
+	chunk := ""
+	for _, r := range value {
+		if chunk != "" && len(encodeWord(useB, chunk+string(r))) > maxEncodedWord {
+			words = append(words, encodeWord(useB, chunk))
+			chunk = ""
+		}
+		chunk += string(r)
+	}
+	words = append(words, encodeWord(useB, chunk))
+	return strings.Join(words, " ")
+}
+
+//encodeWord builds a single encoded-word. mime.WordEncoder is not used
+//because it leaves the ASCII only chunks unencoded and splits long words
+//on its own.
+func encodeWord(useB bool, text string) string {
+	if useB {
+		return "=?utf-8?b?" + base64.StdEncoding.EncodeToString([]byte(text)) + "?="
+	}
+	var builder strings.Builder
+	builder.WriteString("=?utf-8?q?")
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == ' ':
+			builder.WriteByte('_')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '!', c == '*', c == '+', c == '-', c == '/':
+			builder.WriteByte(c)
+		default:
+			fmt.Fprintf(&builder, "=%02X", c)
+		}
+	}
+	builder.WriteString("?=")
+	return builder.String()
+}
+
+//formatAddress formats the address for a header, encoding the name
+//when it is not ASCII
+func formatAddress(address mail.Address) string {
+	if isASCII(address.Name) {
+		return address.String()
+	}
+	return encodeHeader(address.Name) + " <" + address.Address + ">"
+}
+
+//foldHeader formats the header line "name: value", folding it at the
+//white spaces of the value so no line is longer than maxHeaderLength.
+//A word longer than that is left whole.
+func foldHeader(name string, value string) string {
+	var builder strings.Builder
+	builder.WriteString(name)
+	builder.WriteString(":")
+	lineLength := builder.Len()
+
+	for i, word := range strings.Split(value, " ") {
+		if i > 0 && word == "" {
+			//keep the spaces of the value but never fold on them
+			builder.WriteString(" ")
+			lineLength++
+			continue
+		}
+		if lineLength+1+len(word) > maxHeaderLength && lineLength > len(name)+1 {
+			builder.WriteString("\r\n")
+			lineLength = 0
+		}
+		builder.WriteString(" ")
+		builder.WriteString(word)
+		lineLength += 1 + len(word)
+	}
+	return builder.String()
+}
+
+//foldValue returns the value of a header folded as by foldHeader
+func foldValue(name string, value string) string {
+	return strings.TrimPrefix(foldHeader(name, value), name+": ")
+}
+
+//headerField is a header of the mail. The headers are kept in a slice
+//so they are always written in the same order.
+type headerField struct {
+	Name  string
+	Value string
+}
+
+//randReader is the source of the random parts of the Message-ID and
+//of the multipart boundaries
+var randReader = rand.Reader
+
+//GenerateMessageID creates a unique Message-ID, without the angle
+//brackets, in the given domain. The host name is used when domain is empty.
+func GenerateMessageID(domain string) string {
+	if domain == "" {
+		domain, _ = os.Hostname()
+	}
+	if domain == "" {
+		domain = "localhost"
+	}
+	var buf [12]byte
+	io.ReadFull(randReader, buf[:])
+	return fmt.Sprintf("%x.%x@%s", time.Now().UnixNano(), buf[:], domain)
+}
+
+//domainOf returns the domain part of a mail address
+func domainOf(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+//setDefaults fills the Date and the Message-ID of the mail when they
+//are not set
+func setDefaults(ms *MailStruct) {
+	if ms.Date.IsZero() {
+		ms.Date = time.Now()
+	}
+	if ms.MessageID == "" {
+		ms.MessageID = GenerateMessageID(domainOf(ms.From.Address))
+	}
+}
+
+//messageHeaders builds the headers of the mail, other than the
+//MIME ones, in the order they are written
+func messageHeaders(ms MailStruct) []headerField {
+	headers := []headerField{
+		{"Date", ms.Date.Format(time.RFC1123Z)},
+		{"From", formatAddress(ms.From)},
+	}
+	if len(ms.To) > 0 {
+		headers = append(headers, headerField{"To", joinAddresses(ms.To)})
+	} else if len(ms.Cc) == 0 {
+		//only Bcc recipients, which must not be disclosed
+		headers = append(headers, headerField{"To", "undisclosed-recipients:;"})
+	}
+	if len(ms.Cc) > 0 {
+		headers = append(headers, headerField{"Cc", joinAddresses(ms.Cc)})
+	}
+	if len(ms.ReplyTo) > 0 {
+		headers = append(headers, headerField{"Reply-To", joinAddresses(ms.ReplyTo)})
+	}
+	headers = append(headers,
+		headerField{"Subject", encodeHeader(ms.Subject)},
+		headerField{"Message-ID", "<" + ms.MessageID + ">"},
+	)
+	if ms.InReplyTo != "" {
+		headers = append(headers, headerField{"In-Reply-To", "<" + ms.InReplyTo + ">"})
+	}
+	if len(ms.References) > 0 {
+		headers = append(headers, headerField{"References", "<" + strings.Join(ms.References, "> <") + ">"})
+	}
+
+	custom := make(textproto.MIMEHeader)
+	for name, value := range ms.Headers {
+		custom.Set(name, encodeHeader(value))
+	}
+	return append(headers, sortedFields(custom)...)
+}
+
+//reservedHeaders are built from the fields of MailStruct and can not
+//be set through MailStruct.Headers
+var reservedHeaders = map[string]bool{
+	"Date": true, "From": true, "Sender": true, "To": true, "Cc": true, "Bcc": true,
+	"Reply-To": true, "Subject": true, "Message-Id": true, "In-Reply-To": true,
+	"References": true, "Mime-Version": true, "Content-Type": true,
+	"Content-Transfer-Encoding": true, "Content-Disposition": true, "Content-Id": true,
+}
+
+//ValidateHeader checks that a custom header has a valid name, is not one
+//of the headers built by the package and does not contain line breaks
+//that could be used to inject other headers
+func ValidateHeader(name string, value string) error {
+	if name == "" {
+		return fmt.Errorf("Empty header name")
+	}
+	for i := 0; i < len(name); i++ {
+		//RFC 5322 allows printable ASCII characters, except the colon
+		if name[i] <= ' ' || name[i] > '~' || name[i] == ':' {
+			return fmt.Errorf("Invalid header name %q", name)
+		}
+	}
+	if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return fmt.Errorf("Header %s can not be set directly", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("Header %s contains a line break", name)
+	}
+	return nil
+}
+
+//validateMessageID checks a Message-ID given without the angle brackets
+func validateMessageID(id string) error {
+	if strings.ContainsAny(id, "<> \t\r\n") || !strings.Contains(id, "@") {
+		return fmt.Errorf("Invalid Message-ID %q", id)
+	}
+	return nil
+}
+
+//ValidateHeaders checks the fields of the mail that end up in its
+//headers, so that none of them can inject additional headers
+func (ms MailStruct) ValidateHeaders() error {
+	if strings.ContainsAny(ms.Subject, "\r\n") {
+		return fmt.Errorf("Subject contains a line break")
+	}
+	for _, id := range append([]string{ms.MessageID, ms.InReplyTo}, ms.References...) {
+		if id == "" {
+			continue
+		}
+		if err := validateMessageID(id); err != nil {
+			return err
+		}
+	}
+	addresses := append(append(ms.Recipients(), ms.Envelope...), ms.From)
+	for _, address := range append(addresses, ms.ReplyTo...) {
+		if strings.ContainsAny(address.Name+address.Address, "\r\n") {
+			return fmt.Errorf("Address %q contains a line break", address.Address)
+		}
+	}
+	for _, image := range ms.Inline {
+		if image.ContentID == "" {
+			return fmt.Errorf("Inline attachment %s has no ContentID", image.Filename)
+		}
+		if strings.ContainsAny(image.ContentID, "<> \t\r\n") {
+			return fmt.Errorf("Invalid ContentID %q", image.ContentID)
+		}
+	}
+	for name, value := range ms.Headers {
+		if err := ValidateHeader(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sortedFields returns the MIME headers of a part sorted by name
+func sortedFields(header textproto.MIMEHeader) []headerField {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fields := make([]headerField, len(names))
+	for i, name := range names {
+		fields[i] = headerField{name, header.Get(name)}
+	}
+	return fields
+}
+
+func writeHeaders(w io.Writer, headers []headerField) error {
+	for _, header := range headers {
+		if _, err := io.WriteString(w, foldHeader(header.Name, header.Value)+"\r\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
@@ -0,0 +1,52 @@
+package mailsender
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	htmlHiddenRe  = regexp.MustCompile(`(?is)<(head|script|style)[^>]*>.*?</(head|script|style)\s*>`)
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlLinkRe    = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']([^"']*)["'][^>]*>(.*?)</a\s*>`)
+	htmlBreakRe   = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlItemRe    = regexp.MustCompile(`(?i)<li[^>]*>`)
+	htmlBlockRe   = regexp.MustCompile(`(?i)</?(p|div|h[1-6]|ul|ol|table|tr|blockquote|pre|hr)[^>]*>`)
+	htmlCellRe    = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	htmlTagRe     = regexp.MustCompile(`(?s)<[^>]*>`)
+	spacesRe      = regexp.MustCompile(`[ \t\r\f\v]+`)
+	emptyLinesRe  = regexp.MustCompile(`\n{3,}`)
+)
+
+//HTMLToText builds a plain text version of an HTML body.
+//It keeps the paragraphs, list items and the targets of the links,
+//which is enough for the text alternative of a mail.
+func HTMLToText(body string) string {
+	text := htmlHiddenRe.ReplaceAllString(body, "")
+	text = htmlCommentRe.ReplaceAllString(text, "")
+	text = htmlLinkRe.ReplaceAllStringFunc(text, func(link string) string {
+		match := htmlLinkRe.FindStringSubmatch(link)
+		label := strings.TrimSpace(htmlTagRe.ReplaceAllString(match[2], ""))
+		if label == "" || label == match[1] {
+			return match[1]
+		}
+		return label + " (" + match[1] + ")"
+	})
+	//the whitespace of the source has no meaning in HTML
+	text = strings.NewReplacer("\r\n", " ", "\n", " ").Replace(text)
+	text = htmlBreakRe.ReplaceAllString(text, "\n")
+	text = htmlItemRe.ReplaceAllString(text, "\n* ")
+	text = htmlBlockRe.ReplaceAllString(text, "\n\n")
+	text = htmlCellRe.ReplaceAllString(text, " ")
+	text = htmlTagRe.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = spacesRe.ReplaceAllString(text, " ")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	text = emptyLinesRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,121 @@
+//Package mimeparse decodes the MIME mails built by mailsender, for the
+//test server of mailsendertest and the catcher of the service
+package mimeparse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+//Message is a decoded mail
+type Message struct {
+	//Header holds the parsed headers and Subject the decoded subject
+	Header  mail.Header
+	Subject string
+	//Text and HTML are the decoded text/plain and text/html bodies
+	Text string
+	HTML string
+	//Attachments holds the other parts, inline images included
+	Attachments []Attachment
+	//Err is set when the content is not a valid MIME mail. The other
+	//fields are then incomplete.
+	Err error
+}
+
+//Attachment is a decoded part of a mail
+type Attachment struct {
+	Filename    string
+	ContentType string
+	//ContentID is the Content-ID without its angle brackets
+	ContentID string
+	Inline    bool
+	Data      []byte
+}
+
+//Parse decodes raw, a mail with its headers
+func Parse(raw []byte) *Message {
+	m := &Message{}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		m.Err = err
+		return m
+	}
+	m.Header = parsed.Header
+	decoder := new(mime.WordDecoder)
+	if m.Subject, err = decoder.DecodeHeader(parsed.Header.Get("Subject")); err != nil {
+		m.Subject = parsed.Header.Get("Subject")
+	}
+	m.Err = m.readPart(parsed.Header.Get("Content-Type"), parsed.Header.Get("Content-Transfer-Encoding"), parsed.Header.Get("Content-Disposition"), parsed.Header.Get("Content-ID"), parsed.Body)
+	return m
+}
+
+//readPart walks the MIME tree of the mail, keeping the first text and
+//HTML bodies and the other leaves as attachments
+func (m *Message) readPart(contentType string, encoding string, disposition string, contentID string, body io.Reader) error {
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = m.readPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part.Header.Get("Content-Disposition"), part.Header.Get("Content-ID"), part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	dispositionType, dispositionParams, _ := mime.ParseMediaType(disposition)
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if dispositionType != "attachment" && filename == "" && contentID == "" {
+		switch {
+		case mediaType == "text/plain" && m.Text == "":
+			m.Text = string(data)
+			return nil
+		case mediaType == "text/html" && m.HTML == "":
+			m.HTML = string(data)
+			return nil
+		}
+	}
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		ContentID:   strings.Trim(contentID, "<>"),
+		Inline:      dispositionType == "inline",
+		Data:        data,
+	})
+	return nil
+}
@@ -1,51 +1,169 @@
 package mailsender
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/mail"
 	"net/smtp"
+	"strings"
+	"time"
+)
+
+//ErrNoRecipients is returned when a mail has no To, Cc or Bcc address
+var ErrNoRecipients = errors.New("No recipients provided")
+
+//ErrAllRecipientsRejected is wrapped in the SMTPError returned when the
+//server refused every recipient
+var ErrAllRecipientsRejected = errors.New("All recipients were rejected by the server")
+
+//ErrStartTLSNotSupported is returned when STARTTLS is mandatory but the
+//server does not offer it
+var ErrStartTLSNotSupported = errors.New("The server does not support STARTTLS")
+
+//TLSMode tells how the connection to the mail server is secured
+type TLSMode string
+
+const (
+	//TLSNone sends everything unencrypted
+	TLSNone TLSMode = "none"
+	//TLSOpportunistic upgrades the connection with STARTTLS when the
+	//server offers it and continues unencrypted otherwise
+	TLSOpportunistic TLSMode = "opportunistic"
+	//TLSStartTLS requires the connection to be upgraded with STARTTLS,
+	//as done for submission on port 587
+	TLSStartTLS TLSMode = "starttls"
+	//TLSImplicit starts TLS right after connecting, as done on port 465
+	TLSImplicit TLSMode = "implicit"
 )
 
 //MailSender contains the methods for sending mail
 type MailSender interface {
-	SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (int, error)
-	SendMail(server string, usermail string, pass string, ms MailStruct) (int, error)
-	SendMailWithoutAuth(server string, ms MailStruct) (int, error)
+	SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error)
+	SendMailStartTLS(server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error)
+	SendMail(server string, usermail string, pass string, ms MailStruct) (*Result, error)
+	SendMailWithoutAuth(server string, ms MailStruct) (*Result, error)
+}
+
+//ContextMailSender contains the methods for sending mail that stop
+//as soon as the context is done
+type ContextMailSender interface {
+	SendMailTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error)
+	SendMailStartTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error)
+	SendMailContext(ctx context.Context, server string, usermail string, pass string, ms MailStruct) (*Result, error)
+	SendMailWithoutAuthContext(ctx context.Context, server string, ms MailStruct) (*Result, error)
 }
 
 //MailStruct holds the basic mail fields
 type MailStruct struct {
-	From     mail.Address
-	To       mail.Address
-	Subject  string
+	From    mail.Address
+	To      []mail.Address
+	Cc      []mail.Address
+	Bcc     []mail.Address
+	ReplyTo []mail.Address
+	Subject string
+	//Date is set to the current time when it is zero
+	Date time.Time
+	//MessageID is the Message-ID of the mail, without the angle brackets.
+	//A new one is generated when it is empty.
+	MessageID string
+	//InReplyTo and References hold the Message-IDs, without the angle
+	//brackets, of the mails this one answers
+	InReplyTo  string
+	References []string
+	//Headers holds additional headers such as List-Unsubscribe,
+	//X-Priority or any X- header
+	Headers  map[string]string
 	Body     string
-	Password string
+	HTMLBody string
+	//TextFromHTML generates the text alternative from HTMLBody
+	//when Body is empty
+	TextFromHTML bool
+	//Inline holds the images referenced from HTMLBody by their ContentID
+	Inline      []Attachment
+	Attachments []Attachment
+	Password    string
+	//DKIM signs the mail when it is set
+	DKIM *DKIMSigner `json:"-"`
+	//SMIME signs the content of the mail with S/MIME when it is set
+	SMIME *SMIMESigner `json:"-"`
+	//SMIMERecipients encrypts the content of the mail, signed first if
+	//SMIME is set, for the holders of these certificates
+	SMIMERecipients []*x509.Certificate `json:"-"`
+	//PGP signs the content of the mail with OpenPGP when it is set. Its
+	//secret key must be unlocked.
+	PGP *PGPKey `json:"-"`
+	//PGPRecipients encrypts the content of the mail, signed first if
+	//PGP is set, for the holders of these OpenPGP keys
+	PGPRecipients []*PGPKey `json:"-"`
+	//Envelope, when it is set, lists the addresses the mail is delivered
+	//to instead of its To, Cc and Bcc, which are still written in the
+	//headers. It sends the mail again to some of its recipients only.
+	Envelope []mail.Address
+
+	//rendered is the message built by Render, sent instead of building
+	//it again
+	rendered []byte
 }
 
-//Impl implements the sender
-type Impl struct {
-	MailSender
+//Result holds the outcome of sending a mail.
+//When some of the recipients are refused by the server the mail is
+//still sent to the others and the refused ones are listed in Rejected.
+type Result struct {
+	MessageID string
+	Bytes     int
+	Accepted  []mail.Address
+	Rejected  []RecipientError
 }
 
-func messageFromMailStruct(ms MailStruct) []byte {
-	headers := make(map[string]string)
-	headers["From"] = ms.From.String()
-	headers["To"] = ms.To.String()
-	headers["Subject"] = ms.Subject
+//RecipientError describes a recipient refused by the server
+type RecipientError struct {
+	Address mail.Address
+	Err     error
+}
 
-	var message string
+func (re RecipientError) Error() string {
+	return fmt.Sprintf("%s: %s", re.Address.Address, re.Err.Error())
+}
+
+//Recipients returns all the addresses of the To, Cc and Bcc lists
+func (ms MailStruct) Recipients() []mail.Address {
+	recipients := make([]mail.Address, 0, len(ms.To)+len(ms.Cc)+len(ms.Bcc))
+	recipients = append(recipients, ms.To...)
+	recipients = append(recipients, ms.Cc...)
+	return append(recipients, ms.Bcc...)
+}
 
-	for k, v := range headers {
-		message += fmt.Sprintf("%s: %s\r\n", k, v)
+//envelope returns the addresses the mail is delivered to: Envelope
+//when it is set, the recipients otherwise
+func (ms MailStruct) envelope() []mail.Address {
+	if ms.Envelope != nil {
+		return ms.Envelope
 	}
-	message += "\r\n" + ms.Body
+	return ms.Recipients()
+}
 
-	return []byte(message)
+func joinAddresses(addresses []mail.Address) string {
+	list := make([]string, len(addresses))
+	for i, address := range addresses {
+		list[i] = formatAddress(address)
+	}
+	return strings.Join(list, ", ")
+}
 
+//Impl implements the sender
+type Impl struct {
+	MailSender
+	//AuthMechanism pins the SASL mechanism used to authenticate, for
+	//example AuthLogin or AuthXOAuth2. When it is empty the mechanism
+	//is chosen from the ones the server advertises.
+	AuthMechanism string
+	//Timeouts limits the phases of sending a mail
+	Timeouts Timeouts
 }
 
 //CreateTLSConfigWithCA will create a tls configuration that will
@@ -89,105 +207,78 @@ func CreateTLSConfig(serverName string) *tls.Config {
 }
 
 //SendMailTLS send the mail after the tls params have been set
-func (impl *Impl) SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (int, error) {
-	host, _, err := net.SplitHostPort(server)
-	if err != nil {
-		return 0, err
-	}
+func (impl *Impl) SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return impl.SendMailTLSContext(context.Background(), server, tlsconfig, usermail, pass, ms)
+}
 
-	auth := smtp.PlainAuth("", usermail, pass, host)
+//SendMailTLSContext is SendMailTLS stopping when ctx is done
+func (impl *Impl) SendMailTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return impl.send(ctx, server, TLSImplicit, tlsconfig, usermail, pass, ms)
+}
 
-	conn, err := tls.Dial("tcp", server, tlsconfig)
+//SendMailStartTLS connects unencrypted and upgrades the connection with
+//STARTTLS before authenticating. When mandatory is set and the server does
+//not offer STARTTLS, ErrStartTLSNotSupported is returned and the credentials
+//are never sent. No authentication is done when usermail is empty.
+func (impl *Impl) SendMailStartTLS(server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return impl.SendMailStartTLSContext(context.Background(), server, tlsconfig, mandatory, usermail, pass, ms)
+}
 
-	if err != nil {
-		return 0, err
+//SendMailStartTLSContext is SendMailStartTLS stopping when ctx is done
+func (impl *Impl) SendMailStartTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error) {
+	mode := TLSOpportunistic
+	if mandatory {
+		mode = TLSStartTLS
 	}
-
-	defer conn.Close()
-
-	return sendMailWithConnAndAuth(conn, host, ms, auth)
-
+	return impl.send(ctx, server, mode, tlsconfig, usermail, pass, ms)
 }
 
 //SendMail will send a mail using authentication without encryption
-func (impl *Impl) SendMail(server string, usermail string, pass string, ms MailStruct) (int, error) {
-
-	host, _, err := net.SplitHostPort(server)
-	if err != nil {
-		return 0, err
-	}
-
-	auth := smtp.PlainAuth("", usermail, pass, host)
-
-	conn, err := net.Dial("tcp", server)
-
-	if err != nil {
-		return 0, nil
-	}
+func (impl *Impl) SendMail(server string, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return impl.SendMailContext(context.Background(), server, usermail, pass, ms)
+}
 
-	return sendMailWithConnAndAuth(conn, host, ms, auth)
+//SendMailContext is SendMail stopping when ctx is done
+func (impl *Impl) SendMailContext(ctx context.Context, server string, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return impl.send(ctx, server, TLSNone, nil, usermail, pass, ms)
 }
 
 //SendMailWithoutAuth sends a mail without using authentication
-func (impl *Impl) SendMailWithoutAuth(server string, ms MailStruct) (int, error) {
-	host, _, err := net.SplitHostPort(server)
-	if err != nil {
-		return 0, err
-	}
-	conn, err := net.Dial("tcp", server)
-	if err != nil {
-		return 0, nil
-	}
-
-	client, err := smtp.NewClient(conn, host)
-	if err != nil {
-		return 0, err
-	}
-
-	return sendMailWithClient(client, ms)
+func (impl *Impl) SendMailWithoutAuth(server string, ms MailStruct) (*Result, error) {
+	return impl.SendMailWithoutAuthContext(context.Background(), server, ms)
 }
 
-//SendMailWithClient sends the mail after the client has been set up
-func sendMailWithClient(client *smtp.Client, ms MailStruct) (int, error) {
-
-	defer client.Quit()
-
-	if err := client.Mail(ms.From.Address); err != nil {
-		return 0, err
-	}
-
-	if err := client.Rcpt(ms.To.Address); err != nil {
-		return 0, err
-	}
-
-	writer, err := client.Data()
-
-	if err != nil {
-		return 0, err
-	}
-
-	defer writer.Close()
-
-	n, err := writer.Write(messageFromMailStruct(ms))
+//SendMailWithoutAuthContext is SendMailWithoutAuth stopping when ctx is done
+func (impl *Impl) SendMailWithoutAuthContext(ctx context.Context, server string, ms MailStruct) (*Result, error) {
+	return impl.send(ctx, server, TLSNone, nil, "", "", ms)
+}
 
-	if err != nil {
-		return 0, err
+//send runs a whole session: it connects to server, secures the
+//connection as asked by mode, authenticates when usermail is set
+//and sends the mail
+func (impl *Impl) send(ctx context.Context, server string, mode TLSMode, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	var auth smtp.Auth
+	if usermail != "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, newSMTPError(StageDial, err)
+		}
+		if auth, err = impl.newAuth(usermail, pass, host); err != nil {
+			return nil, newSMTPError(StageAuth, err)
+		}
 	}
 
-	return n, nil
-
-}
-
-//SendMailWithConnAndAuth sends the mail using a setup conn and an authentication
-func sendMailWithConnAndAuth(conn net.Conn, host string, ms MailStruct, auth smtp.Auth) (int, error) {
-	client, err := smtp.NewClient(conn, host)
+	s, err := dialSession(ctx, server, mode, tlsconfig, impl.Timeouts, "")
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer s.close()
 
-	if err = client.Auth(auth); err != nil {
-		return 0, err
+	if auth != nil {
+		if err = s.authenticate(auth); err != nil {
+			return nil, err
+		}
 	}
 
-	return sendMailWithClient(client, ms)
+	return s.send(ms)
 }
@@ -0,0 +1,196 @@
+package mailsender_test
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendMailMultipleRecipients(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	server.RejectRecipient("missing@server.com")
+
+	ms := mailsender.MailStruct{
+		From:    mail.Address{Address: "src@server.com"},
+		To:      []mail.Address{{Name: "To", Address: "to@server.com"}, {Address: "missing@server.com"}},
+		Cc:      []mail.Address{{Name: "Cc", Address: "cc@server.com"}},
+		Bcc:     []mail.Address{{Name: "Hidden", Address: "bcc@server.com"}},
+		Subject: "test",
+		Body:    "body",
+	}
+
+	impl := mailsender.Impl{}
+	result, err := impl.SendMailWithoutAuth(server.Addr, ms)
+	assert.Nil(err, "No error expected when only some recipients are rejected, got %v\n", err)
+	assert.Equal([]mail.Address{ms.To[0], ms.Cc[0], ms.Bcc[0]}, result.Accepted)
+	assert.Len(result.Rejected, 1)
+	assert.Equal("missing@server.com", result.Rejected[0].Address.Address)
+	assert.True(strings.HasSuffix(result.MessageID, "@server.com"), "Unexpected Message-ID %s", result.MessageID)
+
+	messages := server.Messages()
+	assert.Len(messages, 1)
+	assert.Equal([]string{"to@server.com", "cc@server.com", "bcc@server.com"}, messages[0].To)
+
+	header := messages[0].Header
+	assert.Equal(`"To" <to@server.com>, <missing@server.com>`, header.Get("To"))
+	assert.Equal(`"Cc" <cc@server.com>`, header.Get("Cc"))
+	assert.Equal("<"+result.MessageID+">", header.Get("Message-Id"))
+	assert.NotEmpty(header.Get("Date"))
+	assert.Empty(header.Get("Bcc"), "Bcc must not be rendered in the headers")
+	assert.NotContains(string(messages[0].Raw), "bcc@server.com")
+}
+
+func TestSendMailEnvelope(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	ms := mailsender.MailStruct{
+		From:     mail.Address{Address: "src@server.com"},
+		To:       []mail.Address{{Address: "to@server.com"}},
+		Cc:       []mail.Address{{Address: "cc@server.com"}},
+		Envelope: []mail.Address{{Address: "cc@server.com"}},
+	}
+	impl := mailsender.Impl{}
+	result, err := impl.SendMailWithoutAuth(server.Addr, ms)
+	assert.Nil(err, "No error expected, got %v", err)
+	assert.Equal(ms.Envelope, result.Accepted)
+
+	messages := server.Messages()
+	if assert.Len(messages, 1) {
+		assert.Equal([]string{"cc@server.com"}, messages[0].To)
+		assert.Equal("<to@server.com>", messages[0].Header.Get("To"))
+		assert.Equal("<cc@server.com>", messages[0].Header.Get("Cc"))
+	}
+}
+
+func TestSendMailAllRecipientsRejected(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	server.RejectRecipient("missing@server.com")
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		Bcc:  []mail.Address{{Address: "missing@server.com"}},
+	}
+
+	impl := mailsender.Impl{}
+	result, err := impl.SendMailWithoutAuth(server.Addr, ms)
+	assert.True(errors.Is(err, mailsender.ErrAllRecipientsRejected), "Expected ErrAllRecipientsRejected, got %v", err)
+	assert.Len(result.Rejected, 1)
+	assert.Empty(server.Messages())
+
+	_, err = impl.SendMailWithoutAuth(server.Addr, mailsender.MailStruct{From: ms.From})
+	assert.True(errors.Is(err, mailsender.ErrNoRecipients), "Expected ErrNoRecipients, got %v", err)
+}
+
+func TestSendMailErrorStages(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	server.RejectRecipient("missing@server.com")
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "missing@server.com"}},
+	}
+
+	impl := mailsender.Impl{}
+	result, err := impl.SendMailWithoutAuth(server.Addr, ms)
+	smtpErr, ok := err.(*mailsender.SMTPError)
+	if assert.True(ok, "SMTPError expected, got %v", err) {
+		assert.Equal(mailsender.StageRcpt, smtpErr.Stage)
+		assert.Equal(550, smtpErr.Code)
+		assert.Equal("5.1.1", smtpErr.EnhancedCode)
+		assert.Equal("5.1.1", result.Rejected[0].Err.(*mailsender.SMTPError).EnhancedCode)
+	}
+
+	auth := mailsendertest.NewUnstartedServer()
+	auth.Users = map[string]string{"src@server.com": "secret"}
+	auth.Start()
+	defer auth.Close()
+	_, err = impl.SendMail(auth.Addr, "src@server.com", "wrong", ms)
+	smtpErr, ok = err.(*mailsender.SMTPError)
+	if assert.True(ok, "SMTPError expected, got %v", err) {
+		assert.Equal(mailsender.StageAuth, smtpErr.Stage)
+		assert.Equal(535, smtpErr.Code)
+		assert.True(smtpErr.Permanent())
+	}
+
+	server.Close()
+	_, err = impl.SendMailWithoutAuth(server.Addr, ms)
+	smtpErr, ok = err.(*mailsender.SMTPError)
+	if assert.True(ok, "SMTPError expected, got %v", err) {
+		assert.Equal(mailsender.StageDial, smtpErr.Stage)
+		assert.True(smtpErr.Temporary())
+	}
+}
+
+func TestSendMailStartTLS(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.STARTTLS = true
+	server.Users = map[string]string{"src@server.com": "secret"}
+	server.Start()
+	defer server.Close()
+	anonymous := mailsendertest.NewUnstartedServer()
+	anonymous.STARTTLS = true
+	anonymous.Start()
+	defer anonymous.Close()
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+		Body: "over tls",
+	}
+
+	impl := mailsender.Impl{}
+	_, err := impl.SendMailStartTLS(server.Addr, server.ClientTLSConfig(), true, "src@server.com", "secret", ms)
+	assert.Nil(err, "No error expected, got %v\n", err)
+	_, err = impl.SendMailStartTLS(anonymous.Addr, anonymous.ClientTLSConfig(), false, "", "", ms)
+	assert.Nil(err, "No error expected, got %v\n", err)
+
+	messages := server.Messages()
+	if assert.Len(messages, 1) {
+		assert.True(messages[0].TLS, "The message should have been sent over TLS")
+		assert.Equal("src@server.com", messages[0].User)
+	}
+	messages = anonymous.Messages()
+	if assert.Len(messages, 1) {
+		assert.True(messages[0].TLS, "The message should have been sent over TLS")
+		assert.Equal("", messages[0].User)
+	}
+}
+
+func TestSendMailStartTLSNotOffered(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.Users = map[string]string{"src@server.com": "secret"}
+	server.Start()
+	defer server.Close()
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+	}
+
+	impl := mailsender.Impl{}
+	_, err := impl.SendMailStartTLS(server.Addr, nil, true, "src@server.com", "secret", ms)
+	assert.True(errors.Is(err, mailsender.ErrStartTLSNotSupported), "Expected ErrStartTLSNotSupported, got %v", err)
+	assert.Empty(server.Messages(), "Nothing should be sent when STARTTLS is mandatory but not offered")
+
+	_, err = impl.SendMailStartTLS(server.Addr, nil, false, "src@server.com", "secret", ms)
+	assert.Nil(err, "Opportunistic STARTTLS should continue unencrypted, got %v\n", err)
+	messages := server.Messages()
+	if assert.Len(messages, 1) {
+		assert.False(messages[0].TLS)
+	}
+}
@@ -0,0 +1,85 @@
+package mailsendertest
+
+import (
+	"net/mail"
+
+	"github.com/adiclepcea/mailsender/internal/mimeparse"
+)
+
+//Message is a mail received by the server
+type Message struct {
+	//From and To are the envelope addresses given to MAIL and RCPT
+	From string
+	To   []string
+	//Raw is the content as it was received, headers included, with its
+	//lines ending in CRLF
+	Raw []byte
+	//TLS tells if the mail came after STARTTLS, User and Mechanism who
+	//authenticated the session and how
+	TLS       bool
+	User      string
+	Mechanism string
+
+	//Header holds the parsed headers and Subject the decoded subject
+	Header  mail.Header
+	Subject string
+	//Text and HTML are the decoded text/plain and text/html bodies
+	Text string
+	HTML string
+	//Attachments holds the other parts, inline images included
+	Attachments []Attachment
+	//ParseError is set when the content is not a valid MIME mail. The
+	//parsed fields are then incomplete.
+	ParseError error
+}
+
+//Attachment is a decoded part of a received mail
+type Attachment struct {
+	Filename    string
+	ContentType string
+	//ContentID is the Content-ID without its angle brackets
+	ContentID string
+	Inline    bool
+	Data      []byte
+}
+
+//Attachment returns the attachment named filename, nil when there is
+//none
+func (m *Message) Attachment(filename string) *Attachment {
+	for i := range m.Attachments {
+		if m.Attachments[i].Filename == filename {
+			return &m.Attachments[i]
+		}
+	}
+	return nil
+}
+
+//newMessage parses the content of a received mail
+func newMessage(from string, to []string, data []byte, secure bool, user string, mechanism string) *Message {
+	m := ParseMessage(data)
+	m.From = from
+	m.To = append([]string(nil), to...)
+	m.TLS = secure
+	m.User = user
+	m.Mechanism = mechanism
+	return m
+}
+
+//ParseMessage parses raw, a mail with its headers, into a Message whose
+//envelope and session fields are left empty. It reads the mails kept by
+//other means than the Server, as by a mailsender.MemoryTransport.
+func ParseMessage(raw []byte) *Message {
+	parsed := mimeparse.Parse(raw)
+	m := &Message{
+		Raw:        raw,
+		Header:     parsed.Header,
+		Subject:    parsed.Subject,
+		Text:       parsed.Text,
+		HTML:       parsed.HTML,
+		ParseError: parsed.Err,
+	}
+	for _, attachment := range parsed.Attachments {
+		m.Attachments = append(m.Attachments, Attachment(attachment))
+	}
+	return m
+}
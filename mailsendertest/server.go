@@ -0,0 +1,678 @@
+//Package mailsendertest provides an in-process SMTP server to test the
+//code sending mails, in the manner of net/http/httptest.
+//
+//The server listens on a random port of 127.0.0.1, supports EHLO,
+//STARTTLS with a generated certificate and AUTH PLAIN, LOGIN, CRAM-MD5,
+//XOAUTH2 and OAUTHBEARER, and keeps the mails it receives, parsed, so
+//the tests can check their headers, bodies and attachments. Failures can
+//be injected to exercise the error paths: refused recipients, replies to
+//DATA, dropped connections and servers that stop answering.
+package mailsendertest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Server is an SMTP server receiving mails in memory
+type Server struct {
+	//Addr is the address the server listens on, as host:port
+	Addr string
+	//Hostname is announced in the greeting and the EHLO reply,
+	//localhost when it is empty
+	Hostname string
+	//STARTTLS offers STARTTLS with a certificate generated for
+	//127.0.0.1 and localhost. ClientTLSConfig returns a configuration
+	//trusting it.
+	STARTTLS bool
+	//RequireTLS refuses the mails sent before STARTTLS
+	RequireTLS bool
+	//Users enables AUTH PLAIN, LOGIN and CRAM-MD5 for these users, the
+	//values being the passwords. Authentication is then required to
+	//send.
+	Users map[string]string
+	//Tokens enables AUTH XOAUTH2 and OAUTHBEARER for these users, the
+	//values being their OAuth2 access tokens
+	Tokens map[string]string
+	//Mechanisms lists the SASL mechanisms offered in the EHLO reply. By
+	//default PLAIN and LOGIN are offered with Users and XOAUTH2 and
+	//OAUTHBEARER with Tokens.
+	Mechanisms []string
+	//MaxMessages makes the server reply 421 to MAIL and close the
+	//connection once this number of mails was received on it, as the
+	//servers limiting the mails per connection do
+	MaxMessages int
+
+	listener  net.Listener
+	tlsConfig *tls.Config
+	roots     *x509.CertPool
+	wg        sync.WaitGroup
+
+	mu       sync.Mutex
+	closed   bool
+	conns    map[net.Conn]bool
+	messages []*Message
+	received chan struct{}
+	rejected map[string]bool
+	replies  map[string]string
+	drops    map[string]bool
+	stall    string
+	//connections and commands count the connections accepted and the
+	//commands received by verb
+	connections int
+	commands    map[string]int
+}
+
+//NewServer starts a server accepting any mail without authentication
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+//NewUnstartedServer returns a server that is not listening yet, to be
+//set up then started with Start
+func NewUnstartedServer() *Server {
+	return &Server{
+		conns:    make(map[net.Conn]bool),
+		received: make(chan struct{}),
+		rejected: make(map[string]bool),
+		replies:  make(map[string]string),
+		drops:    make(map[string]bool),
+		commands: make(map[string]int),
+	}
+}
+
+//Start listens on a random port of 127.0.0.1 and serves the connections
+//in the background. It panics when the server can not listen, as
+//httptest does.
+func (s *Server) Start() {
+	if s.listener != nil {
+		panic("mailsendertest: the server is already started")
+	}
+	if s.STARTTLS {
+		if err := s.generateCertificate(); err != nil {
+			panic(fmt.Sprintf("mailsendertest: could not generate a certificate: %v", err))
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("mailsendertest: could not listen: %v", err))
+	}
+	s.listener = listener
+	s.Addr = listener.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+}
+
+//Close stops the server and closes the open connections
+func (s *Server) Close() {
+	if s.listener == nil {
+		return
+	}
+	s.listener.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+//Host returns the host part of Addr
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	return host
+}
+
+//ClientTLSConfig returns a client configuration trusting the
+//certificate of the server, nil when STARTTLS is not enabled
+func (s *Server) ClientTLSConfig() *tls.Config {
+	if s.roots == nil {
+		return nil
+	}
+	return &tls.Config{RootCAs: s.roots, ServerName: s.Host()}
+}
+
+//Messages returns the mails received so far, in the order they came
+func (s *Server) Messages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.messages...)
+}
+
+//WaitForMessages waits until n mails were received, as when they are
+//sent in the background, and returns them. It fails after timeout.
+func (s *Server) WaitForMessages(n int, timeout time.Duration) ([]*Message, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		messages := append([]*Message(nil), s.messages...)
+		received := s.received
+		s.mu.Unlock()
+		if len(messages) >= n {
+			return messages, nil
+		}
+		select {
+		case <-received:
+		case <-deadline:
+			return messages, fmt.Errorf("Received %d mails instead of %d", len(messages), n)
+		}
+	}
+}
+
+//Reset forgets the received mails, the injected failures and the
+//counts of connections and commands
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+	s.rejected = make(map[string]bool)
+	s.replies = make(map[string]string)
+	s.drops = make(map[string]bool)
+	s.stall = ""
+	s.connections = 0
+	s.commands = make(map[string]int)
+}
+
+//Connections returns the number of connections accepted
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+//Commands returns the number of verb commands received, as NOOP
+func (s *Server) Commands(verb string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[strings.ToUpper(verb)]
+}
+
+//CloseConnections closes the open connections, as a server does with
+//the idle ones
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+//RejectRecipient refuses the address with a 550 in reply to RCPT
+func (s *Server) RejectRecipient(address string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected[strings.ToLower(address)] = true
+}
+
+//FailData replies to the DATA command with code and text instead of
+//accepting the content, as "451 4.3.0 Try again later"
+func (s *Server) FailData(code int, text string) {
+	s.FailCommand("DATA", code, text)
+}
+
+//FailCommand replies to every verb command, as MAIL or RCPT, with code
+//and text. "." replies at the end of the mail content instead of
+//accepting it.
+func (s *Server) FailCommand(verb string, code int, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies[strings.ToUpper(verb)] = fmt.Sprintf("%d %s", code, text)
+}
+
+//DropConnection closes the connection without replying when the verb
+//command is received. "." drops it at the end of the mail content,
+//before it is accepted.
+func (s *Server) DropConnection(verb string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drops[strings.ToUpper(verb)] = true
+}
+
+//Stall stops replying, leaving the connection open, when the verb
+//command is received, to exercise the timeouts of the clients.
+//"GREETING" stalls right after the connection, before the greeting.
+func (s *Server) Stall(verb string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stall = strings.ToUpper(verb)
+}
+
+//command counts the verb command and returns the injected reply to it,
+//whether the connection must be dropped and whether the server must
+//stop replying
+func (s *Server) command(verb string) (string, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands[verb]++
+	return s.replies[verb], s.drops[verb], s.stall == verb
+}
+
+//fault returns the injected reply to verb and whether the connection
+//must be dropped
+func (s *Server) fault(verb string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replies[verb], s.drops[verb]
+}
+
+//hang keeps the connection open without replying until the client
+//closes it
+func hang(conn net.Conn) {
+	io.Copy(ioutil.Discard, conn)
+}
+
+//mechanisms returns the SASL mechanisms offered
+func (s *Server) mechanisms() []string {
+	if len(s.Mechanisms) > 0 {
+		return s.Mechanisms
+	}
+	var mechanisms []string
+	if len(s.Users) > 0 {
+		mechanisms = append(mechanisms, "PLAIN", "LOGIN")
+	}
+	if len(s.Tokens) > 0 {
+		mechanisms = append(mechanisms, "XOAUTH2", "OAUTHBEARER")
+	}
+	return mechanisms
+}
+
+//isRejected tells if the recipient is refused
+func (s *Server) isRejected(address string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected[strings.ToLower(address)]
+}
+
+//receive keeps a mail and wakes up WaitForMessages
+func (s *Server) receive(message *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, message)
+	close(s.received)
+	s.received = make(chan struct{})
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+//session is the state of an SMTP connection
+type session struct {
+	conn    net.Conn
+	tp      *textproto.Conn
+	secure  bool
+	user    string
+	mech    string
+	from    string
+	to      []string
+	hasMail bool
+}
+
+//handle runs the SMTP dialog of a connection
+func (s *Server) handle(conn net.Conn) {
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	s.mu.Lock()
+	s.connections++
+	stall := s.stall
+	s.mu.Unlock()
+	if stall == "GREETING" {
+		hang(conn)
+		return
+	}
+
+	mechanisms := s.mechanisms()
+	received := 0
+	ss := &session{conn: conn, tp: textproto.NewConn(conn)}
+	ss.tp.PrintfLine("220 %s ESMTP mailsendertest", hostname)
+	for {
+		line, err := ss.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			ss.tp.PrintfLine("500 5.5.2 Syntax error")
+			continue
+		}
+		verb := strings.ToUpper(fields[0])
+		reply, drop, stall := s.command(verb)
+		if stall {
+			hang(ss.conn)
+			return
+		}
+		if drop {
+			return
+		}
+		if reply != "" {
+			ss.tp.PrintfLine("%s", reply)
+			continue
+		}
+
+		switch verb {
+		case "EHLO":
+			ss.reset()
+			ss.tp.PrintfLine("250-%s", hostname)
+			if s.STARTTLS && !ss.secure {
+				ss.tp.PrintfLine("250-STARTTLS")
+			}
+			if len(mechanisms) > 0 {
+				ss.tp.PrintfLine("250-AUTH %s", strings.Join(mechanisms, " "))
+			}
+			ss.tp.PrintfLine("250-PIPELINING")
+			ss.tp.PrintfLine("250 8BITMIME")
+		case "HELO":
+			ss.reset()
+			ss.tp.PrintfLine("250 %s", hostname)
+		case "STARTTLS":
+			if !s.STARTTLS || ss.secure {
+				ss.tp.PrintfLine("502 5.5.1 STARTTLS not available")
+				continue
+			}
+			ss.tp.PrintfLine("220 2.0.0 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			//the session starts over, RFC 3207 4.2
+			*ss = session{conn: tlsConn, tp: textproto.NewConn(tlsConn), secure: true}
+		case "AUTH":
+			switch {
+			case len(mechanisms) == 0:
+				ss.tp.PrintfLine("502 5.5.1 AUTH not available")
+			case ss.user != "":
+				ss.tp.PrintfLine("503 5.5.1 Already authenticated")
+			default:
+				user, err := s.authenticate(ss.tp, mechanisms, fields[1:])
+				if err != nil {
+					ss.tp.PrintfLine("535 5.7.8 Authentication credentials invalid")
+					continue
+				}
+				ss.user, ss.mech = user, strings.ToUpper(fields[1])
+				ss.tp.PrintfLine("235 2.7.0 Authentication successful")
+			}
+		case "MAIL":
+			switch {
+			case s.RequireTLS && !ss.secure:
+				ss.tp.PrintfLine("530 5.7.0 Must issue a STARTTLS command first")
+			case len(mechanisms) > 0 && ss.user == "":
+				ss.tp.PrintfLine("530 5.7.0 Authentication required")
+			case s.MaxMessages > 0 && received >= s.MaxMessages:
+				ss.tp.PrintfLine("421 4.7.0 Too many messages, closing connection")
+				return
+			case ss.hasMail:
+				ss.tp.PrintfLine("503 5.5.1 Sender already given")
+			default:
+				from, ok := pathArgument(line, "FROM")
+				if !ok {
+					ss.tp.PrintfLine("501 5.5.4 Syntax: MAIL FROM:<address>")
+					continue
+				}
+				ss.from, ss.hasMail = from, true
+				ss.tp.PrintfLine("250 2.1.0 OK")
+			}
+		case "RCPT":
+			to, ok := pathArgument(line, "TO")
+			switch {
+			case !ss.hasMail:
+				ss.tp.PrintfLine("503 5.5.1 MAIL first")
+			case !ok || to == "":
+				ss.tp.PrintfLine("501 5.5.4 Syntax: RCPT TO:<address>")
+			case s.isRejected(to):
+				ss.tp.PrintfLine("550 5.1.1 <%s>: Recipient address rejected", to)
+			default:
+				ss.to = append(ss.to, to)
+				ss.tp.PrintfLine("250 2.1.5 OK")
+			}
+		case "DATA":
+			if len(ss.to) == 0 {
+				ss.tp.PrintfLine("503 5.5.1 RCPT first")
+				continue
+			}
+			ss.tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := ss.tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			//the lines are read ending in LF, they were sent with CRLF
+			data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+			if reply, drop := s.fault("."); drop {
+				return
+			} else if reply != "" {
+				ss.reset()
+				ss.tp.PrintfLine("%s", reply)
+				continue
+			}
+			s.receive(newMessage(ss.from, ss.to, data, ss.secure, ss.user, ss.mech))
+			received++
+			ss.reset()
+			ss.tp.PrintfLine("250 2.0.0 OK queued")
+		case "RSET":
+			ss.reset()
+			ss.tp.PrintfLine("250 2.0.0 OK")
+		case "NOOP":
+			ss.tp.PrintfLine("250 2.0.0 OK")
+		case "VRFY":
+			ss.tp.PrintfLine("252 2.0.0 Cannot VRFY user")
+		case "QUIT":
+			ss.tp.PrintfLine("221 2.0.0 Bye")
+			return
+		default:
+			ss.tp.PrintfLine("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+//reset forgets the mail in progress
+func (ss *session) reset() {
+	ss.from, ss.to, ss.hasMail = "", nil, false
+}
+
+//pathArgument returns the address of "MAIL FROM:<address> params" or
+//"RCPT TO:<address> params"
+func pathArgument(line string, keyword string) (string, bool) {
+	i := strings.Index(line, ":")
+	if i < 0 || !strings.EqualFold(strings.TrimSpace(line[strings.Index(line, " ")+1:i]), keyword) {
+		return "", false
+	}
+	path := strings.TrimSpace(line[i+1:])
+	if !strings.HasPrefix(path, "<") || !strings.Contains(path, ">") {
+		return "", false
+	}
+	return path[1:strings.Index(path, ">")], true
+}
+
+//authenticate runs the AUTH exchange of one of the offered mechanisms
+//and returns the authenticated user: PLAIN, RFC 4616, LOGIN, the LOGIN
+//draft, CRAM-MD5, RFC 2195, XOAUTH2, as described by Google, and
+//OAUTHBEARER, RFC 7628
+func (s *Server) authenticate(tp *textproto.Conn, mechanisms []string, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("No mechanism")
+	}
+	mechanism := strings.ToUpper(args[0])
+	offered := false
+	for _, m := range mechanisms {
+		offered = offered || strings.EqualFold(m, mechanism)
+	}
+	if !offered {
+		return "", fmt.Errorf("Mechanism %s not offered", args[0])
+	}
+
+	//challenge sends a 334 with the challenge and reads the answer
+	challenge := func(text string) (string, error) {
+		tp.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(text)))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if line == "*" {
+			return "", errors.New("Authentication cancelled")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		return string(decoded), err
+	}
+	//initial reads the initial response, asking for it when the client
+	//did not send it along with AUTH
+	initial := func() (string, error) {
+		if len(args) < 2 {
+			return challenge("")
+		}
+		decoded, err := base64.StdEncoding.DecodeString(args[1])
+		return string(decoded), err
+	}
+
+	var user, password string
+	switch mechanism {
+	case "PLAIN":
+		response, err := initial()
+		if err != nil {
+			return "", err
+		}
+		parts := strings.Split(response, "\x00")
+		if len(parts) != 3 {
+			return "", errors.New("Invalid PLAIN response")
+		}
+		user, password = parts[1], parts[2]
+	case "LOGIN":
+		var err error
+		if len(args) > 1 {
+			user, err = initial()
+		} else {
+			user, err = challenge("Username:")
+		}
+		if err != nil {
+			return "", err
+		}
+		if password, err = challenge("Password:"); err != nil {
+			return "", err
+		}
+	case "CRAM-MD5":
+		nonce := fmt.Sprintf("<%d@mailsendertest>", time.Now().UnixNano())
+		response, err := challenge(nonce)
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(response)
+		if len(fields) != 2 {
+			return "", errors.New("Invalid CRAM-MD5 response")
+		}
+		expected, ok := s.Users[fields[0]]
+		mac := hmac.New(md5.New, []byte(expected))
+		mac.Write([]byte(nonce))
+		if !ok || fields[1] != fmt.Sprintf("%x", mac.Sum(nil)) {
+			return "", errors.New("Invalid credentials")
+		}
+		return fields[0], nil
+	case "XOAUTH2", "OAUTHBEARER":
+		response, err := initial()
+		if err != nil {
+			return "", err
+		}
+		token := ""
+		for _, field := range strings.Split(strings.TrimPrefix(response, "n,"), "\x01") {
+			switch {
+			case strings.HasPrefix(field, "user="):
+				user = strings.TrimPrefix(field, "user=")
+			case strings.HasPrefix(field, "a="):
+				user = strings.TrimSuffix(strings.TrimPrefix(field, "a="), ",")
+			case strings.HasPrefix(field, "auth=Bearer "):
+				token = strings.TrimPrefix(field, "auth=Bearer ")
+			}
+		}
+		if expected, ok := s.Tokens[user]; !ok || expected != token {
+			//the details of the failure are sent as a challenge the
+			//client answers before the final reply
+			challenge(`{"status":"401","schemes":"bearer"}`)
+			return "", errors.New("Invalid token")
+		}
+		return user, nil
+	default:
+		return "", fmt.Errorf("Mechanism %s not supported", args[0])
+	}
+	if expected, ok := s.Users[user]; !ok || expected != password {
+		return "", errors.New("Invalid credentials")
+	}
+	return user, nil
+}
+
+//generateCertificate creates the self-signed certificate used for
+//STARTTLS
+func (s *Server) generateCertificate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mailsendertest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	s.roots = x509.NewCertPool()
+	s.roots.AddCert(cert)
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}}
+	return nil
+}
@@ -0,0 +1,152 @@
+package mailsendertest_test
+
+import (
+	"errors"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMail() mailsender.MailStruct {
+	return mailsender.MailStruct{
+		From:        mail.Address{Name: "Sender", Address: "src@example.com"},
+		To:          []mail.Address{{Address: "to@server.com"}, {Address: "other@server.com"}},
+		Subject:     "Relevé de compte",
+		Body:        "The statement is attached",
+		HTMLBody:    `<p>The statement</p><img src="cid:logo">`,
+		Inline:      []mailsender.Attachment{{Filename: "logo.png", ContentType: "image/png", Data: []byte("PNG"), ContentID: "logo"}},
+		Attachments: []mailsender.Attachment{mailsender.AttachBytes("relevé.csv", []byte("date,amount\n"))},
+	}
+}
+
+func TestServerReceive(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	impl := &mailsender.Impl{}
+	result, err := impl.SendMailWithoutAuth(server.Addr, testMail())
+	assert.Nil(err)
+	assert.Equal(2, len(result.Accepted))
+
+	messages := server.Messages()
+	assert.Equal(1, len(messages))
+	m := messages[0]
+	assert.Nil(m.ParseError)
+	assert.Equal("src@example.com", m.From)
+	assert.Equal([]string{"to@server.com", "other@server.com"}, m.To)
+	assert.False(m.TLS)
+	assert.Equal("", m.User)
+	assert.Equal("Relevé de compte", m.Subject)
+	assert.Equal(result.MessageID, strings.Trim(m.Header.Get("Message-ID"), "<>"))
+	assert.Equal("The statement is attached", m.Text)
+	assert.Equal(`<p>The statement</p><img src="cid:logo">`, m.HTML)
+	assert.Equal(2, len(m.Attachments))
+	logo := m.Attachment("logo.png")
+	if assert.NotNil(logo) {
+		assert.Equal("logo", logo.ContentID)
+		assert.True(logo.Inline)
+		assert.Equal("PNG", string(logo.Data))
+	}
+	statement := m.Attachment("relevé.csv")
+	if assert.NotNil(statement) {
+		assert.Equal("date,amount\n", string(statement.Data))
+		assert.False(statement.Inline)
+	}
+
+	server.Reset()
+	assert.Equal(0, len(server.Messages()))
+}
+
+func TestServerSTARTTLSAndAuth(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.STARTTLS = true
+	server.RequireTLS = true
+	server.Users = map[string]string{"src@example.com": "secret"}
+	server.Start()
+	defer server.Close()
+
+	for _, mechanism := range []string{mailsender.AuthPlain, mailsender.AuthLogin} {
+		impl := &mailsender.Impl{AuthMechanism: mechanism}
+		_, err := impl.SendMailStartTLS(server.Addr, server.ClientTLSConfig(), true, "src@example.com", "secret", testMail())
+		assert.Nil(err, mechanism)
+	}
+	messages := server.Messages()
+	assert.Equal(2, len(messages))
+	for i, mechanism := range []string{"PLAIN", "LOGIN"} {
+		assert.True(messages[i].TLS)
+		assert.Equal("src@example.com", messages[i].User)
+		assert.Equal(mechanism, messages[i].Mechanism)
+	}
+
+	impl := &mailsender.Impl{}
+	_, err := impl.SendMailStartTLS(server.Addr, server.ClientTLSConfig(), true, "src@example.com", "wrong", testMail())
+	assert.NotNil(err, "The password is wrong")
+	_, err = impl.SendMailWithoutAuth(server.Addr, testMail())
+	assert.NotNil(err, "TLS and authentication are required")
+	assert.Equal(2, len(server.Messages()))
+}
+
+func TestServerFailures(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	impl := &mailsender.Impl{}
+
+	server.RejectRecipient("Other@Server.com")
+	result, err := impl.SendMailWithoutAuth(server.Addr, testMail())
+	assert.Nil(err, "The mail should reach the accepted recipient")
+	if assert.Equal(1, len(result.Rejected)) {
+		assert.Equal("other@server.com", result.Rejected[0].Address.Address)
+	}
+	assert.Equal([]string{"to@server.com"}, server.Messages()[0].To)
+
+	server.Reset()
+	server.FailData(451, "4.3.0 Try again later")
+	_, err = impl.SendMailWithoutAuth(server.Addr, testMail())
+	var smtpErr *mailsender.SMTPError
+	if assert.True(errors.As(err, &smtpErr), "Expected an SMTP error, got %v", err) {
+		assert.True(smtpErr.Temporary())
+	}
+
+	server.Reset()
+	server.FailCommand(".", 554, "5.6.0 Message rejected")
+	_, err = impl.SendMailWithoutAuth(server.Addr, testMail())
+	if assert.True(errors.As(err, &smtpErr), "Expected an SMTP error, got %v", err) {
+		assert.True(smtpErr.Permanent())
+	}
+
+	for _, verb := range []string{"MAIL", "DATA", "."} {
+		server.Reset()
+		server.DropConnection(verb)
+		_, err = impl.SendMailWithoutAuth(server.Addr, testMail())
+		assert.NotNil(err, "The connection is dropped at %s", verb)
+	}
+	assert.Equal(0, len(server.Messages()))
+}
+
+func TestServerWaitForMessages(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		smtp.SendMail(server.Addr, nil, "src@example.com", []string{"to@server.com"}, []byte("Subject: Hi\r\n\r\nHello\r\n"))
+	}()
+	messages, err := server.WaitForMessages(1, 5*time.Second)
+	assert.Nil(err)
+	if assert.Equal(1, len(messages)) {
+		assert.Equal("Hi", messages[0].Subject)
+		assert.Equal("Hello\r\n", messages[0].Text)
+	}
+	_, err = server.WaitForMessages(2, 50*time.Millisecond)
+	assert.NotNil(err)
+}
@@ -0,0 +1,358 @@
+package mailsender
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//maxLineLength is the maximum length of an encoded line as set by RFC 2045
+const maxLineLength = 76
+
+//Attachment is a file sent along with the mail.
+//The content is taken from Data, from Reader or from the file at Path,
+//in this order. Reader and Path are only read while the mail is sent,
+//so large files are never kept entirely in memory. A Reader can be read
+//only once: a mail having one is sent a single time, unless it is
+//rendered first with Render.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+	Reader      io.Reader `json:"-"`
+	Path        string    `json:"-"`
+	//ContentID makes the attachment referable as cid:ContentID
+	//when it is part of the inline images of the mail
+	ContentID string
+}
+
+//AttachFile creates an attachment from the file found at path
+func AttachFile(path string) (Attachment, error) {
+	if _, err := os.Stat(path); err != nil {
+		return Attachment{}, err
+	}
+	return Attachment{Filename: filepath.Base(path), Path: path}, nil
+}
+
+//AttachBytes creates an attachment holding data
+func AttachBytes(filename string, data []byte) Attachment {
+	return Attachment{Filename: filename, Data: data}
+}
+
+//AttachReader creates an attachment whose content is read from r
+//when the mail is sent. r is consumed by the first send.
+func AttachReader(filename string, r io.Reader) Attachment {
+	return Attachment{Filename: filename, Reader: r}
+}
+
+//open returns the content of the attachment
+func (a Attachment) open() (io.ReadCloser, error) {
+	switch {
+	case a.Data != nil:
+		return ioutil.NopCloser(bytes.NewReader(a.Data)), nil
+	case a.Reader != nil:
+		return ioutil.NopCloser(a.Reader), nil
+	case a.Path != "":
+		return os.Open(a.Path)
+	}
+	return nil, fmt.Errorf("Attachment %s has no content", a.Filename)
+}
+
+//detectContentType guesses the content type first from the file extension
+//and then from the first bytes of the content
+func detectContentType(filename string, content *bufio.Reader) string {
+	if ct := mime.TypeByExtension(filepath.Ext(filename)); ct != "" {
+		return ct
+	}
+	head, _ := content.Peek(512)
+	return http.DetectContentType(head)
+}
+
+//countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	N int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.N += n
+	return n, err
+}
+
+//lineWrapper breaks the written data in lines of maxLineLength characters
+type lineWrapper struct {
+	w    io.Writer
+	used int
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if lw.used == maxLineLength {
+			if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+				return written, err
+			}
+			lw.used = 0
+		}
+		chunk := p
+		if len(chunk) > maxLineLength-lw.used {
+			chunk = chunk[:maxLineLength-lw.used]
+		}
+		n, err := lw.w.Write(chunk)
+		written += n
+		lw.used += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+//partCreator writes the header of a new MIME part and returns the
+//writer for its content. multipart.Writer.CreatePart is one.
+type partCreator func(header textproto.MIMEHeader) (io.Writer, error)
+
+//mimePart writes a MIME entity using the given creator
+type mimePart func(create partCreator) error
+
+//randomBoundary generates a boundary for a multipart entity
+func randomBoundary() (string, error) {
+	var buf [30]byte
+	if _, err := io.ReadFull(randReader, buf[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf[:]), nil
+}
+
+//multipartPart builds a multipart/<subtype> entity holding parts
+func multipartPart(subtype string, parts ...mimePart) mimePart {
+	return func(create partCreator) error {
+		boundary, err := randomBoundary()
+		if err != nil {
+			return err
+		}
+		w, err := create(textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": boundary})},
+		})
+		if err != nil {
+			return err
+		}
+		mw := multipart.NewWriter(w)
+		if err = mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+		for _, part := range parts {
+			if err = part(mw.CreatePart); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	}
+}
+
+//needsQuotedPrintable tells if text can not be sent as 7bit, either
+//because of 8-bit characters or because of lines that are too long.
+//Trailing white space is encoded too, as servers may strip it and
+//break the signatures, RFC 3156 3.
+func needsQuotedPrintable(text string) bool {
+	if !isASCII(text) {
+		return true
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) > maxLineLength || strings.TrimRight(line, " \t") != line {
+			return true
+		}
+	}
+	return false
+}
+
+//textPart builds a text/<subtype> entity in UTF-8, quoted-printable
+//encoded when it can not be sent as it is
+func textPart(subtype string, text string) mimePart {
+	return func(create partCreator) error {
+		header := textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("text/"+subtype, map[string]string{"charset": "utf-8"})},
+		}
+		if !needsQuotedPrintable(text) {
+			header.Set("Content-Transfer-Encoding", "7bit")
+			w, err := create(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(w, text)
+			return err
+		}
+
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, err := create(header)
+		if err != nil {
+			return err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err = io.WriteString(qp, text); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+}
+
+//attachmentPart builds a base64 encoded entity from the attachment.
+//Attachments having a ContentID are set inline so they can be
+//referenced from the HTML body.
+func attachmentPart(a Attachment) mimePart {
+	return func(create partCreator) error {
+		content, err := a.open()
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+
+		reader := bufio.NewReader(content)
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = detectContentType(a.Filename, reader)
+		}
+
+		header := textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+
+		dispositionType := "attachment"
+		if a.ContentID != "" {
+			dispositionType = "inline"
+			header.Set("Content-ID", "<"+a.ContentID+">")
+		}
+		//FormatMediaType switches to the RFC 2231 form for non-ASCII names
+		disposition := mime.FormatMediaType(dispositionType, map[string]string{"filename": a.Filename})
+		if disposition == "" {
+			return fmt.Errorf("Invalid attachment name %q", a.Filename)
+		}
+		header.Set("Content-Disposition", foldValue("Content-Disposition", disposition))
+
+		w, err := create(header)
+		if err != nil {
+			return err
+		}
+
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w})
+		if _, err = io.Copy(encoder, reader); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+}
+
+//bodyPart builds the entity holding the text and the HTML of the mail:
+//multipart/alternative when both are present and multipart/related
+//around the HTML when it has inline images
+func bodyPart(ms MailStruct) mimePart {
+	text := ms.Body
+	if text == "" && ms.HTMLBody != "" && ms.TextFromHTML {
+		text = HTMLToText(ms.HTMLBody)
+	}
+
+	if ms.HTMLBody == "" {
+		return textPart("plain", text)
+	}
+
+	html := textPart("html", ms.HTMLBody)
+	if len(ms.Inline) > 0 {
+		parts := []mimePart{html}
+		for _, image := range ms.Inline {
+			parts = append(parts, attachmentPart(image))
+		}
+		html = multipartPart("related", parts...)
+	}
+
+	if text == "" {
+		return html
+	}
+	return multipartPart("alternative", textPart("plain", text), html)
+}
+
+//writeMessage streams the mail to w. Mails with attachments are
+//sent as multipart/mixed with the body as the first part. The content
+//is then signed and encrypted with S/MIME or OpenPGP if needed. A mail signed
+//with DKIM is built in memory first, as the signature comes before it.
+func writeMessage(w io.Writer, ms MailStruct) error {
+	if ms.rendered != nil {
+		_, err := w.Write(ms.rendered)
+		return err
+	}
+	if err := ms.ValidateHeaders(); err != nil {
+		return err
+	}
+	if ms.DKIM != nil {
+		signer := ms.DKIM
+		ms.DKIM = nil
+		var buf bytes.Buffer
+		if err := writeMessage(&buf, ms); err != nil {
+			return err
+		}
+		return signMessage(w, signer, buf.Bytes())
+	}
+	if (ms.SMIME != nil || len(ms.SMIMERecipients) > 0) && (ms.PGP != nil || len(ms.PGPRecipients) > 0) {
+		return fmt.Errorf("A mail can not use both S/MIME and OpenPGP")
+	}
+	root := bodyPart(ms)
+	if len(ms.Attachments) > 0 {
+		parts := []mimePart{root}
+		for _, attachment := range ms.Attachments {
+			parts = append(parts, attachmentPart(attachment))
+		}
+		root = multipartPart("mixed", parts...)
+	}
+	if ms.SMIME != nil {
+		root = signedPart(root, ms.SMIME)
+	}
+	if len(ms.SMIMERecipients) > 0 {
+		root = encryptedPart(root, ms.SMIMERecipients)
+	}
+	if ms.PGP != nil {
+		root = pgpSignedPart(root, ms.PGP)
+	}
+	if len(ms.PGPRecipients) > 0 {
+		root = pgpEncryptedPart(root, ms.PGPRecipients)
+	}
+
+	setDefaults(&ms)
+	headers := messageHeaders(ms)
+	headers = append(headers, headerField{"MIME-Version", "1.0"})
+	return root(func(header textproto.MIMEHeader) (io.Writer, error) {
+		return w, writeHeaders(w, append(headers, sortedFields(header)...))
+	})
+}
+
+//Render builds the message of the mail and returns a copy of the mail
+//holding it, so that the same bytes are sent however many times the
+//copy is sent: to several servers or again after a failure. The Reader
+//of an attachment can only be read once, a mail having one must be
+//rendered before being sent more than once. The fields of the copy must
+//not be changed, its message would not follow them.
+func (ms MailStruct) Render() (MailStruct, error) {
+	if ms.rendered != nil {
+		return ms, nil
+	}
+	setDefaults(&ms)
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, ms); err != nil {
+		return ms, err
+	}
+	ms.rendered = buf.Bytes()
+	return ms, nil
+}
@@ -0,0 +1,336 @@
+package mailsender
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMessageWithAttachments(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "mailsender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "raport lunar.csv")
+	if err = ioutil.WriteFile(path, []byte("a,b\n1,2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileAttachment, err := AttachFile(path)
+	assert.Nil(err)
+
+	pdf := append([]byte("%PDF-1.4\n"), bytes.Repeat([]byte{0xff, 0x00, 0x7f}, 100)...)
+
+	ms := MailStruct{
+		From:    mail.Address{Address: "src@server.com"},
+		To:      []mail.Address{{Address: "to@server.com"}},
+		Subject: "Report",
+		Body:    "See attached",
+		Attachments: []Attachment{
+			fileAttachment,
+			AttachBytes("document", pdf),
+			AttachReader("factură.txt", strings.NewReader("plătit")),
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		assert.True(len(line) <= 78, "Line too long: %s", line)
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	assert.Equal("1.0", msg.Header.Get("MIME-Version"))
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Nil(err)
+	assert.Equal("multipart/mixed", mediaType)
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+
+	part, err := reader.NextPart()
+	assert.Nil(err)
+	body, _ := ioutil.ReadAll(part)
+	assert.Equal("See attached", string(body))
+
+	expected := []struct {
+		filename    string
+		contentType string
+		content     []byte
+	}{
+		{"raport lunar.csv", "text/csv; charset=utf-8", []byte("a,b\n1,2\n")},
+		{"document", "application/pdf", pdf},
+		{"factură.txt", "text/plain; charset=utf-8", []byte("plătit")},
+	}
+
+	for _, e := range expected {
+		part, err = reader.NextPart()
+		assert.Nil(err)
+		//FileName decodes the RFC 2231 form of non-ASCII names
+		assert.Equal(e.filename, part.FileName())
+		assert.Equal(e.contentType, part.Header.Get("Content-Type"))
+		assert.Equal("base64", part.Header.Get("Content-Transfer-Encoding"))
+		//multipart.Reader does not decode base64, only quoted-printable
+		content, _ := ioutil.ReadAll(part)
+		decoded, err := decodeBase64Lines(content)
+		assert.Nil(err)
+		assert.Equal(e.content, decoded)
+	}
+	_, err = reader.NextPart()
+	assert.NotNil(err, "No more parts expected")
+}
+
+func TestWriteMessageHTMLWithInlineImages(t *testing.T) {
+	assert := assert.New(t)
+
+	logo := AttachBytes("logo.png", []byte("\x89PNG\r\n\x1a\n"))
+	logo.ContentID = "logo@server.com"
+
+	ms := MailStruct{
+		From:         mail.Address{Address: "src@server.com"},
+		To:           []mail.Address{{Address: "to@server.com"}},
+		Subject:      "Newsletter",
+		HTMLBody:     `<p>Hello <b>you</b></p><img src="cid:logo@server.com"><a href="https://server.com">Site</a>`,
+		TextFromHTML: true,
+		Inline:       []Attachment{logo},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Equal("multipart/alternative", mediaType)
+
+	alternative := multipart.NewReader(msg.Body, params["boundary"])
+	text, err := alternative.NextPart()
+	assert.Nil(err)
+	assert.Equal("text/plain; charset=utf-8", text.Header.Get("Content-Type"))
+	content, _ := ioutil.ReadAll(text)
+	assert.Equal("Hello you\n\nSite (https://server.com)", string(content))
+
+	related, err := alternative.NextPart()
+	assert.Nil(err)
+	mediaType, params, _ = mime.ParseMediaType(related.Header.Get("Content-Type"))
+	assert.Equal("multipart/related", mediaType)
+
+	relatedReader := multipart.NewReader(related, params["boundary"])
+	html, err := relatedReader.NextPart()
+	assert.Nil(err)
+	assert.Equal("text/html; charset=utf-8", html.Header.Get("Content-Type"))
+	content, _ = ioutil.ReadAll(html)
+	assert.Equal(ms.HTMLBody, string(content))
+
+	image, err := relatedReader.NextPart()
+	assert.Nil(err)
+	assert.Equal("<logo@server.com>", image.Header.Get("Content-ID"))
+	assert.Equal("image/png", image.Header.Get("Content-Type"))
+	assert.True(strings.HasPrefix(image.Header.Get("Content-Disposition"), "inline"))
+
+	ms.Inline = []Attachment{AttachBytes("logo.png", nil)}
+	assert.NotNil(writeMessage(&buf, ms), "Error expected for an inline image without ContentID")
+}
+
+func TestWriteMessageHTMLOnly(t *testing.T) {
+	assert := assert.New(t)
+	ms := MailStruct{
+		From:     mail.Address{Address: "src@server.com"},
+		To:       []mail.Address{{Address: "to@server.com"}},
+		HTMLBody: "<p>Hello</p>",
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	assert.Equal("text/html; charset=utf-8", msg.Header.Get("Content-Type"))
+}
+
+func TestHTMLToText(t *testing.T) {
+	assert := assert.New(t)
+	html := `<html><head><title>T</title><style>p {}</style></head><body>
+<h1>Title</h1>
+<p>First   line<br>second &amp; last</p>
+<ul><li>one</li><li>two</li></ul>
+<!-- hidden -->
+<a href="https://server.com/x">https://server.com/x</a>
+</body></html>`
+	assert.Equal("Title\n\nFirst line\nsecond & last\n\n* one\n* two\n\nhttps://server.com/x", HTMLToText(html))
+}
+
+func TestWriteMessageEncoding(t *testing.T) {
+	assert := assert.New(t)
+	var to []mail.Address
+	for i := 0; i < 6; i++ {
+		to = append(to, mail.Address{Name: "Destinatar Şcoală", Address: "destinatar@server.com"})
+	}
+	body := "Bună ziua,\nacesta este un mesaj cu diacritice și cu un rând foarte lung care trece de limita de 76 de caractere."
+
+	ms := MailStruct{
+		From:    mail.Address{Name: "Jürgen Müller", Address: "src@server.com"},
+		To:      to,
+		Subject: "Grüße aus Timișoara, o notificare cu un subiect suficient de lung pentru a fi împărțit",
+		Body:    body,
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		assert.True(len(line) <= 78, "Line too long: %s", line)
+		assert.True(isASCII(line), "Line not encoded: %s", line)
+	}
+
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	assert.Equal("1.0", msg.Header.Get("MIME-Version"))
+	assert.Equal("text/plain; charset=utf-8", msg.Header.Get("Content-Type"))
+	assert.Equal("quoted-printable", msg.Header.Get("Content-Transfer-Encoding"))
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	assert.Nil(err)
+	assert.Equal(ms.Subject, subject)
+
+	from, err := msg.Header.AddressList("From")
+	assert.Nil(err)
+	assert.Equal("Jürgen Müller", from[0].Name)
+	addresses, err := msg.Header.AddressList("To")
+	assert.Nil(err)
+	assert.Equal(to, derefAddresses(addresses))
+
+	decoded, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	assert.Nil(err)
+	assert.Equal(strings.Replace(body, "\n", "\r\n", -1), string(decoded))
+}
+
+func TestFoldHeader(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("Subject: short", foldHeader("Subject", "short"))
+	long := strings.Repeat("word ", 20) + strings.Repeat("x", 90)
+	folded := foldHeader("Subject", long)
+	for _, line := range strings.Split(folded, "\r\n") {
+		assert.True(len(line) <= 78 || !strings.Contains(strings.TrimSpace(line), " "), "Line too long: %s", line)
+	}
+	assert.Equal("Subject: "+long, strings.Replace(folded, "\r\n", "", -1))
+}
+
+func TestWriteMessageGolden(t *testing.T) {
+	ms := MailStruct{
+		From:      mail.Address{Name: "Sender", Address: "src@server.com"},
+		To:        []mail.Address{{Address: "to@server.com"}},
+		Cc:        []mail.Address{{Name: "Copy", Address: "cc@server.com"}},
+		Subject:   "Golden",
+		Date:      time.Date(2016, 10, 1, 12, 30, 0, 0, time.UTC),
+		MessageID: "1234@server.com",
+		Body:      "Hello",
+	}
+	expected := "Date: Sat, 01 Oct 2016 12:30:00 +0000\r\n" +
+		"From: \"Sender\" <src@server.com>\r\n" +
+		"To: <to@server.com>\r\n" +
+		"Cc: \"Copy\" <cc@server.com>\r\n" +
+		"Subject: Golden\r\n" +
+		"Message-ID: <1234@server.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Hello"
+
+	for i := 0; i < 5; i++ {
+		var buf bytes.Buffer
+		assert.Nil(t, writeMessage(&buf, ms))
+		assert.Equal(t, expected, buf.String())
+	}
+}
+
+func TestGenerateMessageID(t *testing.T) {
+	assert := assert.New(t)
+	id := GenerateMessageID("server.com")
+	assert.True(strings.HasSuffix(id, "@server.com"), "Unexpected Message-ID %s", id)
+	assert.NotEqual(id, GenerateMessageID("server.com"))
+	assert.Regexp(`^[0-9a-f]+\.[0-9a-f]+@.+$`, GenerateMessageID(""))
+}
+
+func TestWriteMessageCustomHeaders(t *testing.T) {
+	assert := assert.New(t)
+	ms := MailStruct{
+		From:       mail.Address{Address: "src@server.com"},
+		To:         []mail.Address{{Address: "to@server.com"}},
+		ReplyTo:    []mail.Address{{Name: "Support", Address: "support@server.com"}},
+		Subject:    "Re: Ticket",
+		Date:       time.Date(2016, 10, 1, 12, 30, 0, 0, time.UTC),
+		MessageID:  "3@server.com",
+		InReplyTo:  "2@server.com",
+		References: []string{"1@server.com", "2@server.com"},
+		Headers: map[string]string{
+			"X-Priority":       "1",
+			"List-Unsubscribe": "<mailto:unsubscribe@server.com>",
+			"x-ticket":         "Tichet ăî",
+		},
+		Body: "Answer",
+	}
+	expected := "Date: Sat, 01 Oct 2016 12:30:00 +0000\r\n" +
+		"From: <src@server.com>\r\n" +
+		"To: <to@server.com>\r\n" +
+		"Reply-To: \"Support\" <support@server.com>\r\n" +
+		"Subject: Re: Ticket\r\n" +
+		"Message-ID: <3@server.com>\r\n" +
+		"In-Reply-To: <2@server.com>\r\n" +
+		"References: <1@server.com> <2@server.com>\r\n" +
+		"List-Unsubscribe: <mailto:unsubscribe@server.com>\r\n" +
+		"X-Priority: 1\r\n" +
+		"X-Ticket: =?utf-8?q?Tichet_=C4=83=C3=AE?=\r\n" +
+		"MIME-Version: 1.0\r\n"
+
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+	assert.True(strings.HasPrefix(buf.String(), expected), "Unexpected headers:\n%s", buf.String())
+}
+
+func TestValidateHeaders(t *testing.T) {
+	assert := assert.New(t)
+	valid := MailStruct{Subject: "ok", Headers: map[string]string{"X-Custom": "value"}}
+	assert.Nil(valid.ValidateHeaders())
+
+	invalid := []MailStruct{
+		{Subject: "injected\r\nBcc: victim@server.com"},
+		{Headers: map[string]string{"X-Custom": "value\nBcc: victim@server.com"}},
+		{Headers: map[string]string{"X Custom": "value"}},
+		{Headers: map[string]string{"X-Custom:": "value"}},
+		{Headers: map[string]string{"from": "other@server.com"}},
+		{InReplyTo: "1@server.com>\r\nBcc: <victim@server.com"},
+		{References: []string{"no-domain"}},
+		{ReplyTo: []mail.Address{{Name: "a\r\nBcc: b", Address: "a@server.com"}}},
+	}
+	for _, ms := range invalid {
+		assert.NotNil(ms.ValidateHeaders(), "Error expected for %+v", ms)
+	}
+}
+
+//decodeBase64Lines decodes base64 content split on several lines
+func decodeBase64Lines(content []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(content)), ""))
+}
+
+func derefAddresses(addresses []*mail.Address) []mail.Address {
+	list := make([]mail.Address, len(addresses))
+	for i, address := range addresses {
+		list[i] = *address
+	}
+	return list
+}
@@ -0,0 +1,25 @@
+package mailsender
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortMX(t *testing.T) {
+	assert := assert.New(t)
+	records := []*net.MX{{Host: "c", Pref: 30}, {Host: "a1", Pref: 10}, {Host: "b", Pref: 20}, {Host: "a2", Pref: 10}}
+
+	firsts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		sorted := sortMX(records)
+		assert.Equal(4, len(sorted))
+		assert.Equal(10, int(sorted[1].Pref))
+		assert.Equal("b", sorted[2].Host)
+		assert.Equal("c", sorted[3].Host)
+		firsts[sorted[0].Host]++
+	}
+	assert.True(firsts["a1"] > 0 && firsts["a2"] > 0, "The hosts of equal preference should be shuffled, got %v", firsts)
+	assert.Equal("c", records[0].Host, "The records of the resolver should not be changed")
+}
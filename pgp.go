@@ -0,0 +1,247 @@
+package mailsender
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+//PGPKey is an OpenPGP key, RFC 4880: a primary key with its user IDs and
+//subkeys. Version 4 RSA, Ed25519 and Curve25519 keys are supported, the
+//keys GnuPG creates by default.
+type PGPKey struct {
+	UserIDs []string
+	primary *pgpKey
+	subkeys []*pgpKey
+}
+
+//ReadPGPKeys reads the keys found in data, ASCII armored or binary, as
+//exported by gpg --export or gpg --export-secret-keys. Secret keys that
+//are protected by a passphrase must be unlocked before signing.
+func ReadPGPKeys(data []byte) ([]*PGPKey, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN PGP ")) {
+		return readPGPPackets(data)
+	}
+	var keys []*PGPKey
+	blocks := strings.Split(string(data), "-----BEGIN PGP ")
+	for _, block := range blocks[1:] {
+		decoded, err := pgpDearmor([]byte("-----BEGIN PGP " + block))
+		if err != nil {
+			return nil, err
+		}
+		blockKeys, err := readPGPPackets(decoded)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, blockKeys...)
+	}
+	return keys, nil
+}
+
+//readPGPPackets reads the keys of a binary key ring. The signatures are
+//skipped: the keys are trusted as they were placed in the key ring.
+func readPGPPackets(data []byte) ([]*PGPKey, error) {
+	var keys []*PGPKey
+	for len(data) > 0 {
+		tag, body, rest, err := readPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+
+		switch tag {
+		case pgpTagPublicKey, pgpTagSecretKey:
+			k, err := parsePGPKey(body, tag == pgpTagSecretKey)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, &PGPKey{primary: k})
+		case pgpTagUserID, pgpTagPublicSubkey, pgpTagSecretSubkey:
+			if len(keys) == 0 {
+				return nil, fmt.Errorf("OpenPGP packet %d found before a primary key", tag)
+			}
+			key := keys[len(keys)-1]
+			if tag == pgpTagUserID {
+				key.UserIDs = append(key.UserIDs, string(body))
+				continue
+			}
+			k, err := parsePGPKey(body, tag == pgpTagSecretSubkey)
+			if err != nil {
+				return nil, err
+			}
+			key.subkeys = append(key.subkeys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No OpenPGP key found")
+	}
+	return keys, nil
+}
+
+//Fingerprint returns the fingerprint of the primary key in hexadecimal
+func (k *PGPKey) Fingerprint() string {
+	return fmt.Sprintf("%X", k.primary.fingerprint)
+}
+
+//Emails returns the addresses of the user IDs of the key, in lower case
+func (k *PGPKey) Emails() []string {
+	var emails []string
+	for _, id := range k.UserIDs {
+		if address, err := mail.ParseAddress(id); err == nil {
+			emails = append(emails, strings.ToLower(address.Address))
+		}
+	}
+	return emails
+}
+
+//Unlock decrypts the secret keys protected by passphrase
+func (k *PGPKey) Unlock(passphrase string) error {
+	if err := k.primary.unlock(passphrase); err != nil {
+		return err
+	}
+	for _, subkey := range k.subkeys {
+		if err := subkey.unlock(passphrase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//signingKey returns the primary key or, when it can not sign, the last
+//signing subkey having its secret key
+func (k *PGPKey) signingKey() (*pgpKey, error) {
+	if k.primary.canSign() && k.primary.private != nil {
+		return k.primary, nil
+	}
+	for i := len(k.subkeys) - 1; i >= 0; i-- {
+		if k.subkeys[i].canSign() && k.subkeys[i].private != nil {
+			return k.subkeys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("The OpenPGP key %s has no unlocked signing key", k.Fingerprint())
+}
+
+//encryptionKey returns the last encryption subkey or, when there is
+//none, the primary key if it can encrypt
+func (k *PGPKey) encryptionKey() (*pgpKey, error) {
+	for i := len(k.subkeys) - 1; i >= 0; i-- {
+		if k.subkeys[i].canEncrypt() {
+			return k.subkeys[i], nil
+		}
+	}
+	if k.primary.canEncrypt() {
+		return k.primary, nil
+	}
+	return nil, fmt.Errorf("The OpenPGP key %s has no encryption key", k.Fingerprint())
+}
+
+//Sign returns the ASCII armored detached signature of content, signed
+//as a canonical text document with SHA-256
+func (k *PGPKey) Sign(content []byte) (string, error) {
+	signing, err := k.signingKey()
+	if err != nil {
+		return "", err
+	}
+	signature, err := signing.sign(pgpTextDocument, content, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return pgpArmor("SIGNATURE", signature), nil
+}
+
+//EncryptPGP returns the ASCII armored OpenPGP message holding content
+//encrypted with AES-256 for the holders of the keys
+func EncryptPGP(content []byte, recipients []*PGPKey) (string, error) {
+	var keys []*pgpKey
+	for _, recipient := range recipients {
+		k, err := recipient.encryptionKey()
+		if err != nil {
+			return "", err
+		}
+		keys = append(keys, k)
+	}
+	message, err := pgpEncrypt(content, keys)
+	if err != nil {
+		return "", err
+	}
+	return pgpArmor("MESSAGE", message), nil
+}
+
+//pgpSignedPart builds the multipart/signed entity of RFC 3156 5 holding
+//the content entity built by part and its detached OpenPGP signature
+func pgpSignedPart(part mimePart, signer *PGPKey) mimePart {
+	return multipartSigned(part, "application/pgp-signature", "pgp-sha256", func(entity []byte) (mimePart, error) {
+		signature, err := signer.Sign(entity)
+		if err != nil {
+			return nil, err
+		}
+		return armoredPart("application/pgp-signature", "signature.asc", "OpenPGP digital signature", signature), nil
+	})
+}
+
+//pgpEncryptedPart builds the multipart/encrypted entity of RFC 3156 4
+//holding the entity built by part encrypted for the recipients
+func pgpEncryptedPart(part mimePart, recipients []*PGPKey) mimePart {
+	return func(create partCreator) error {
+		entity, err := renderEntity(part)
+		if err != nil {
+			return err
+		}
+		encrypted, err := EncryptPGP(entity, recipients)
+		if err != nil {
+			return err
+		}
+		boundary, err := randomBoundary()
+		if err != nil {
+			return err
+		}
+
+		w, err := create(textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/encrypted", map[string]string{
+				"protocol": "application/pgp-encrypted",
+				"boundary": boundary,
+			})},
+		})
+		if err != nil {
+			return err
+		}
+		mw := multipart.NewWriter(w)
+		if err = mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+		control := armoredPart("application/pgp-encrypted", "", "PGP/MIME version identification", "Version: 1\r\n")
+		if err = control(mw.CreatePart); err != nil {
+			return err
+		}
+		if err = armoredPart("application/octet-stream", "encrypted.asc", "OpenPGP encrypted message", encrypted)(mw.CreatePart); err != nil {
+			return err
+		}
+		return mw.Close()
+	}
+}
+
+//armoredPart builds a 7bit entity holding ASCII armored OpenPGP data
+func armoredPart(contentType string, filename string, description string, armored string) mimePart {
+	return func(create partCreator) error {
+		header := textproto.MIMEHeader{
+			"Content-Type":        {contentType},
+			"Content-Description": {description},
+		}
+		if filename != "" {
+			header.Set("Content-Type", contentType+`; name="`+filename+`"`)
+			header.Set("Content-Disposition", `inline; filename="`+filename+`"`)
+		}
+		w, err := create(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, armored)
+		return err
+	}
+}
@@ -0,0 +1,740 @@
+package mailsender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+)
+
+//The OpenPGP packet tags, RFC 4880 4.3
+const (
+	pgpTagPKESK         = 1
+	pgpTagSignature     = 2
+	pgpTagSecretKey     = 5
+	pgpTagPublicKey     = 6
+	pgpTagSecretSubkey  = 7
+	pgpTagLiteral       = 11
+	pgpTagUserID        = 13
+	pgpTagPublicSubkey  = 14
+	pgpTagEncryptedData = 18
+	pgpTagMDC           = 19
+)
+
+//The OpenPGP algorithms used, RFC 4880 9 and RFC 6637
+const (
+	pgpRSA          = 1
+	pgpRSAEncrypt   = 2
+	pgpRSASign      = 3
+	pgpECDH         = 18
+	pgpEdDSA        = 22
+	pgpSHA1         = 2
+	pgpSHA256       = 8
+	pgpSHA384       = 9
+	pgpSHA512       = 10
+	pgpSHA224       = 11
+	pgpAES128       = 7
+	pgpAES192       = 8
+	pgpAES256       = 9
+	pgpTextDocument = 0x01
+)
+
+//The curves of the Ed25519 and Curve25519 keys, RFC 4880bis
+var (
+	pgpOIDEd25519    = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+	pgpOIDCurve25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+)
+
+var errPGPTruncated = errors.New("Truncated OpenPGP data")
+
+//readPacket reads the first packet of data, in the old or the new format
+func readPacket(data []byte) (tag byte, body []byte, rest []byte, err error) {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return 0, nil, nil, fmt.Errorf("Invalid OpenPGP packet")
+	}
+	var length, offset int
+	if data[0]&0x40 != 0 {
+		tag = data[0] & 0x3f
+		switch first := int(data[1]); {
+		case first < 192:
+			length, offset = first, 2
+		case first < 224:
+			if len(data) < 3 {
+				return 0, nil, nil, errPGPTruncated
+			}
+			length, offset = (first-192)<<8+int(data[2])+192, 3
+		case first == 255:
+			if len(data) < 6 {
+				return 0, nil, nil, errPGPTruncated
+			}
+			length, offset = int(binary.BigEndian.Uint32(data[2:6])), 6
+		default:
+			return 0, nil, nil, fmt.Errorf("Partial OpenPGP packets are not supported")
+		}
+	} else {
+		tag = (data[0] >> 2) & 0x0f
+		switch data[0] & 3 {
+		case 0:
+			length, offset = int(data[1]), 2
+		case 1:
+			if len(data) < 3 {
+				return 0, nil, nil, errPGPTruncated
+			}
+			length, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+		case 2:
+			if len(data) < 5 {
+				return 0, nil, nil, errPGPTruncated
+			}
+			length, offset = int(binary.BigEndian.Uint32(data[1:5])), 5
+		default:
+			length, offset = len(data)-1, 1
+		}
+	}
+	if length < 0 || len(data) < offset+length {
+		return 0, nil, nil, errPGPTruncated
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+//pgpPacket encodes a packet in the new format
+func pgpPacket(tag byte, body []byte) []byte {
+	packet := []byte{0xc0 | tag}
+	switch n := len(body); {
+	case n < 192:
+		packet = append(packet, byte(n))
+	case n < 8384:
+		packet = append(packet, byte((n-192)>>8+192), byte(n-192))
+	default:
+		packet = append(packet, 255, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(packet, body...)
+}
+
+//readMPI reads a multiprecision integer, RFC 4880 3.2
+func readMPI(data []byte) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errPGPTruncated
+	}
+	n := (int(binary.BigEndian.Uint16(data)) + 7) / 8
+	if len(data) < 2+n {
+		return nil, nil, errPGPTruncated
+	}
+	return data[2 : 2+n], data[2+n:], nil
+}
+
+//pgpMPI encodes value, big-endian, as a multiprecision integer
+func pgpMPI(value []byte) []byte {
+	for len(value) > 0 && value[0] == 0 {
+		value = value[1:]
+	}
+	bits := 0
+	if len(value) > 0 {
+		bits = (len(value)-1)*8 + big.NewInt(int64(value[0])).BitLen()
+	}
+	return append([]byte{byte(bits >> 8), byte(bits)}, value...)
+}
+
+//pgpArmor encodes data in the ASCII armor of blockType, RFC 4880 6.2
+func pgpArmor(blockType string, data []byte) string {
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN PGP " + blockType + "-----\r\n\r\n")
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 64 {
+		armored.WriteString(encoded[:64] + "\r\n")
+		encoded = encoded[64:]
+	}
+	crc := crc24(data)
+	armored.WriteString(encoded + "\r\n=" + base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) + "\r\n")
+	armored.WriteString("-----END PGP " + blockType + "-----\r\n")
+	return armored.String()
+}
+
+//pgpDearmor decodes the first ASCII armored block of data, checking its
+//checksum when it has one
+func pgpDearmor(data []byte) ([]byte, error) {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	start := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "-----BEGIN PGP ") {
+			start = i + 1
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("No OpenPGP armor found")
+	}
+	//the armor headers end with an empty line
+	for i := start; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			start = i + 1
+			break
+		}
+	}
+
+	var encoded, checksum string
+	for _, line := range lines[start:] {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-----END PGP ") {
+			break
+		}
+		if strings.HasPrefix(line, "=") {
+			checksum = line[1:]
+			continue
+		}
+		encoded += line
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		crc, err := base64.StdEncoding.DecodeString(checksum)
+		sum := crc24(decoded)
+		if err != nil || !bytes.Equal(crc, []byte{byte(sum >> 16), byte(sum >> 8), byte(sum)}) {
+			return nil, fmt.Errorf("Invalid OpenPGP armor checksum")
+		}
+	}
+	return decoded, nil
+}
+
+//crc24 is the checksum of the ASCII armor
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+//pgpKey is a public key or subkey packet with, when it is known and
+//unlocked, its private key
+type pgpKey struct {
+	algorithm   byte
+	created     time.Time
+	fingerprint []byte
+
+	rsa       *rsa.PublicKey
+	ed25519   ed25519.PublicKey
+	x25519    []byte
+	kdfHash   byte
+	kdfCipher byte
+
+	//secret holds the secret part of a secret key packet until it is
+	//unlocked into private
+	secret  []byte
+	private crypto.Signer
+}
+
+//keyID returns the key ID, the low 64 bits of the fingerprint
+func (k *pgpKey) keyID() []byte {
+	return k.fingerprint[len(k.fingerprint)-8:]
+}
+
+//canSign tells if the key is of a signing algorithm
+func (k *pgpKey) canSign() bool {
+	return k.algorithm == pgpRSA || k.algorithm == pgpRSASign || k.algorithm == pgpEdDSA
+}
+
+//canEncrypt tells if the key is of an encryption algorithm
+func (k *pgpKey) canEncrypt() bool {
+	return k.algorithm == pgpRSA || k.algorithm == pgpRSAEncrypt || k.algorithm == pgpECDH
+}
+
+//parsePGPKey parses a version 4 key packet. For a secret key packet the
+//bytes following the public key are kept for unlock.
+func parsePGPKey(body []byte, secret bool) (*pgpKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, fmt.Errorf("Only version 4 OpenPGP keys are supported")
+	}
+	k := &pgpKey{algorithm: body[5], created: time.Unix(int64(binary.BigEndian.Uint32(body[1:5])), 0)}
+	rest := body[6:]
+	var err error
+	switch k.algorithm {
+	case pgpRSA, pgpRSAEncrypt, pgpRSASign:
+		var n, e []byte
+		if n, rest, err = readMPI(rest); err != nil {
+			return nil, err
+		}
+		if e, rest, err = readMPI(rest); err != nil {
+			return nil, err
+		}
+		k.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case pgpEdDSA, pgpECDH:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, errPGPTruncated
+		}
+		oid := rest[1 : 1+int(rest[0])]
+		var point []byte
+		if point, rest, err = readMPI(rest[1+int(rest[0]):]); err != nil {
+			return nil, err
+		}
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, fmt.Errorf("Unsupported OpenPGP key point")
+		}
+		if k.algorithm == pgpEdDSA {
+			if !bytes.Equal(oid, pgpOIDEd25519) {
+				return nil, fmt.Errorf("Only Ed25519 OpenPGP signing keys are supported")
+			}
+			k.ed25519 = ed25519.PublicKey(point[1:])
+			break
+		}
+		if !bytes.Equal(oid, pgpOIDCurve25519) {
+			return nil, fmt.Errorf("Only Curve25519 OpenPGP encryption keys are supported")
+		}
+		if len(rest) < 4 || rest[0] != 3 || rest[1] != 1 {
+			return nil, fmt.Errorf("Invalid OpenPGP ECDH parameters")
+		}
+		k.x25519, k.kdfHash, k.kdfCipher = point[1:], rest[2], rest[3]
+		rest = rest[4:]
+	default:
+		//keys of other algorithms are listed but can not be used
+		if secret {
+			return k, nil
+		}
+		rest = nil
+	}
+
+	public := body[:len(body)-len(rest)]
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(public) >> 8), byte(len(public))})
+	h.Write(public)
+	k.fingerprint = h.Sum(nil)
+
+	if secret {
+		k.secret = rest
+		if len(rest) > 0 && rest[0] == 0 {
+			//the secret key is not protected
+			if err = k.unlock(""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return k, nil
+}
+
+//unlock decrypts the secret key with passphrase, RFC 4880 5.5.3
+func (k *pgpKey) unlock(passphrase string) error {
+	if k.private != nil || len(k.secret) == 0 {
+		return nil
+	}
+	data := k.secret
+	usage := data[0]
+	var mpis []byte
+	switch usage {
+	case 0:
+		if len(data) < 3 {
+			return errPGPTruncated
+		}
+		mpis = data[1 : len(data)-2]
+		var sum uint16
+		for _, b := range mpis {
+			sum += uint16(b)
+		}
+		if sum != binary.BigEndian.Uint16(data[len(data)-2:]) {
+			return fmt.Errorf("Invalid OpenPGP secret key checksum")
+		}
+	case 254, 255:
+		if len(data) < 3 {
+			return errPGPTruncated
+		}
+		keyLen, err := pgpCipherKeyLen(data[1])
+		if err != nil {
+			return err
+		}
+		key, rest, err := pgpS2K(data[2:], passphrase, keyLen)
+		if err != nil {
+			return err
+		}
+		if len(rest) < aes.BlockSize {
+			return errPGPTruncated
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		plain := cfbDecrypt(block, rest[:aes.BlockSize], rest[aes.BlockSize:])
+		if usage == 254 {
+			if len(plain) < sha1.Size {
+				return errPGPTruncated
+			}
+			mpis = plain[:len(plain)-sha1.Size]
+			sum := sha1.Sum(mpis)
+			if !bytes.Equal(sum[:], plain[len(plain)-sha1.Size:]) {
+				return fmt.Errorf("Wrong OpenPGP passphrase")
+			}
+		} else {
+			if len(plain) < 2 {
+				return errPGPTruncated
+			}
+			mpis = plain[:len(plain)-2]
+			var sum uint16
+			for _, b := range mpis {
+				sum += uint16(b)
+			}
+			if sum != binary.BigEndian.Uint16(plain[len(plain)-2:]) {
+				return fmt.Errorf("Wrong OpenPGP passphrase")
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported OpenPGP secret key protection %d", usage)
+	}
+	return k.parsePrivate(mpis)
+}
+
+//parsePrivate reads the secret MPIs of a signing key. The secret part
+//of an encryption key is not needed to send mails and is left out.
+func (k *pgpKey) parsePrivate(mpis []byte) error {
+	switch k.algorithm {
+	case pgpRSA, pgpRSASign:
+		var values [4][]byte
+		var err error
+		for i := range values {
+			if values[i], mpis, err = readMPI(mpis); err != nil {
+				return err
+			}
+		}
+		private := &rsa.PrivateKey{
+			PublicKey: *k.rsa,
+			D:         new(big.Int).SetBytes(values[0]),
+			Primes:    []*big.Int{new(big.Int).SetBytes(values[1]), new(big.Int).SetBytes(values[2])},
+		}
+		if err = private.Validate(); err != nil {
+			return err
+		}
+		private.Precompute()
+		k.private = private
+	case pgpEdDSA:
+		seed, _, err := readMPI(mpis)
+		if err != nil {
+			return err
+		}
+		if len(seed) > ed25519.SeedSize {
+			return fmt.Errorf("Invalid OpenPGP Ed25519 secret key")
+		}
+		seed = append(make([]byte, ed25519.SeedSize-len(seed)), seed...)
+		private := ed25519.NewKeyFromSeed(seed)
+		if !bytes.Equal(private.Public().(ed25519.PublicKey), k.ed25519) {
+			return fmt.Errorf("The OpenPGP Ed25519 secret key does not match its public key")
+		}
+		k.private = private
+	}
+	return nil
+}
+
+//pgpCipherKeyLen returns the key size of an AES algorithm
+func pgpCipherKeyLen(algorithm byte) (int, error) {
+	switch algorithm {
+	case pgpAES128:
+		return 16, nil
+	case pgpAES192:
+		return 24, nil
+	case pgpAES256:
+		return 32, nil
+	}
+	return 0, fmt.Errorf("Unsupported OpenPGP cipher %d", algorithm)
+}
+
+//pgpHash returns the hash function of algorithm
+func pgpHash(algorithm byte) (func() hash.Hash, error) {
+	switch algorithm {
+	case pgpSHA1:
+		return sha1.New, nil
+	case pgpSHA256:
+		return sha256.New, nil
+	case pgpSHA384:
+		return sha512.New384, nil
+	case pgpSHA512:
+		return sha512.New, nil
+	case pgpSHA224:
+		return sha256.New224, nil
+	}
+	return nil, fmt.Errorf("Unsupported OpenPGP hash %d", algorithm)
+}
+
+//pgpS2K reads a string-to-key specifier and derives a key of keyLen
+//bytes from passphrase, RFC 4880 3.7
+func pgpS2K(data []byte, passphrase string, keyLen int) ([]byte, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errPGPTruncated
+	}
+	s2kType := data[0]
+	newHash, err := pgpHash(data[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	rest := data[2:]
+	var salt []byte
+	count := 0
+	switch s2kType {
+	case 0:
+	case 1, 3:
+		if len(rest) < 8 {
+			return nil, nil, errPGPTruncated
+		}
+		salt, rest = rest[:8], rest[8:]
+		if s2kType == 3 {
+			if len(rest) < 1 {
+				return nil, nil, errPGPTruncated
+			}
+			count = (16 + int(rest[0]&15)) << (uint(rest[0]>>4) + 6)
+			rest = rest[1:]
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unsupported OpenPGP S2K %d", s2kType)
+	}
+
+	input := append(append([]byte(nil), salt...), passphrase...)
+	if count < len(input) {
+		count = len(input)
+	}
+	var key []byte
+	for preload := 0; len(key) < keyLen; preload++ {
+		h := newHash()
+		h.Write(make([]byte, preload))
+		for total := count; total > 0; total -= len(input) {
+			if total < len(input) {
+				h.Write(input[:total])
+				break
+			}
+			h.Write(input)
+		}
+		key = h.Sum(key)
+	}
+	return key[:keyLen], rest, nil
+}
+
+//cfbEncrypt encrypts data in the CFB mode used by OpenPGP, RFC 4880 13.9
+func cfbEncrypt(block cipher.Block, iv []byte, data []byte) []byte {
+	out := make([]byte, len(data))
+	feedback := append([]byte(nil), iv...)
+	for i := 0; i < len(data); i += block.BlockSize() {
+		block.Encrypt(feedback, feedback)
+		n := copy(out[i:], data[i:])
+		if n > len(feedback) {
+			n = len(feedback)
+		}
+		for j := 0; j < n; j++ {
+			out[i+j] ^= feedback[j]
+		}
+		copy(feedback, out[i:i+n])
+	}
+	return out
+}
+
+//cfbDecrypt reverses cfbEncrypt
+func cfbDecrypt(block cipher.Block, iv []byte, data []byte) []byte {
+	out := make([]byte, len(data))
+	feedback := append([]byte(nil), iv...)
+	for i := 0; i < len(data); i += block.BlockSize() {
+		block.Encrypt(feedback, feedback)
+		n := len(data) - i
+		if n > len(feedback) {
+			n = len(feedback)
+		}
+		for j := 0; j < n; j++ {
+			out[i+j] = data[i+j] ^ feedback[j]
+		}
+		copy(feedback, data[i:i+n])
+	}
+	return out
+}
+
+//sign returns the version 4 signature packet of data, RFC 4880 5.2.3
+func (k *pgpKey) sign(sigType byte, data []byte, now time.Time) ([]byte, error) {
+	if k.private == nil {
+		return nil, fmt.Errorf("The OpenPGP signing key is locked or missing")
+	}
+	created := uint32(now.Unix())
+	hashedSubpackets := []byte{5, 2, byte(created >> 24), byte(created >> 16), byte(created >> 8), byte(created)}
+	hashedSubpackets = append(hashedSubpackets, 22, 33, 4)
+	hashedSubpackets = append(hashedSubpackets, k.fingerprint...)
+	unhashedSubpackets := append([]byte{9, 16}, k.keyID()...)
+
+	hashed := []byte{4, sigType, k.algorithm, pgpSHA256, byte(len(hashedSubpackets) >> 8), byte(len(hashedSubpackets))}
+	hashed = append(hashed, hashedSubpackets...)
+	h := sha256.New()
+	h.Write(data)
+	h.Write(hashed)
+	h.Write([]byte{4, 0xff, byte(len(hashed) >> 24), byte(len(hashed) >> 16), byte(len(hashed) >> 8), byte(len(hashed))})
+	digest := h.Sum(nil)
+
+	body := append(hashed, byte(len(unhashedSubpackets)>>8), byte(len(unhashedSubpackets)))
+	body = append(body, unhashedSubpackets...)
+	body = append(body, digest[:2]...)
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		signature, err := rsa.SignPKCS1v15(randReader, private, crypto.SHA256, digest)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, pgpMPI(signature)...)
+	case ed25519.PrivateKey:
+		signature := ed25519.Sign(private, digest)
+		body = append(body, pgpMPI(signature[:32])...)
+		body = append(body, pgpMPI(signature[32:])...)
+	default:
+		return nil, fmt.Errorf("Unsupported OpenPGP signing key")
+	}
+	return pgpPacket(pgpTagSignature, body), nil
+}
+
+//encryptSessionKey returns the public-key encrypted session key packet
+//of the key, RFC 4880 5.1 and RFC 6637 8
+func (k *pgpKey) encryptSessionKey(sessionKey []byte) ([]byte, error) {
+	//the algorithm of the session key, the key and its checksum
+	var sum uint16
+	for _, b := range sessionKey {
+		sum += uint16(b)
+	}
+	message := append([]byte{pgpAES256}, sessionKey...)
+	message = append(message, byte(sum>>8), byte(sum))
+
+	body := append([]byte{3}, k.keyID()...)
+	body = append(body, k.algorithm)
+	switch k.algorithm {
+	case pgpRSA, pgpRSAEncrypt:
+		encrypted, err := rsa.EncryptPKCS1v15(randReader, k.rsa, message)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, pgpMPI(encrypted)...)
+	case pgpECDH:
+		ephemeral, err := ecdh.X25519().GenerateKey(randReader)
+		if err != nil {
+			return nil, err
+		}
+		public, err := ecdh.X25519().NewPublicKey(k.x25519)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := ephemeral.ECDH(public)
+		if err != nil {
+			return nil, err
+		}
+		kek, err := k.ecdhKEK(shared)
+		if err != nil {
+			return nil, err
+		}
+		//PKCS #5 padding to a multiple of 8 bytes
+		padding := 8 - len(message)%8
+		message = append(message, bytes.Repeat([]byte{byte(padding)}, padding)...)
+		wrapped, err := aesKeyWrap(kek, message)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, pgpMPI(append([]byte{0x40}, ephemeral.PublicKey().Bytes()...))...)
+		body = append(body, byte(len(wrapped)))
+		body = append(body, wrapped...)
+	default:
+		return nil, fmt.Errorf("Unsupported OpenPGP encryption key")
+	}
+	return pgpPacket(pgpTagPKESK, body), nil
+}
+
+//ecdhKEK derives the key wrapping the session key from the shared
+//secret of an ECDH key, RFC 6637 7
+func (k *pgpKey) ecdhKEK(shared []byte) ([]byte, error) {
+	newHash, err := pgpHash(k.kdfHash)
+	if err != nil {
+		return nil, err
+	}
+	keyLen, err := pgpCipherKeyLen(k.kdfCipher)
+	if err != nil {
+		return nil, err
+	}
+	param := append([]byte{byte(len(pgpOIDCurve25519))}, pgpOIDCurve25519...)
+	param = append(param, pgpECDH, 3, 1, k.kdfHash, k.kdfCipher)
+	param = append(param, "Anonymous Sender    "...)
+	param = append(param, k.fingerprint...)
+
+	h := newHash()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(shared)
+	h.Write(param)
+	kek := h.Sum(nil)
+	if len(kek) < keyLen {
+		return nil, fmt.Errorf("The OpenPGP KDF hash is too short")
+	}
+	return kek[:keyLen], nil
+}
+
+//aesKeyWrap wraps key with kek, RFC 3394
+func aesKeyWrap(kek []byte, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := append([]byte(nil), key...)
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(b, a)
+			copy(b[8:], r[i*8:(i+1)*8])
+			block.Encrypt(b, b)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(b[:8])^uint64(n*j+i+1))
+			copy(r[i*8:], b[8:])
+		}
+	}
+	return append(a, r...), nil
+}
+
+//pgpEncrypt returns the OpenPGP message holding data encrypted with
+//AES-256 for the keys, in a symmetrically encrypted and integrity
+//protected data packet, RFC 4880 5.13
+func pgpEncrypt(data []byte, keys []*pgpKey) ([]byte, error) {
+	sessionKey := make([]byte, 32)
+	prefix := make([]byte, aes.BlockSize, aes.BlockSize+2)
+	if _, err := io.ReadFull(randReader, sessionKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(randReader, prefix); err != nil {
+		return nil, err
+	}
+
+	var message []byte
+	for _, k := range keys {
+		packet, err := k.encryptSessionKey(sessionKey)
+		if err != nil {
+			return nil, err
+		}
+		message = append(message, packet...)
+	}
+
+	//a binary literal data packet without name or date
+	literal := pgpPacket(pgpTagLiteral, append([]byte{'b', 0, 0, 0, 0, 0}, data...))
+	plain := append(prefix, prefix[aes.BlockSize-2:]...)
+	plain = append(plain, literal...)
+	plain = append(plain, 0xc0|pgpTagMDC, sha1.Size)
+	mdc := sha1.Sum(plain)
+	plain = append(plain, mdc[:]...)
+
+	block, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := cfbEncrypt(block, make([]byte, aes.BlockSize), plain)
+	return append(message, pgpPacket(pgpTagEncryptedData, append([]byte{1}, encrypted...))...), nil
+}
@@ -0,0 +1,355 @@
+package mailsender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+//ErrPoolClosed is returned when sending through a closed Pool
+var ErrPoolClosed = errors.New("The pool is closed")
+
+//defaultMaxIdle is the number of idle sessions kept when MaxIdle is 0
+const defaultMaxIdle = 2
+
+//quitTimeout bounds the QUIT sent to the sessions closed by the pool
+//outside of a send
+const quitTimeout = 10 * time.Second
+
+//Pool sends mails to one server reusing authenticated sessions.
+//Between mails the session is reset with RSET and an idle session is
+//checked with NOOP before being used again. A session dropped by the
+//server is replaced transparently. A Pool is safe for concurrent use
+//and must not be copied after its first use.
+type Pool struct {
+	//Server is the address of the mail server, as host:port
+	Server string
+	//Mode selects how the connection is secured, TLSNone by default
+	Mode TLSMode
+	//TLSConfig is used for TLSImplicit, TLSStartTLS and TLSOpportunistic.
+	//When it is nil CreateTLSConfig is used.
+	TLSConfig *tls.Config
+	//Username and Password are the credentials. No authentication is
+	//done when Username is empty.
+	Username string
+	Password string
+	//AuthMechanism pins the SASL mechanism, as for Impl
+	AuthMechanism string
+	//LocalName is the host name sent with EHLO, localhost when it is empty
+	LocalName string
+	//Timeouts limits the phases of each session
+	Timeouts Timeouts
+	//MaxIdle is the number of idle sessions kept open, 2 when it is 0.
+	//A negative value keeps none.
+	MaxIdle int
+	//MaxOpen limits the number of sessions sending at the same time,
+	//the others wait for one of them to be free. When it is 0 there is
+	//no limit.
+	MaxOpen int
+	//MaxMessages is the number of mails sent on a session before it is
+	//closed, to stay below the limit of the server. When it is 0 there
+	//is no limit.
+	MaxMessages int
+	//IdleTimeout closes the sessions idle for longer. When it is 0 they
+	//are kept until the server drops them.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   []*session
+	slots  chan struct{}
+	closed bool
+}
+
+//Send sends the mail on a session of the pool
+func (p *Pool) Send(ms MailStruct) (*Result, error) {
+	return p.SendContext(context.Background(), ms)
+}
+
+//SendContext sends the mail on a session of the pool, giving up when
+//ctx is done. When a reused session turns out to be dropped by the
+//server before the content of the mail was written, the mail is sent on
+//a new one.
+func (p *Pool) SendContext(ctx context.Context, ms MailStruct) (*Result, error) {
+	for {
+		s, reused, err := p.get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		result, err := s.send(ms)
+		//once its content was written the mail can not be sent again,
+		//its Reader attachments being consumed
+		content := s.content
+		p.put(s)
+		if reused && ctx.Err() == nil && !content && sessionLost(err) {
+			continue
+		}
+		return result, err
+	}
+}
+
+//Close closes the idle sessions. The sessions in use are closed when
+//their mail is sent.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, s := range idle {
+		p.discard(s)
+	}
+	return nil
+}
+
+//get returns an idle session, checked with NOOP, or a new one when
+//there is none. reused tells if the session was already used.
+func (p *Pool) get(ctx context.Context) (s *session, reused bool, err error) {
+	p.mu.Lock()
+	if p.slots == nil && p.MaxOpen > 0 {
+		p.slots = make(chan struct{}, p.MaxOpen)
+	}
+	slots := p.slots
+	p.mu.Unlock()
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false, newSMTPError(StageDial, ctx.Err())
+		}
+	}
+
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.release()
+			return nil, false, ErrPoolClosed
+		}
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		//the last session returned is the least likely to be dropped
+		s = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if p.IdleTimeout > 0 && time.Since(s.idleSince) > p.IdleTimeout {
+			p.discard(s)
+			continue
+		}
+		s.watch(ctx)
+		if s.noop() != nil {
+			if err = ctx.Err(); err != nil {
+				p.release()
+				return nil, false, newSMTPError(StageDial, err)
+			}
+			continue
+		}
+		return s, true, nil
+	}
+
+	if s, err = p.dial(ctx); err != nil {
+		p.release()
+		return nil, false, err
+	}
+	return s, false, nil
+}
+
+//dial opens and authenticates a new session
+func (p *Pool) dial(ctx context.Context) (*session, error) {
+	var auth smtp.Auth
+	if p.Username != "" {
+		host, _, err := net.SplitHostPort(p.Server)
+		if err != nil {
+			return nil, newSMTPError(StageDial, err)
+		}
+		impl := Impl{AuthMechanism: p.AuthMechanism}
+		if auth, err = impl.newAuth(p.Username, p.Password, host); err != nil {
+			return nil, newSMTPError(StageAuth, err)
+		}
+	}
+
+	mode := p.Mode
+	if mode == "" {
+		mode = TLSNone
+	}
+	s, err := dialSession(ctx, p.Server, mode, p.TLSConfig, p.Timeouts, p.LocalName)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		if err = s.authenticate(auth); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//put returns the session to the pool once its mail is sent, unless
+//it is broken, reached MaxMessages or there are enough idle sessions
+func (p *Pool) put(s *session) {
+	defer p.release()
+	if s.closed {
+		return
+	}
+	if p.MaxMessages > 0 && s.messages >= p.MaxMessages {
+		s.close()
+		return
+	}
+
+	s.unwatch()
+	maxIdle := p.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdle
+	}
+
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < maxIdle {
+		s.idleSince = time.Now()
+		p.idle = append(p.idle, s)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	p.discard(s)
+}
+
+//discard closes a session that is not bound to a context
+func (p *Pool) discard(s *session) {
+	ctx, cancel := context.WithTimeout(context.Background(), quitTimeout)
+	s.watch(ctx)
+	s.close()
+	cancel()
+}
+
+//release frees the slot of a session that is not used anymore
+func (p *Pool) release() {
+	p.mu.Lock()
+	slots := p.slots
+	p.mu.Unlock()
+	if slots != nil {
+		<-slots
+	}
+}
+
+//sessionLost tells if err means the server dropped a reused session
+//before the mail transaction started, as with a 421 reply when its
+//limit of messages per connection is reached. No recipient got the
+//mail, so it can be sent on another session.
+func sessionLost(err error) bool {
+	smtpErr, ok := err.(*SMTPError)
+	if !ok || smtpErr.Stage != StageMail {
+		return false
+	}
+	return smtpErr.Code == 0 || smtpErr.Code == 421
+}
+
+//poolKey identifies the pools of a PoolSender
+type poolKey struct {
+	server   string
+	mode     TLSMode
+	usermail string
+	pass     string
+}
+
+//PoolSender is a MailSender sending through a Pool for each server and
+//account it is used with, so that consecutive mails reuse the sessions.
+//The tls configuration of the first mail sent with a server and account
+//is used for all the others. Close closes the pools.
+type PoolSender struct {
+	//AuthMechanism, Timeouts, MaxOpen and MaxMessages are used for
+	//the pools created
+	AuthMechanism string
+	Timeouts      Timeouts
+	MaxOpen       int
+	MaxMessages   int
+
+	mu    sync.Mutex
+	pools map[poolKey]*Pool
+}
+
+//pool returns the pool for the server and account, creating it on first use
+func (ps *PoolSender) pool(server string, mode TLSMode, tlsconfig *tls.Config, usermail string, pass string) *Pool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.pools == nil {
+		ps.pools = make(map[poolKey]*Pool)
+	}
+	key := poolKey{server: server, mode: mode, usermail: usermail, pass: pass}
+	if _, ok := ps.pools[key]; !ok {
+		ps.pools[key] = &Pool{
+			Server:        server,
+			Mode:          mode,
+			TLSConfig:     tlsconfig,
+			Username:      usermail,
+			Password:      pass,
+			AuthMechanism: ps.AuthMechanism,
+			Timeouts:      ps.Timeouts,
+			MaxOpen:       ps.MaxOpen,
+			MaxMessages:   ps.MaxMessages,
+		}
+	}
+	return ps.pools[key]
+}
+
+//Close closes the pools
+func (ps *PoolSender) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for key, pool := range ps.pools {
+		pool.Close()
+		delete(ps.pools, key)
+	}
+	return nil
+}
+
+//SendMailTLS sends the mail over implicit TLS on a pooled session
+func (ps *PoolSender) SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ps.SendMailTLSContext(context.Background(), server, tlsconfig, usermail, pass, ms)
+}
+
+//SendMailStartTLS sends the mail using STARTTLS on a pooled session
+func (ps *PoolSender) SendMailStartTLS(server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ps.SendMailStartTLSContext(context.Background(), server, tlsconfig, mandatory, usermail, pass, ms)
+}
+
+//SendMail sends the mail unencrypted, with authentication, on a pooled session
+func (ps *PoolSender) SendMail(server string, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ps.SendMailContext(context.Background(), server, usermail, pass, ms)
+}
+
+//SendMailWithoutAuth sends the mail unencrypted, without authentication,
+//on a pooled session
+func (ps *PoolSender) SendMailWithoutAuth(server string, ms MailStruct) (*Result, error) {
+	return ps.SendMailWithoutAuthContext(context.Background(), server, ms)
+}
+
+//SendMailTLSContext is SendMailTLS stopping when ctx is done
+func (ps *PoolSender) SendMailTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ps.pool(server, TLSImplicit, tlsconfig, usermail, pass).SendContext(ctx, ms)
+}
+
+//SendMailStartTLSContext is SendMailStartTLS stopping when ctx is done
+func (ps *PoolSender) SendMailStartTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error) {
+	mode := TLSOpportunistic
+	if mandatory {
+		mode = TLSStartTLS
+	}
+	return ps.pool(server, mode, tlsconfig, usermail, pass).SendContext(ctx, ms)
+}
+
+//SendMailContext is SendMail stopping when ctx is done
+func (ps *PoolSender) SendMailContext(ctx context.Context, server string, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ps.pool(server, TLSNone, nil, usermail, pass).SendContext(ctx, ms)
+}
+
+//SendMailWithoutAuthContext is SendMailWithoutAuth stopping when ctx is done
+func (ps *PoolSender) SendMailWithoutAuthContext(ctx context.Context, server string, ms MailStruct) (*Result, error) {
+	return ps.pool(server, TLSNone, nil, "", "").SendContext(ctx, ms)
+}
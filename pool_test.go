@@ -0,0 +1,176 @@
+package mailsender_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func poolMail(i int) mailsender.MailStruct {
+	return mailsender.MailStruct{
+		From:    mail.Address{Address: "src@server.com"},
+		To:      []mail.Address{{Address: "to@server.com"}},
+		Subject: fmt.Sprintf("mail %d", i),
+		Body:    "body",
+	}
+}
+
+func TestPoolReusesSessions(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.Users = map[string]string{"src@server.com": "secret"}
+	server.Mechanisms = []string{"PLAIN"}
+	server.Start()
+	defer server.Close()
+
+	pool := &mailsender.Pool{Server: server.Addr, Username: "src@server.com", Password: "secret"}
+	for i := 0; i < 5; i++ {
+		result, err := pool.Send(poolMail(i))
+		assert.Nil(err, "No error expected, got %v", err)
+		assert.Equal(1, len(result.Accepted))
+	}
+	assert.Nil(pool.Close())
+
+	assert.Equal(1, server.Connections(), "A single session should be used")
+	assert.Equal(4, server.Commands("NOOP"), "The idle session should be checked before each reuse")
+	messages := server.Messages()
+	assert.Equal(5, len(messages))
+	assert.Equal("src@server.com", messages[4].User)
+
+	_, err := pool.Send(poolMail(5))
+	assert.Equal(mailsender.ErrPoolClosed, err)
+}
+
+func TestPoolReconnects(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.MaxMessages = 2
+	server.Start()
+	defer server.Close()
+
+	pool := &mailsender.Pool{Server: server.Addr}
+	defer pool.Close()
+
+	//the third mail gets a 421 on the reused session and goes on a new one
+	for i := 0; i < 3; i++ {
+		_, err := pool.Send(poolMail(i))
+		assert.Nil(err, "No error expected, got %v", err)
+	}
+	assert.Equal(2, server.Connections())
+
+	server.CloseConnections()
+	_, err := pool.Send(poolMail(3))
+	assert.Nil(err, "A dropped session should be replaced, got %v", err)
+	assert.Equal(3, server.Connections())
+	assert.Equal(4, len(server.Messages()))
+}
+
+func TestPoolMaxMessages(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	pool := &mailsender.Pool{Server: server.Addr, MaxMessages: 2}
+	defer pool.Close()
+	for i := 0; i < 5; i++ {
+		_, err := pool.Send(poolMail(i))
+		assert.Nil(err, "No error expected, got %v", err)
+	}
+	assert.Equal(3, server.Connections(), "A session should be closed after MaxMessages")
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	pool := &mailsender.Pool{Server: server.Addr, MaxOpen: 2, MaxIdle: 2}
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := pool.Send(poolMail(i))
+			assert.Nil(err, "No error expected, got %v", err)
+		}(i)
+	}
+	wg.Wait()
+
+	connections := server.Connections()
+	assert.True(connections <= 2, "At most 2 sessions expected, got %d", connections)
+	assert.Equal(20, len(server.Messages()))
+
+	//with every session busy the context ends the wait
+	server.Stall("MAIL")
+	stalled := &mailsender.Pool{Server: server.Addr, MaxOpen: 1, Timeouts: mailsender.Timeouts{Command: time.Second}}
+	defer stalled.Close()
+	go stalled.SendContext(context.Background(), poolMail(0))
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := stalled.SendContext(ctx, poolMail(1))
+	assert.True(errors.Is(err, context.DeadlineExceeded), "Deadline exceeded expected, got %v", err)
+}
+
+func TestPoolKeepsSessionAfterRejection(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	server.RejectRecipient("nobody@server.com")
+
+	pool := &mailsender.Pool{Server: server.Addr}
+	defer pool.Close()
+
+	ms := poolMail(0)
+	ms.To = []mail.Address{{Address: "nobody@server.com"}}
+	_, err := pool.Send(ms)
+	assert.True(errors.Is(err, mailsender.ErrAllRecipientsRejected))
+
+	_, err = pool.Send(poolMail(1))
+	assert.Nil(err, "No error expected, got %v", err)
+	assert.Equal(1, server.Connections(), "A refused mail should not end the session")
+}
+
+func TestPoolRetryKeepsReader(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+
+	pool := &mailsender.Pool{Server: server.Addr}
+	defer pool.Close()
+	_, err := pool.Send(poolMail(0))
+	assert.Nil(err, "No error expected, got %v", err)
+
+	//the dropped session fails before the content, which is still unread
+	server.CloseConnections()
+	ms := poolMail(1)
+	ms.Attachments = []mailsender.Attachment{mailsender.AttachReader("statement.csv", strings.NewReader("date,amount\n"))}
+	_, err = pool.Send(ms)
+	assert.Nil(err, "No error expected, got %v", err)
+
+	messages := server.Messages()
+	if assert.Equal(2, len(messages)) {
+		if attachment := messages[1].Attachment("statement.csv"); assert.NotNil(attachment) {
+			assert.Equal("date,amount\n", string(attachment.Data))
+		}
+	}
+
+	//a session dropped after the content is not used again for the mail
+	server.DropConnection(".")
+	ms = poolMail(2)
+	ms.Attachments = []mailsender.Attachment{mailsender.AttachReader("statement.csv", strings.NewReader("date,amount\n"))}
+	_, err = pool.Send(ms)
+	assert.NotNil(err, "The mail should not be sent again once its content was written")
+	assert.Equal(2, len(server.Messages()))
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//maxBatchSize is the number of mails accepted in one /sendbatch request
+const maxBatchSize = 10000
+
+//defaultBatchConcurrency is the number of mails of a batch sent at the
+//same time when batchconcurrency is not set
+const defaultBatchConcurrency = 4
+
+//BatchRequest is a mail of a /sendbatch request, each mail having its
+//own template data
+type BatchRequest struct {
+	mailsender.MailStruct
+	TemplateRequest
+	Callback string `json:"callback"`
+}
+
+//BatchItemResponse is the result of one mail of a /sendbatch request,
+//at the position of the mail in the request
+type BatchItemResponse struct {
+	//ID is the id of the mail in /messages
+	ID        string `json:"id,omitempty"`
+	MessageID string `json:"messageid,omitempty"`
+	//Status is the HTTP status the mail would get from /sendmail
+	Status   int                 `json:"status"`
+	Accepted []string            `json:"accepted,omitempty"`
+	Rejected []RejectedRecipient `json:"rejected,omitempty"`
+	Error    *ErrorResponse      `json:"error,omitempty"`
+}
+
+//RejectedRecipient is a recipient refused by the mail server
+type RejectedRecipient struct {
+	Address string `json:"address"`
+	Error   string `json:"error"`
+}
+
+//newBatchItemResponse builds the response for a mail of a batch. status
+//is used when err does not come from the mail server.
+func newBatchItemResponse(messageID string, result *mailsender.Result, status int, err error) BatchItemResponse {
+	item := BatchItemResponse{MessageID: messageID, Status: http.StatusOK}
+	if result != nil {
+		for _, accepted := range result.Accepted {
+			item.Accepted = append(item.Accepted, accepted.Address)
+		}
+		for _, rejected := range result.Rejected {
+			item.Rejected = append(item.Rejected, RejectedRecipient{Address: rejected.Address.Address, Error: rejected.Err.Error()})
+		}
+	}
+	if err != nil {
+		var response ErrorResponse
+		item.Status, response = errorResponse(status, err)
+		item.Error = &response
+	}
+	return item
+}
+
+//batchSenders hands out the senders of a batch, one PoolSender for each
+//authentication mechanism, so that the mails of an account reuse the
+//same sessions
+type batchSenders struct {
+	mss     *MailSenderService
+	mu      sync.Mutex
+	senders map[string]*mailsender.PoolSender
+}
+
+func newBatchSenders(mss *MailSenderService) *batchSenders {
+	return &batchSenders{mss: mss, senders: make(map[string]*mailsender.PoolSender)}
+}
+
+//get returns the sender used for mails coming from address
+func (bs *batchSenders) get(address string) mailsender.MailSender {
+	mechanism := bs.mss.authMechanism(address)
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if _, ok := bs.senders[mechanism]; !ok {
+		bs.senders[mechanism] = &mailsender.PoolSender{
+			AuthMechanism: mechanism,
+			Timeouts:      bs.mss.Mail.Timeouts.durations(),
+			MaxOpen:       bs.mss.Mail.BatchConcurrency,
+		}
+	}
+	return bs.senders[mechanism]
+}
+
+//close closes the sessions of the batch
+func (bs *batchSenders) close() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, sender := range bs.senders {
+		sender.Close()
+	}
+}
+
+//SendBatch sends the mails, already validated, at most batchconcurrency
+//at the same time, with the sender returned by newSender for the address
+//of each of them. They are tracked and their events posted as for
+///sendmail, callbacks holding the callback URL of each mail, or being
+//nil. The results are in the order of the mails.
+func (mss *MailSenderService) SendBatch(ctx context.Context, newSender func(address string) mailsender.MailSender,
+	mails []mailsender.MailStruct, callbacks []string) []BatchItemResponse {
+
+	workers := mss.Mail.BatchConcurrency
+	if workers <= 0 {
+		workers = defaultBatchConcurrency
+	}
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := range mails {
+			indexes <- i
+		}
+	}()
+
+	items := make([]BatchItemResponse, len(mails))
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				ms := mails[i]
+				callback := ""
+				if callbacks != nil {
+					callback = callbacks[i]
+				}
+				if err := ctx.Err(); err != nil {
+					items[i] = newBatchItemResponse(ms.MessageID, nil, http.StatusInternalServerError, err)
+					continue
+				}
+				id, result, err := mss.sendNow(ctx, newSender(ms.From.Address), ms, callback)
+				items[i] = newBatchItemResponse(ms.MessageID, result, http.StatusInternalServerError, err)
+				items[i].ID = id
+			}
+		}()
+	}
+	wg.Wait()
+	return items
+}
+
+//SendBatchMessage is the method that links the /sendbatch REST call to
+//SendBatch, or to the queue when there is one. The body is a JSON array of
+//mails and the answer a JSON array with the result of each of them, in
+//the same order. An invalid mail is not sent but does not stop the others.
+func (mss *MailSenderService) SendBatchMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Sorry, only POST allowed!"))
+		return
+	}
+
+	var requests []BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(requests) > maxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("At most %d mails can be sent in a batch", maxBatchSize))
+		return
+	}
+
+	items := make([]BatchItemResponse, len(requests))
+	valid := make([]mailsender.MailStruct, 0, len(requests))
+	callbacks := make([]string, 0, len(requests))
+	positions := make([]int, 0, len(requests))
+	for i := range requests {
+		ms := &requests[i].MailStruct
+		if err := mss.accept(ms, requests[i].TemplateRequest, requests[i].Callback); err != nil {
+			items[i] = newBatchItemResponse(ms.MessageID, nil, http.StatusBadRequest, err)
+			continue
+		}
+		if mss.queue != nil {
+			id, err := mss.queue.EnqueueWithCallback(*ms, requests[i].Callback)
+			if err != nil {
+				items[i] = newBatchItemResponse(ms.MessageID, nil, http.StatusInternalServerError, err)
+				continue
+			}
+			items[i] = BatchItemResponse{ID: id, MessageID: ms.MessageID, Status: http.StatusAccepted}
+			continue
+		}
+		valid = append(valid, *ms)
+		callbacks = append(callbacks, requests[i].Callback)
+		positions = append(positions, i)
+	}
+
+	senders := newBatchSenders(mss)
+	defer senders.close()
+	for i, item := range mss.SendBatch(r.Context(), senders.get, valid, callbacks) {
+		items[positions[i]] = item
+	}
+
+	writeJSON(w, items)
+}
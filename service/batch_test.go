@@ -0,0 +1,130 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceSendBatch(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{Server: "exampleserver.com:25", BatchConcurrency: 2}}
+
+	mails := []mailsender.MailStruct{
+		{From: mail.Address{Address: "src@server.com"}, To: []mail.Address{{Address: "a@server.com"}}, MessageID: "1@server.com"},
+		{From: mail.Address{Address: "src@server.com"}, To: []mail.Address{{Address: "b@server.com"}}, MessageID: "2@server.com"},
+	}
+	refused := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550, Message: "No such user", Err: mailsender.ErrAllRecipientsRejected}
+
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMailWithoutAuth", "exampleserver.com:25", mails[0]).Return(&mailsender.Result{MessageID: "1@server.com", Accepted: mails[0].To}, nil)
+	mockMailSender.On("SendMailWithoutAuth", "exampleserver.com:25", mails[1]).Return((*mailsender.Result)(nil), refused)
+
+	newSender := func(address string) mailsender.MailSender { return mockMailSender }
+	results := serv.SendBatch(context.Background(), newSender, mails, nil)
+
+	assert.Equal(2, len(results))
+	assert.Equal(http.StatusOK, results[0].Status)
+	assert.Equal("1@server.com", results[0].MessageID)
+	assert.Equal([]string{"a@server.com"}, results[0].Accepted)
+	assert.Equal(http.StatusUnprocessableEntity, results[1].Status)
+	assert.Equal("2@server.com", results[1].MessageID)
+	mockMailSender.AssertExpectations(t)
+
+	qm, ok := serv.tracker().Get(results[1].ID)
+	assert.True(ok, "The mails sent should be tracked")
+	assert.Equal(StatusFailed, qm.Status)
+	assert.Equal("2@server.com", qm.Mail.MessageID)
+}
+
+func TestSendBatchMessage(t *testing.T) {
+	assert := assert.New(t)
+	//nothing listens on the port, so the valid mail can not be sent
+	serv := MailSenderService{Mail: MailSetup{Server: "127.0.0.1:1", DefaultMail: "mail@exampleserver.com"}}
+
+	body := `[{"To":[{"Address":"not an address"}]},{"To":[{"Address":"dest@server.com"}]}]`
+	w := httptest.NewRecorder()
+	serv.SendBatchMessage(w, httptest.NewRequest(http.MethodPost, "/sendbatch", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var items []BatchItemResponse
+	assert.Nil(json.NewDecoder(w.Body).Decode(&items))
+	assert.Equal(2, len(items))
+	assert.Equal(http.StatusBadRequest, items[0].Status)
+	assert.NotNil(items[0].Error)
+	assert.Equal(http.StatusServiceUnavailable, items[1].Status)
+	assert.Equal(mailsender.StageDial, items[1].Error.Stage)
+	assert.NotEqual("", items[1].MessageID, "A Message-ID should be generated for the valid mail")
+
+	w = httptest.NewRecorder()
+	serv.SendBatchMessage(w, httptest.NewRequest(http.MethodPost, "/sendbatch", bytes.NewBufferString(`{"To":[]}`)))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	serv.SendBatchMessage(w, httptest.NewRequest(http.MethodGet, "/sendbatch", nil))
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestSendBatchMessageEvents(t *testing.T) {
+	assert := assert.New(t)
+	receiver := newEventReceiver("callbacks", 0)
+	defer receiver.Close()
+
+	serv := MailSenderService{
+		Mail:  MailSetup{Server: "127.0.0.1:1", DefaultMail: "mail@exampleserver.com"},
+		Setup: Setup{CallbackSecret: "callbacks", CallbackHosts: []string{"127.0.0.1"}},
+	}
+	defer serv.Close()
+
+	body := `[{"To":[{"Address":"dest@server.com"}],"callback":"` + receiver.URL + `"},{"To":[{"Address":"other@server.com"}]}]`
+	w := httptest.NewRecorder()
+	serv.SendBatchMessage(w, httptest.NewRequest(http.MethodPost, "/sendbatch", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	events := receiver.wait(t, 2)
+	serv.events().wait()
+	sort.Strings(events)
+	assert.Equal([]string{EventAccepted, EventFailed}, events)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	for _, event := range receiver.events {
+		assert.Equal([]string{"dest@server.com"}, event.Recipients, "Only the events of the mail should reach its callback")
+	}
+}
+
+func TestSendBatchMessageQueued(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	serv := MailSenderService{Mail: MailSetup{Server: "exampleserver.com:25", DefaultMail: "mail@exampleserver.com"}}
+	//the queue is not started, so the mails stay on disk
+	serv.queue = newTestQueue(t, dir, newRecordingSend().send)
+
+	body := `[{"To":[{"Address":"dest@server.com"}],"Subject":"queued"},{"To":[]}]`
+	w := httptest.NewRecorder()
+	serv.SendBatchMessage(w, httptest.NewRequest(http.MethodPost, "/sendbatch", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var items []BatchItemResponse
+	assert.Nil(json.NewDecoder(w.Body).Decode(&items))
+	assert.Equal(2, len(items))
+	assert.Equal(http.StatusAccepted, items[0].Status)
+	qm, ok := serv.queue.Get(items[0].ID)
+	assert.True(ok)
+	assert.Equal("queued", qm.Mail.Subject)
+	assert.Equal(items[0].MessageID, qm.Mail.MessageID)
+	assert.Equal(http.StatusBadRequest, items[1].Status)
+	assert.Equal("", items[1].ID)
+}
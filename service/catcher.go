@@ -0,0 +1,297 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/internal/mimeparse"
+)
+
+//catcherPath is where the web interface of the catcher is served
+const catcherPath = "/catcher/"
+
+//capture makes the setup keep the mails in memory, as the catcher needs
+func (ts *TransportSetup) capture() error {
+	switch ts.Type {
+	case "":
+		ts.Type = TransportMemory
+	case TransportMemory:
+	default:
+		return fmt.Errorf("The catcher can not be used with the %s transport", ts.Type)
+	}
+	return nil
+}
+
+//catcherHeader is a header of a captured mail, decoded
+type catcherHeader struct {
+	Name  string
+	Value string
+}
+
+//catcherMail is a captured mail as shown by the catcher
+type catcherMail struct {
+	mailsender.CapturedMail
+	Headers     []catcherHeader
+	Text        string
+	HTML        string
+	Attachments []mimeparse.Attachment
+	//ParseError is set when the mail is not a valid MIME mail
+	ParseError error
+}
+
+//parseCaptured decodes the headers and the parts of a captured mail
+func parseCaptured(cm mailsender.CapturedMail) *catcherMail {
+	parsed := mimeparse.Parse(cm.Raw)
+	m := &catcherMail{
+		CapturedMail: cm,
+		Text:         parsed.Text,
+		HTML:         parsed.HTML,
+		Attachments:  parsed.Attachments,
+		ParseError:   parsed.Err,
+	}
+	decoder := new(mime.WordDecoder)
+	for name, values := range parsed.Header {
+		for _, value := range values {
+			if decoded, err := decoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			m.Headers = append(m.Headers, catcherHeader{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(m.Headers, func(i, j int) bool {
+		return m.Headers[i].Name < m.Headers[j].Name
+	})
+	return m
+}
+
+//Catcher is the method that links /catcher/ to the web interface
+//showing the mails kept by the memory transport:
+//
+//	/catcher/                        the list of the mails
+//	/catcher/{id}                    a mail, its bodies, headers and source
+//	/catcher/{id}/html               the HTML body, sandboxed
+//	/catcher/{id}/attachments/{n}    the download of an attachment
+//	/catcher/clear                   POST drops all the mails
+func (mss *MailSenderService) Catcher(w http.ResponseWriter, r *http.Request) {
+	if mss.memory == nil {
+		http.Error(w, "The mails are only kept by the memory transport", http.StatusNotFound)
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, catcherPath), "/")
+	if path[0] == "clear" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Sorry, only POST allowed!", http.StatusMethodNotAllowed)
+			return
+		}
+		mss.memory.Clear()
+		http.Redirect(w, r, catcherPath, http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Sorry, only GET allowed!", http.StatusMethodNotAllowed)
+		return
+	}
+	if path[0] == "" {
+		mss.catcherList(w, r)
+		return
+	}
+
+	cm, ok := mss.memory.Message(path[0])
+	if !ok {
+		http.Error(w, fmt.Sprintf("No mail with the id %s", path[0]), http.StatusNotFound)
+		return
+	}
+	m := parseCaptured(cm)
+	switch {
+	case len(path) == 1:
+		catcherMailPage(w, r, m)
+	case len(path) == 2 && path[1] == "html":
+		catcherHTML(w, m)
+	case len(path) == 3 && path[1] == "attachments":
+		catcherAttachmentDownload(w, m, path[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//catcherList shows the mails selected by the query, as for
+///transport/messages
+func (mss *MailSenderService) catcherList(w http.ResponseWriter, r *http.Request) {
+	query, err := parseMailQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	renderCatcher(w, "list", map[string]interface{}{
+		"Title":   "Mails",
+		"Refresh": true,
+		"Query":   query,
+		"Mails":   mss.memory.Messages(query),
+	})
+}
+
+//catcherMailPage shows one view of a mail: its HTML or text body, its
+//headers or its source. The HTML body is shown by default.
+func catcherMailPage(w http.ResponseWriter, r *http.Request, m *catcherMail) {
+	view := r.URL.Query().Get("view")
+	switch view {
+	case "html", "text", "headers", "source":
+	case "":
+		view = "text"
+		if m.HTML != "" {
+			view = "html"
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid view %s", view), http.StatusBadRequest)
+		return
+	}
+	renderCatcher(w, "mail", map[string]interface{}{
+		"Title":  m.Subject,
+		"Views":  []string{"html", "text", "headers", "source"},
+		"Mail":   m,
+		"View":   view,
+		"Source": string(m.Raw),
+	})
+}
+
+//catcherHTML serves the HTML body of a mail, its cid: links pointing to
+//the inline parts. The body is sandboxed so it can not run scripts.
+func catcherHTML(w http.ResponseWriter, m *catcherMail) {
+	body := m.HTML
+	for i, attachment := range m.Attachments {
+		if attachment.ContentID != "" {
+			body = strings.Replace(body, "cid:"+attachment.ContentID, fmt.Sprintf("%s%s/attachments/%d", catcherPath, m.ID, i), -1)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	io.WriteString(w, body)
+}
+
+//catcherAttachmentDownload serves the attachment at the given index
+func catcherAttachmentDownload(w http.ResponseWriter, m *catcherMail, index string) {
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 || i >= len(m.Attachments) {
+		http.Error(w, fmt.Sprintf("No attachment %s", index), http.StatusNotFound)
+		return
+	}
+	attachment := m.Attachments[i]
+	filename := attachment.Filename
+	if filename == "" {
+		filename = "attachment-" + index
+	}
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Data)))
+	w.Write(attachment.Data)
+}
+
+//renderCatcher writes a page of the catcher
+func renderCatcher(w http.ResponseWriter, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := catcherTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+//catcherTemplates are the pages of the catcher, kept in the binary
+var catcherTemplates = template.Must(template.New("catcher").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"time": func(cm mailsender.CapturedMail) string {
+		return cm.Captured.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - Mail catcher</title>
+{{if .Refresh}}<meta http-equiv="refresh" content="5">{{end}}
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+header { background: #2d3e50; color: #fff; padding: 0.6em 1em; display: flex; align-items: center; gap: 1em; }
+header a { color: #fff; text-decoration: none; font-weight: bold; }
+header form { margin-left: auto; }
+main { padding: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.4em 0.6em; border-bottom: 1px solid #ddd; vertical-align: top; }
+tr.mail:hover { background: #f3f6f9; }
+pre { white-space: pre-wrap; word-break: break-all; background: #f7f7f7; padding: 1em; }
+iframe { width: 100%; height: 70vh; border: 1px solid #ddd; }
+nav a { margin-right: 1em; }
+nav a.current { font-weight: bold; }
+.empty, .error { color: #888; }
+</style>
+</head>
+<body>
+<header>
+<a href="/catcher/">Mail catcher</a>
+<form method="post" action="/catcher/clear"><button type="submit">Clear</button></form>
+</header>
+<main>
+{{end}}
+
+{{define "footer"}}</main>
+</body>
+</html>
+{{end}}
+
+{{define "list"}}{{template "header" .}}
+<form method="get" action="/catcher/">
+<input name="from" placeholder="From" value="{{.Query.From}}">
+<input name="recipient" placeholder="Recipient" value="{{.Query.Recipient}}">
+<input name="subject" placeholder="Subject" value="{{.Query.Subject}}">
+<button type="submit">Search</button>
+</form>
+{{if .Mails}}
+<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .Mails}}<tr class="mail">
+<td>{{time .}}</td>
+<td>{{.From}}</td>
+<td>{{join .Recipients ", "}}</td>
+<td><a href="/catcher/{{.ID}}">{{if .Subject}}{{.Subject}}{{else}}(no subject){{end}}</a></td>
+<td>{{.Size}}</td>
+</tr>
+{{end}}</table>
+{{else}}<p class="empty">No mails were captured.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "mail"}}{{template "header" .}}
+<h2>{{.Mail.Subject}}</h2>
+<table>
+<tr><th>From</th><td>{{.Mail.From}}</td></tr>
+<tr><th>To</th><td>{{join .Mail.Recipients ", "}}</td></tr>
+<tr><th>Received</th><td>{{time .Mail.CapturedMail}}</td></tr>
+{{if .Mail.Attachments}}<tr><th>Attachments</th><td>{{$id := .Mail.ID}}{{range $i, $a := .Mail.Attachments}}
+<a href="/catcher/{{$id}}/attachments/{{$i}}">{{if $a.Filename}}{{$a.Filename}}{{else}}attachment-{{$i}}{{end}}</a> ({{$a.ContentType}}, {{len $a.Data}} bytes)<br>
+{{end}}</td></tr>{{end}}
+</table>
+{{if .Mail.ParseError}}<p class="error">The mail could not be read: {{.Mail.ParseError}}</p>{{end}}
+<nav>
+{{$view := .View}}{{$id := .Mail.ID}}{{range $v := .Views}}
+<a href="/catcher/{{$id}}?view={{$v}}"{{if eq $v $view}} class="current"{{end}}>{{$v}}</a>
+{{end}}
+<a href="/transport/messages/{{.Mail.ID}}.eml">download</a>
+</nav>
+{{if eq .View "html"}}{{if .Mail.HTML}}<iframe sandbox src="/catcher/{{.Mail.ID}}/html"></iframe>{{else}}<p class="empty">The mail has no HTML body.</p>{{end}}
+{{else if eq .View "text"}}{{if .Mail.Text}}<pre>{{.Mail.Text}}</pre>{{else}}<p class="empty">The mail has no text body.</p>{{end}}
+{{else if eq .View "headers"}}<table>
+{{range .Mail.Headers}}<tr><th>{{.Name}}</th><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{else}}<pre>{{.Source}}</pre>
+{{end}}
+{{template "footer"}}{{end}}
+`))
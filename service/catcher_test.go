@@ -0,0 +1,79 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceCatcher(t *testing.T) {
+	assert := assert.New(t)
+	serv, err := NewMailSenderService(`{"mailsetup":{"defaultmail":"dev@localhost"},"servicesetup":{"port":8080,"catcher":true}}`)
+	assert.Nil(err, "The catcher should not need a mail server")
+	assert.Equal(TransportMemory, serv.Mail.Transport.Type)
+
+	body := `{"To":[{"Address":"user@server.com"}],"Subject":"Relevé <mensuel>","Body":"See the statement",` +
+		`"HTMLBody":"<p>Statement</p><img src=\"cid:logo\">",` +
+		`"Inline":[{"Filename":"logo.png","ContentType":"image/png","Data":"UE5H","ContentID":"logo"}],` +
+		`"Attachments":[{"Filename":"relevé.csv","ContentType":"text/csv","Data":"ZGF0ZSxhbW91bnQK"}]}`
+	w := httptest.NewRecorder()
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	id := serv.memory.Messages(mailsender.MailQuery{})[0].ID
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serv.Catcher(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	w = get("/catcher/?recipient=user")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `<a href="/catcher/`+id+`">Relevé &lt;mensuel&gt;</a>`)
+	assert.Contains(get("/catcher/?recipient=nobody").Body.String(), "No mails were captured.")
+
+	w = get("/catcher/" + id)
+	assert.Equal(http.StatusOK, w.Code)
+	page := w.Body.String()
+	assert.Contains(page, `<iframe sandbox src="/catcher/`+id+`/html">`, "The HTML body is shown first")
+	assert.Contains(page, `<a href="/catcher/`+id+`/attachments/1">relevé.csv</a>`)
+	assert.Contains(get("/catcher/"+id+"?view=text").Body.String(), "<pre>See the statement</pre>")
+	assert.Contains(get("/catcher/"+id+"?view=headers").Body.String(), "<tr><th>Subject</th><td>Relevé &lt;mensuel&gt;</td></tr>")
+	assert.Contains(get("/catcher/"+id+"?view=source").Body.String(), "Content-Transfer-Encoding: base64")
+	assert.Equal(http.StatusBadRequest, get("/catcher/"+id+"?view=pdf").Code)
+
+	w = get("/catcher/" + id + "/html")
+	assert.Equal("sandbox", w.Header().Get("Content-Security-Policy"))
+	assert.Equal(`<p>Statement</p><img src="/catcher/`+id+`/attachments/0">`, w.Body.String())
+
+	w = get("/catcher/" + id + "/attachments/1")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("text/csv", w.Header().Get("Content-Type"))
+	assert.True(strings.HasPrefix(w.Header().Get("Content-Disposition"), "attachment; filename*=utf-8''relev"))
+	assert.Equal("date,amount\n", w.Body.String())
+	assert.Equal(http.StatusNotFound, get("/catcher/"+id+"/attachments/2").Code)
+	assert.Equal(http.StatusNotFound, get("/catcher/42").Code)
+
+	w = httptest.NewRecorder()
+	serv.Catcher(w, httptest.NewRequest(http.MethodGet, "/catcher/clear", nil))
+	assert.Equal(http.StatusMethodNotAllowed, w.Code)
+	w = httptest.NewRecorder()
+	serv.Catcher(w, httptest.NewRequest(http.MethodPost, "/catcher/clear", nil))
+	assert.Equal(http.StatusSeeOther, w.Code)
+	assert.Equal(0, len(serv.memory.Messages(mailsender.MailQuery{})))
+}
+
+func TestServiceCatcherSetup(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewMailSenderService(`{"mailsetup":{"defaultmail":"dev@localhost","transport":{"type":"log"}},"servicesetup":{"port":8080,"catcher":true}}`)
+	assert.NotNil(err, "The catcher needs the memory transport")
+
+	serv, err := NewMailSenderService(`{"mailsetup":{"defaultmail":"dev@localhost","transport":{"type":"memory","limit":5}},"servicesetup":{"port":8080,"catcher":true}}`)
+	assert.Nil(err)
+	assert.Equal(5, serv.memory.Limit)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//DKIMSetup is the DKIM key signing the mails sent from a domain
+type DKIMSetup struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+	//KeyFile is the PEM file of the RSA or Ed25519 private key
+	KeyFile string `json:"keyfile"`
+	//Headers lists the signed header fields, mailsender.DefaultDKIMHeaders
+	//when it is empty
+	Headers []string `json:"headers"`
+}
+
+//loadDKIM reads the DKIM keys of the setup
+func (mss *MailSenderService) loadDKIM() error {
+	for _, setup := range mss.Mail.DKIM {
+		if setup.Domain == "" || setup.Selector == "" || setup.KeyFile == "" {
+			return fmt.Errorf("Invalid DKIM setup for %s", setup.Domain)
+		}
+		data, err := ioutil.ReadFile(setup.KeyFile)
+		if err != nil {
+			return err
+		}
+		key, err := mailsender.ParseDKIMKey(data)
+		if err != nil {
+			return fmt.Errorf("Invalid DKIM key for %s: %s", setup.Domain, err.Error())
+		}
+		if mss.dkim == nil {
+			mss.dkim = make(map[string]*mailsender.DKIMSigner)
+		}
+		mss.dkim[strings.ToLower(setup.Domain)] = &mailsender.DKIMSigner{
+			Domain:   setup.Domain,
+			Selector: setup.Selector,
+			Key:      key,
+			Headers:  setup.Headers,
+		}
+	}
+	return nil
+}
+
+//dkimSigner returns the signer of the domain of address, nil when the
+//mails of the domain are not signed
+func (mss *MailSenderService) dkimSigner(address string) *mailsender.DKIMSigner {
+	domain := address[strings.LastIndex(address, "@")+1:]
+	return mss.dkim[strings.ToLower(domain)]
+}
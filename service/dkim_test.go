@@ -0,0 +1,56 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestServiceDKIM(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "dkim")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(err)
+	keyFile := filepath.Join(dir, "mail.pem")
+	assert.Nil(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+	config := `{"mailsetup":{"server":"exampleserver.com:25","dkim":[{"domain":"Example.com","selector":"mail","keyfile":%q}]},
+		"servicesetup":{"port":8080}}`
+
+	serv, err := NewMailSenderService(fmt.Sprintf(config, keyFile))
+	assert.Nil(err)
+	assert.NotNil(serv.dkimSigner("src@example.com"))
+	assert.Nil(serv.dkimSigner("src@other.com"))
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@example.com"},
+		To:   []mail.Address{{Address: "dest@server.com"}},
+	}
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMailWithoutAuth", "exampleserver.com:25", mock.Anything).Return(&mailsender.Result{}, nil)
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	sent := mockMailSender.Calls[0].Arguments.Get(1).(mailsender.MailStruct)
+	assert.NotNil(sent.DKIM, "The mail should be signed")
+	assert.Equal("mail", sent.DKIM.Selector)
+
+	assert.Nil(ioutil.WriteFile(keyFile, []byte("not a key"), 0600))
+	_, err = NewMailSenderService(fmt.Sprintf(config, keyFile))
+	assert.NotNil(err, "Expected an error for an invalid key")
+	_, err = NewMailSenderService(fmt.Sprintf(config, filepath.Join(dir, "missing.pem")))
+	assert.NotNil(err, "Expected an error for a missing key")
+}
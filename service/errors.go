@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//ErrorResponse is the JSON body sent back when a request fails.
+//The SMTP fields are only set when the mail server refused the mail.
+type ErrorResponse struct {
+	Error        string           `json:"error"`
+	Stage        mailsender.Stage `json:"stage,omitempty"`
+	Code         int              `json:"code,omitempty"`
+	EnhancedCode string           `json:"enhancedcode,omitempty"`
+	Temporary    bool             `json:"temporary"`
+}
+
+//statusForError chooses the HTTP status matching an error from the mail server:
+//a send running out of time is 504 and a canceled one 503, temporary
+//failures, like greylisting, are 503 so the client retries later, refused
+//credentials are 401, refused senders, recipients or content are 422 and
+//a mail server that can not be used at all is 502
+func statusForError(smtpErr *mailsender.SMTPError) int {
+	switch {
+	case errors.Is(smtpErr, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(smtpErr, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	if smtpErr.Temporary() {
+		return http.StatusServiceUnavailable
+	}
+	switch smtpErr.Stage {
+	case mailsender.StageAuth:
+		return http.StatusUnauthorized
+	case mailsender.StageMail, mailsender.StageRcpt, mailsender.StageData:
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
+//errorResponse builds the ErrorResponse of err. Errors from the mail server
+//get the status given by statusForError, the others the given status.
+func errorResponse(status int, err error) (int, ErrorResponse) {
+	response := ErrorResponse{Error: err.Error()}
+
+	var smtpErr *mailsender.SMTPError
+	if errors.As(err, &smtpErr) {
+		status = statusForError(smtpErr)
+		response.Stage = smtpErr.Stage
+		response.Code = smtpErr.Code
+		response.EnhancedCode = smtpErr.EnhancedCode
+		//the server refused nothing when the send was interrupted
+		response.Temporary = smtpErr.Temporary() || errors.Is(smtpErr, context.Canceled) || errors.Is(smtpErr, context.DeadlineExceeded)
+	}
+	return status, response
+}
+
+//writeError sends err as a JSON ErrorResponse with the status chosen
+//by errorResponse
+func writeError(w http.ResponseWriter, status int, err error) {
+	status, response := errorResponse(status, err)
+	if response.Temporary {
+		w.Header().Set("Retry-After", "60")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
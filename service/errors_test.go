@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteErrorStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{&mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550, EnhancedCode: "5.1.1"}, http.StatusUnprocessableEntity},
+		{&mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, EnhancedCode: "4.7.1"}, http.StatusServiceUnavailable},
+		{&mailsender.SMTPError{Stage: mailsender.StageAuth, Code: 535, EnhancedCode: "5.7.8"}, http.StatusUnauthorized},
+		{&mailsender.SMTPError{Stage: mailsender.StageData, Code: 552}, http.StatusUnprocessableEntity},
+		{&mailsender.SMTPError{Stage: mailsender.StageTLS, Err: errors.New("certificate signed by unknown authority")}, http.StatusBadGateway},
+		{&mailsender.SMTPError{Stage: mailsender.StageDial, Err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{fmt.Errorf("wrapped: %w", &mailsender.SMTPError{Stage: mailsender.StageMail, Code: 553}), http.StatusUnprocessableEntity},
+		{&mailsender.SMTPError{Stage: mailsender.StageRcpt, Message: "context canceled", Err: context.Canceled}, http.StatusServiceUnavailable},
+		{&mailsender.SMTPError{Stage: mailsender.StageData, Message: "context deadline exceeded", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{&mailsender.SMTPError{Stage: mailsender.StageDial, Message: "context deadline exceeded", Err: context.DeadlineExceeded}, http.StatusGatewayTimeout},
+		{errors.New("other"), http.StatusInternalServerError},
+	}
+
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		writeError(recorder, http.StatusInternalServerError, c.err)
+		assert.Equal(c.status, recorder.Code, "Unexpected status for %v", c.err)
+		assert.Equal("application/json", recorder.Header().Get("Content-Type"))
+	}
+}
+
+func TestWriteErrorBody(t *testing.T) {
+	assert := assert.New(t)
+	recorder := httptest.NewRecorder()
+	err := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, EnhancedCode: "4.7.1", Message: "Greylisted"}
+	writeError(recorder, http.StatusInternalServerError, err)
+
+	var response ErrorResponse
+	assert.Nil(json.NewDecoder(recorder.Body).Decode(&response))
+	assert.Equal(ErrorResponse{Error: err.Error(), Stage: mailsender.StageRcpt, Code: 451, EnhancedCode: "4.7.1", Temporary: true}, response)
+	assert.Equal("60", recorder.Header().Get("Retry-After"))
+}
+
+func TestSendMailMessageErrors(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{DefaultMail: "mail@exampleserver.com"}}
+
+	recorder := httptest.NewRecorder()
+	serv.SendMailMessage(recorder, httptest.NewRequest(http.MethodGet, "/sendmail", nil))
+	assert.Equal(http.StatusMethodNotAllowed, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	serv.SendMailMessage(recorder, httptest.NewRequest(http.MethodPost, "/sendmail", nil))
+	assert.Equal(http.StatusBadRequest, recorder.Code)
+
+	var response ErrorResponse
+	assert.Nil(json.NewDecoder(recorder.Body).Decode(&response))
+	assert.NotEmpty(response.Error)
+	assert.Equal(mailsender.Stage(""), response.Stage)
+}
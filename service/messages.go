@@ -0,0 +1,153 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//defaultListLimit is the number of messages listed by /messages when
+//the request gives no limit
+const defaultListLimit = 100
+
+//MessageStatus is the JSON body describing a message. It leaves
+//out the content of the mail and the password of the sender.
+type MessageStatus struct {
+	ID          string     `json:"id"`
+	MessageID   string     `json:"messageid"`
+	Status      string     `json:"status"`
+	From        string     `json:"from"`
+	Recipients  []string   `json:"recipients"`
+	Subject     string     `json:"subject"`
+	Created     time.Time  `json:"created"`
+	Updated     time.Time  `json:"updated"`
+	NextAttempt *time.Time `json:"nextattempt,omitempty"`
+	Attempts    []Attempt  `json:"attempts"`
+	LastError   string     `json:"lasterror,omitempty"`
+	//Failed lists the recipients that will not get the message
+	Failed []RejectedRecipient `json:"failed,omitempty"`
+}
+
+//newMessageStatus describes qm
+func newMessageStatus(qm QueuedMessage) MessageStatus {
+	status := MessageStatus{
+		ID:        qm.ID,
+		MessageID: qm.Mail.MessageID,
+		Status:    qm.Status,
+		From:      qm.Mail.From.Address,
+		Subject:   qm.Mail.Subject,
+		Created:   qm.Created,
+		Updated:   qm.Updated,
+		Attempts:  qm.Attempts,
+		LastError: qm.LastError,
+		Failed:    qm.Failed,
+	}
+	for _, recipient := range qm.Mail.Recipients() {
+		status.Recipients = append(status.Recipients, recipient.Address)
+	}
+	if qm.pending() {
+		next := qm.NextAttempt
+		status.NextAttempt = &next
+	}
+	if status.Attempts == nil {
+		status.Attempts = []Attempt{}
+	}
+	return status
+}
+
+//messageStore holds the messages described by /messages
+type messageStore interface {
+	Get(id string) (QueuedMessage, bool)
+	List(filter MessageFilter) []QueuedMessage
+}
+
+//messages returns the queue or, without it, the tracker of the mails
+//sent at once
+func (mss *MailSenderService) messages() messageStore {
+	if mss.queue != nil {
+		return mss.queue
+	}
+	return mss.tracker()
+}
+
+//writeJSON sends v as the JSON body of the answer
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+//GetMessage is the method that links GET /messages/{id} to the queue, or
+//to the mails sent without it. It answers the MessageStatus of the
+//message.
+func (mss *MailSenderService) GetMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Sorry, only GET allowed!"))
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/messages/")
+	qm, ok := mss.messages().Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No message with the id %s", id))
+		return
+	}
+	writeJSON(w, newMessageStatus(qm))
+}
+
+//ListMessages is the method that links GET /messages to the queue, or to
+//the mails sent without it. The messages can be filtered with the
+//status, recipient, since and until parameters, the times being in RFC
+//3339 format, and limit sets how many of them are listed, the newest
+//first.
+func (mss *MailSenderService) ListMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Sorry, only GET allowed!"))
+		return
+	}
+	filter, err := parseMessageFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	list := []MessageStatus{}
+	for _, qm := range mss.messages().List(filter) {
+		list = append(list, newMessageStatus(qm))
+	}
+	writeJSON(w, list)
+}
+
+//parseMessageFilter reads the filter of a /messages request
+func parseMessageFilter(r *http.Request) (MessageFilter, error) {
+	query := r.URL.Query()
+	filter := MessageFilter{
+		Status:    query.Get("status"),
+		Recipient: query.Get("recipient"),
+		Limit:     defaultListLimit,
+	}
+
+	switch filter.Status {
+	case "", StatusQueued, StatusSending, StatusDeferred, StatusDelivered, StatusFailed:
+	default:
+		return filter, fmt.Errorf("Invalid status %s", filter.Status)
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, fmt.Errorf("Invalid since: %s", err.Error())
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, fmt.Errorf("Invalid until: %s", err.Error())
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 {
+			return filter, fmt.Errorf("Invalid limit %s", limit)
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessagesEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	greylisted := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, EnhancedCode: "4.7.1", Message: "Try again later"}
+	rs := newRecordingSend(greylisted)
+	q := newTestQueue(t, dir, rs.send)
+	q.retryInitial = time.Hour
+	q.retryMax = time.Hour
+	serv := MailSenderService{queue: q}
+
+	ms := queueMail()
+	ms.Password = "secret"
+	deferred, err := q.Enqueue(ms)
+	assert.Nil(err)
+	q.Start()
+	rs.wait(t, 1)
+	q.Stop()
+
+	ms.To = []mail.Address{{Address: "Other@server.com"}}
+	queued, err := q.Enqueue(ms)
+	assert.Nil(err)
+
+	w := httptest.NewRecorder()
+	serv.GetMessage(w, httptest.NewRequest(http.MethodGet, "/messages/"+deferred, nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotContains(w.Body.String(), "secret", "The password should never be shown")
+	var status MessageStatus
+	assert.Nil(json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(StatusDeferred, status.Status)
+	assert.Equal([]string{"dest@server.com"}, status.Recipients)
+	assert.Equal(1, len(status.Attempts))
+	assert.Equal(451, status.Attempts[0].Code)
+	assert.Equal("4.7.1", status.Attempts[0].EnhancedCode)
+	assert.Equal("Try again later", status.Attempts[0].Response)
+	assert.NotNil(status.NextAttempt)
+
+	w = httptest.NewRecorder()
+	serv.GetMessage(w, httptest.NewRequest(http.MethodGet, "/messages/unknown", nil))
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	list := func(query string) []MessageStatus {
+		w := httptest.NewRecorder()
+		serv.ListMessages(w, httptest.NewRequest(http.MethodGet, "/messages"+query, nil))
+		assert.Equal(http.StatusOK, w.Code, query)
+		var list []MessageStatus
+		assert.Nil(json.NewDecoder(w.Body).Decode(&list))
+		return list
+	}
+	all := list("")
+	assert.Equal(2, len(all))
+	assert.Equal(queued, all[0].ID, "The newest message should be first")
+	assert.Equal(1, len(list("?limit=1")))
+	assert.Equal(deferred, list("?status=deferred")[0].ID)
+	assert.Equal(queued, list("?recipient=other@server.com")[0].ID)
+	assert.Equal(0, len(list("?status=failed")))
+	since := time.Now().Add(time.Minute).Format(time.RFC3339)
+	assert.Equal(0, len(list("?since="+since)))
+	until := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	assert.Equal(0, len(list("?until="+until)))
+
+	w = httptest.NewRecorder()
+	serv.ListMessages(w, httptest.NewRequest(http.MethodGet, "/messages?status=lost", nil))
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestMessagesSentWithoutQueue(t *testing.T) {
+	assert := assert.New(t)
+	serv, err := NewMailSenderService(`{"mailsetup":{"defaultmail":"dev@localhost","transport":{"type":"memory"}},"servicesetup":{"port":8080}}`)
+	assert.Nil(err)
+
+	send := func(serv *MailSenderService, body string) (int, string) {
+		w := httptest.NewRecorder()
+		serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+		return w.Code, strings.TrimPrefix(w.Header().Get("Location"), "/messages/")
+	}
+	code, delivered := send(serv, `{"To":[{"Address":"dest@server.com"}],"Subject":"sent","Password":"secret"}`)
+	assert.Equal(http.StatusOK, code)
+
+	w := httptest.NewRecorder()
+	serv.GetMessage(w, httptest.NewRequest(http.MethodGet, "/messages/"+delivered, nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.NotContains(w.Body.String(), "secret", "The password should never be shown")
+	var status MessageStatus
+	assert.Nil(json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(StatusDelivered, status.Status)
+	assert.Equal("sent", status.Subject)
+	assert.Equal([]string{"dest@server.com"}, status.Recipients)
+	assert.Equal(1, len(status.Attempts))
+	assert.Nil(status.NextAttempt)
+
+	//nothing listens on the port, so the mail fails
+	unreachable := &MailSenderService{Mail: MailSetup{Server: "127.0.0.1:1", DefaultMail: "mail@exampleserver.com"}}
+	code, failed := send(unreachable, `{"To":[{"Address":"other@server.com"}]}`)
+	assert.Equal(http.StatusServiceUnavailable, code)
+
+	w = httptest.NewRecorder()
+	unreachable.ListMessages(w, httptest.NewRequest(http.MethodGet, "/messages?status=failed", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	var list []MessageStatus
+	assert.Nil(json.NewDecoder(w.Body).Decode(&list))
+	if assert.Equal(1, len(list)) {
+		assert.Equal(failed, list[0].ID)
+		assert.Equal([]string{"other@server.com"}, list[0].Recipients)
+		assert.NotEqual("", list[0].LastError)
+	}
+}
+
+func TestQueuePrune(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	rs := newRecordingSend()
+	q := newTestQueue(t, dir, rs.send)
+	id, err := q.Enqueue(queueMail())
+	assert.Nil(err)
+	q.Start()
+	rs.wait(t, 1)
+	q.Stop()
+
+	qm, ok := q.Get(id)
+	assert.True(ok)
+	assert.Equal(StatusDelivered, qm.Status)
+
+	q.retention = time.Nanosecond
+	q.prune()
+	_, ok = q.Get(id)
+	assert.False(ok, "The delivered message should be removed after the retention time")
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//tokenExpiryMargin is how long before its expiry an access token is refreshed
+const tokenExpiryMargin = time.Minute
+
+//OAuth2Account represents a sending account that authenticates with
+//OAuth2 access tokens instead of a password
+type OAuth2Account struct {
+	Mail         string `json:"mail"`
+	ClientID     string `json:"clientid"`
+	ClientSecret string `json:"clientsecret"`
+	RefreshToken string `json:"refreshtoken"`
+	TokenURL     string `json:"tokenurl"`
+	//Mechanism is XOAUTH2, the default, or OAUTHBEARER
+	Mechanism string `json:"mechanism"`
+}
+
+//TokenSource obtains the access tokens of an account from its token
+//endpoint and caches them until they are about to expire
+type TokenSource struct {
+	account OAuth2Account
+	client  *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+//NewTokenSource creates a TokenSource for the account
+func NewTokenSource(account OAuth2Account) *TokenSource {
+	return &TokenSource{
+		account: account,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+//Token returns the cached access token, refreshing it when it is
+//missing or about to expire
+func (ts *TokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Add(tokenExpiryMargin).Before(ts.expiry) {
+		return ts.token, nil
+	}
+	return ts.refresh()
+}
+
+//Refresh obtains a new access token even if the cached one is still valid
+func (ts *TokenSource) Refresh() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.refresh()
+}
+
+//tokenResponse is the answer of the token endpoint, as in RFC 6749
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (ts *TokenSource) refresh() (string, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {ts.account.ClientID},
+		"client_secret": {ts.account.ClientSecret},
+		"refresh_token": {ts.account.RefreshToken},
+	}
+	resp, err := ts.client.PostForm(ts.account.TokenURL, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tr tokenResponse
+	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("Invalid answer from the token endpoint: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return "", fmt.Errorf("Could not refresh the token of %s: %s %s", ts.account.Mail, tr.Error, tr.ErrorDescription)
+	}
+
+	ts.token = tr.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	//some providers rotate the refresh token
+	if tr.RefreshToken != "" {
+		ts.account.RefreshToken = tr.RefreshToken
+	}
+	return ts.token, nil
+}
+
+//oauth2Account returns the OAuth2 account configured for address
+func (ms MailSetup) oauth2Account(address string) (OAuth2Account, bool) {
+	for _, account := range ms.Accounts {
+		if strings.EqualFold(account.Mail, address) {
+			return account, true
+		}
+	}
+	return OAuth2Account{}, false
+}
+
+//tokenSource returns the TokenSource of an OAuth2 account, creating it
+//on first use so that the tokens are cached between mails
+func (mss *MailSenderService) tokenSource(account OAuth2Account) *TokenSource {
+	mss.tokenSourcesMu.Lock()
+	defer mss.tokenSourcesMu.Unlock()
+	if mss.tokenSources == nil {
+		mss.tokenSources = make(map[string]*TokenSource)
+	}
+	key := strings.ToLower(account.Mail)
+	if _, ok := mss.tokenSources[key]; !ok {
+		mss.tokenSources[key] = NewTokenSource(account)
+	}
+	return mss.tokenSources[key]
+}
+
+//isAuthError tells if err is the server refusing the credentials, which
+//for a token means it was revoked or expired earlier than announced
+func isAuthError(err error) bool {
+	var smtpErr *mailsender.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Stage == mailsender.StageAuth && (smtpErr.Code == 535 || smtpErr.Code == 334)
+	}
+	return false
+}
+
+//authMechanism returns the mechanism used for mails coming from address:
+//the one of its OAuth2 account if it has one, else the one of the setup
+func (mss *MailSenderService) authMechanism(address string) string {
+	if account, ok := mss.Mail.oauth2Account(address); ok && mss.Mail.UseAUTH {
+		if account.Mechanism != "" {
+			return account.Mechanism
+		}
+		return mailsender.AuthXOAuth2
+	}
+	return mss.Mail.AuthMechanism
+}
+
+//newMailSender creates the sender used for mails coming from address
+func (mss *MailSenderService) newMailSender(address string) mailsender.MailSender {
+	return &mailsender.Impl{AuthMechanism: mss.authMechanism(address), Timeouts: mss.Mail.Timeouts.durations()}
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"sync/atomic"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+//newTokenEndpoint starts a stub token endpoint handing out numbered
+//tokens valid for expiresIn seconds
+func newTokenEndpoint(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" ||
+			r.FormValue("client_id") != "id" || r.FormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		n := atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, `{"access_token":"token%d","expires_in":%d,"token_type":"Bearer"}`, n, expiresIn)
+	}))
+	return server, &calls
+}
+
+func TestTokenSourceCachesToken(t *testing.T) {
+	assert := assert.New(t)
+	server, calls := newTokenEndpoint(t, 3600)
+	defer server.Close()
+
+	ts := NewTokenSource(OAuth2Account{Mail: "src@server.com", ClientID: "id", ClientSecret: "secret",
+		RefreshToken: "refresh", TokenURL: server.URL})
+
+	token, err := ts.Token()
+	assert.Nil(err)
+	assert.Equal("token1", token)
+	token, err = ts.Token()
+	assert.Nil(err)
+	assert.Equal("token1", token, "The cached token should be used")
+
+	token, err = ts.Refresh()
+	assert.Nil(err)
+	assert.Equal("token2", token)
+	assert.Equal(int32(2), atomic.LoadInt32(calls))
+}
+
+func TestTokenSourceRefreshesBeforeExpiry(t *testing.T) {
+	assert := assert.New(t)
+	//tokens expiring within tokenExpiryMargin are never reused
+	server, _ := newTokenEndpoint(t, 30)
+	defer server.Close()
+
+	ts := NewTokenSource(OAuth2Account{ClientID: "id", ClientSecret: "secret", RefreshToken: "refresh", TokenURL: server.URL})
+	first, err := ts.Token()
+	assert.Nil(err)
+	second, err := ts.Token()
+	assert.Nil(err)
+	assert.NotEqual(first, second)
+
+	ts = NewTokenSource(OAuth2Account{ClientID: "id", ClientSecret: "secret", RefreshToken: "revoked", TokenURL: server.URL})
+	_, err = ts.Token()
+	assert.NotNil(err, "Error expected for a refused refresh token")
+}
+
+func TestServiceSendMailRefreshesRefusedToken(t *testing.T) {
+	assert := assert.New(t)
+	server, _ := newTokenEndpoint(t, 3600)
+	defer server.Close()
+
+	serv := MailSenderService{
+		Setup: Setup{Port: 8080},
+		Mail: MailSetup{
+			Server:  "smtp.gmail.com:587",
+			UseAUTH: true,
+			TLSMode: mailsender.TLSNone,
+			Accounts: []OAuth2Account{{Mail: "src@gmail.com", ClientID: "id", ClientSecret: "secret",
+				RefreshToken: "refresh", TokenURL: server.URL}},
+		},
+	}
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@gmail.com"},
+		To:   []mail.Address{{Address: "dest@server.com"}},
+	}
+	_, err := serv.ValidateMailStruct(&ms)
+	assert.Nil(err, "No password is needed for an OAuth2 account, got %v\n", err)
+
+	withToken := func(token string) mailsender.MailStruct {
+		m := ms
+		m.Password = token
+		return m
+	}
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMail", "smtp.gmail.com:587", "src@gmail.com", "token1", withToken("token1")).
+		Return((*mailsender.Result)(nil), &mailsender.SMTPError{Stage: mailsender.StageAuth, Code: 535, EnhancedCode: "5.7.8", Message: "Username and Password not accepted"}).Once()
+	mockMailSender.On("SendMail", "smtp.gmail.com:587", "src@gmail.com", "token2", withToken("token2")).
+		Return(&mailsender.Result{}, nil).Once()
+
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	mockMailSender.AssertExpectations(t)
+
+	impl, ok := serv.newMailSender("SRC@gmail.com").(*mailsender.Impl)
+	assert.True(ok)
+	assert.Equal(mailsender.AuthXOAuth2, impl.AuthMechanism)
+}
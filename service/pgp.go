@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"strings"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//PGPSetup is the OpenPGP/MIME (RFC 3156) signing and encryption of the
+//mails
+type PGPSetup struct {
+	//SigningKey is the file of the secret key, as exported by
+	//gpg --export-secret-keys, signing all the mails
+	SigningKey string `json:"signingkey"`
+	//Passphrase unlocks the signing key when it is protected
+	Passphrase string `json:"passphrase"`
+	//Keyring is the directory of the public keys of the recipients, one
+	//or more keys per file. A mail is encrypted when all its recipients
+	//have a key.
+	Keyring string `json:"keyring"`
+	//RequireEncryption refuses the mails having recipients without a key
+	//instead of sending them unencrypted
+	RequireEncryption bool `json:"requireencryption"`
+}
+
+//loadPGP reads the signing key and the keyring of the setup
+func (mss *MailSenderService) loadPGP() error {
+	setup := mss.Mail.PGP
+	if setup.RequireEncryption && setup.Keyring == "" {
+		return fmt.Errorf("OpenPGP encryption can not be required without a keyring")
+	}
+	//the mails signed with S/MIME are not encrypted with OpenPGP
+	if setup.RequireEncryption && len(mss.smime) > 0 {
+		return fmt.Errorf("OpenPGP encryption can not be required along with S/MIME signing")
+	}
+	if setup.SigningKey != "" {
+		keys, err := readPGPFile(setup.SigningKey)
+		if err != nil {
+			return err
+		}
+		if err = keys[0].Unlock(setup.Passphrase); err != nil {
+			return fmt.Errorf("Invalid OpenPGP signing key %s: %s", setup.SigningKey, err.Error())
+		}
+		mss.pgpSigner = keys[0]
+	}
+	if setup.Keyring == "" {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(setup.Keyring)
+	if err != nil {
+		return fmt.Errorf("Invalid OpenPGP keyring: %s", err.Error())
+	}
+	mss.pgpKeys = make(map[string]*mailsender.PGPKey)
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		keys, err := readPGPFile(filepath.Join(setup.Keyring, file.Name()))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			for _, email := range key.Emails() {
+				mss.pgpKeys[email] = key
+			}
+		}
+	}
+	return nil
+}
+
+//readPGPFile reads the OpenPGP keys of the file at path
+func readPGPFile(path string) ([]*mailsender.PGPKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := mailsender.ReadPGPKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid OpenPGP key %s: %s", path, err.Error())
+	}
+	return keys, nil
+}
+
+//pgpCopies returns the mails to send for ms, signed with the OpenPGP key
+//of the setup and encrypted when all their recipients have a key, an
+//error when one has none and RequireEncryption is set. The keys of an
+//encrypted message are seen by all its readers, so the Bcc recipients
+//each get a copy encrypted for them alone while the others share one.
+func (mss *MailSenderService) pgpCopies(ms mailsender.MailStruct) ([]mailsender.MailStruct, error) {
+	ms.PGP = mss.pgpSigner
+	if mss.pgpKeys == nil {
+		return []mailsender.MailStruct{ms}, nil
+	}
+	recipients := ms.Envelope
+	if recipients == nil {
+		recipients = ms.Recipients()
+	}
+	for _, recipient := range recipients {
+		if _, ok := mss.pgpKeys[strings.ToLower(recipient.Address)]; !ok {
+			if mss.Mail.PGP.RequireEncryption {
+				return nil, fmt.Errorf("No OpenPGP key for %s", recipient.Address)
+			}
+			return []mailsender.MailStruct{ms}, nil
+		}
+	}
+
+	visible := make(map[string]bool)
+	for _, recipient := range append(append([]mail.Address(nil), ms.To...), ms.Cc...) {
+		visible[strings.ToLower(recipient.Address)] = true
+	}
+	shared := ms
+	shared.Envelope = nil
+	var copies []mailsender.MailStruct
+	for _, recipient := range recipients {
+		key := mss.pgpKeys[strings.ToLower(recipient.Address)]
+		if visible[strings.ToLower(recipient.Address)] {
+			shared.Envelope = append(shared.Envelope, recipient)
+			shared.PGPRecipients = append(shared.PGPRecipients, key)
+			continue
+		}
+		hidden := ms
+		hidden.Envelope = []mail.Address{recipient}
+		hidden.PGPRecipients = []*mailsender.PGPKey{key}
+		copies = append(copies, hidden)
+	}
+	if len(shared.Envelope) > 0 {
+		copies = append([]mailsender.MailStruct{shared}, copies...)
+	}
+	return copies, nil
+}
@@ -0,0 +1,725 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//The statuses of a queued message
+const (
+	//StatusQueued is a message waiting for its first attempt
+	StatusQueued = "queued"
+	//StatusSending is a message being delivered
+	StatusSending = "sending"
+	//StatusDeferred is a message waiting to be retried
+	StatusDeferred = "deferred"
+	//StatusDelivered is a message taken by the mail server, for all its
+	//recipients but the ones listed in Failed
+	StatusDelivered = "delivered"
+	//StatusFailed is a message that will not be delivered, as it was
+	//refused or is older than the maximum age. It is dead-lettered.
+	StatusFailed = "failed"
+)
+
+//The defaults of the queue setup
+const (
+	defaultQueueWorkers = 4
+	defaultMaxAge       = 5 * 24 * time.Hour
+	defaultRetryInitial = time.Minute
+	defaultRetryMax     = time.Hour
+	defaultRetention    = 7 * 24 * time.Hour
+	defaultAttemptTime  = 10 * time.Minute
+	//queueIdleWait is the longest a worker waits before looking at the
+	//queue again when it has nothing to do
+	queueIdleWait = time.Minute
+)
+
+//QueueSetup configures the outbound queue. The queue is used when Dir
+//is set. The durations are in seconds.
+type QueueSetup struct {
+	Dir     string `json:"dir"`
+	Workers int    `json:"workers"`
+	//MaxAge is how long a message is retried before being dead-lettered
+	MaxAge int `json:"maxage"`
+	//RetryInitial is the delay before the first retry. It doubles for
+	//each of the following ones up to RetryMax.
+	RetryInitial int `json:"retryinitial"`
+	RetryMax     int `json:"retrymax"`
+	//Retention is how long the delivered and failed messages are kept
+	//for the status requests
+	Retention int `json:"retention"`
+	//AttemptTimeout is how long an attempt may take before it is
+	//abandoned and retried later
+	AttemptTimeout int `json:"attempttimeout"`
+}
+
+//validate checks the values of the setup
+func (qs QueueSetup) validate() error {
+	if qs.Workers < 0 || qs.MaxAge < 0 || qs.RetryInitial < 0 || qs.RetryMax < 0 || qs.Retention < 0 || qs.AttemptTimeout < 0 {
+		return fmt.Errorf("Invalid queue setup")
+	}
+	return nil
+}
+
+//Attempt is one try to deliver a queued message with the answer of
+//the mail server
+type Attempt struct {
+	Time         time.Time           `json:"time"`
+	Stage        mailsender.Stage    `json:"stage,omitempty"`
+	Code         int                 `json:"code,omitempty"`
+	EnhancedCode string              `json:"enhancedcode,omitempty"`
+	Response     string              `json:"response,omitempty"`
+	Accepted     []string            `json:"accepted,omitempty"`
+	Rejected     []RejectedRecipient `json:"rejected,omitempty"`
+}
+
+//newAttempt records the outcome of sending a message
+func newAttempt(start time.Time, result *mailsender.Result, err error) Attempt {
+	attempt := Attempt{Time: start}
+	if result != nil {
+		item := newBatchItemResponse("", result, 0, nil)
+		attempt.Accepted = item.Accepted
+		attempt.Rejected = item.Rejected
+	}
+	if err != nil {
+		attempt.Response = err.Error()
+		var smtpErr *mailsender.SMTPError
+		if errors.As(err, &smtpErr) {
+			attempt.Stage = smtpErr.Stage
+			attempt.Code = smtpErr.Code
+			attempt.EnhancedCode = smtpErr.EnhancedCode
+			attempt.Response = smtpErr.Message
+		}
+	}
+	return attempt
+}
+
+//QueuedMessage is a mail accepted by the queue, as stored on disk
+type QueuedMessage struct {
+	ID          string                `json:"id"`
+	Mail        mailsender.MailStruct `json:"mail"`
+	Status      string                `json:"status"`
+	Attempts    []Attempt             `json:"attempts"`
+	Created     time.Time             `json:"created"`
+	Updated     time.Time             `json:"updated"`
+	NextAttempt time.Time             `json:"nextattempt"`
+	LastError   string                `json:"lasterror,omitempty"`
+	//Failed lists the recipients that will not get the message: refused
+	//for good, or still refused for now at the maximum age
+	Failed []RejectedRecipient `json:"failed,omitempty"`
+	//Callback is the URL receiving the events of the message
+	Callback string `json:"callback,omitempty"`
+}
+
+//accepted tells if a recipient took the message in one of its attempts
+func (qm *QueuedMessage) accepted() bool {
+	for _, attempt := range qm.Attempts {
+		if len(attempt.Accepted) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//pending tells if the message is still to be delivered
+func (qm *QueuedMessage) pending() bool {
+	return qm.Status == StatusQueued || qm.Status == StatusDeferred
+}
+
+//Queue stores the accepted mails on disk and delivers them with worker
+//goroutines. A mail failing with a temporary error is retried with an
+//exponential backoff until it is older than the maximum age, only for
+//the recipients that refused it for now when the others took it. Mails
+//that can not be delivered are moved to the dead letter directory and
+//the delivered ones to the delivered directory, where they are kept for
+//the retention time.
+type Queue struct {
+	dir          string
+	deadDir      string
+	deliveredDir string
+	send         mailsender.SendFunc
+	workers      int
+	maxAge       time.Duration
+	retryInitial time.Duration
+	retryMax     time.Duration
+	retention    time.Duration
+	attemptTime  time.Duration
+
+	//notify is called with the events of the messages
+	notify func(event string, qm QueuedMessage)
+
+	mu       sync.Mutex
+	messages map[string]*QueuedMessage
+	wake     chan struct{}
+	stop     chan struct{}
+	//cancel abandons the deliveries in progress when the queue stops
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+//NewQueue creates the queue stored in the directory of setup, reloading
+//the mails left there. The mails are delivered with send once the queue
+//is started.
+func NewQueue(setup QueueSetup, send mailsender.SendFunc) (*Queue, error) {
+	if err := setup.validate(); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:          filepath.Join(setup.Dir, "queue"),
+		deadDir:      filepath.Join(setup.Dir, "dead"),
+		deliveredDir: filepath.Join(setup.Dir, "delivered"),
+		send:         send,
+		workers:      setup.Workers,
+		maxAge:       time.Duration(setup.MaxAge) * time.Second,
+		retryInitial: time.Duration(setup.RetryInitial) * time.Second,
+		retryMax:     time.Duration(setup.RetryMax) * time.Second,
+		retention:    time.Duration(setup.Retention) * time.Second,
+		attemptTime:  time.Duration(setup.AttemptTimeout) * time.Second,
+		messages:     make(map[string]*QueuedMessage),
+		wake:         make(chan struct{}, 1),
+	}
+	if q.workers == 0 {
+		q.workers = defaultQueueWorkers
+	}
+	if q.maxAge == 0 {
+		q.maxAge = defaultMaxAge
+	}
+	if q.retryInitial == 0 {
+		q.retryInitial = defaultRetryInitial
+	}
+	if q.retryMax == 0 {
+		q.retryMax = defaultRetryMax
+	}
+	if q.retention == 0 {
+		q.retention = defaultRetention
+	}
+	if q.attemptTime == 0 {
+		q.attemptTime = defaultAttemptTime
+	}
+
+	for _, dir := range []string{q.dir, q.deadDir, q.deliveredDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+//load reads the messages stored in the directories of the queue
+func (q *Queue) load() error {
+	for _, dir := range []string{q.dir, q.deadDir, q.deliveredDir} {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			qm, err := readMessage(filepath.Join(dir, file.Name()))
+			if err != nil {
+				log.Printf("Skipping queued message %s: %v", file.Name(), err)
+				continue
+			}
+			//the delivery was interrupted by the restart
+			if qm.Status == StatusSending {
+				qm.Status = StatusDeferred
+			}
+			q.messages[qm.ID] = qm
+		}
+	}
+	if n := q.Len(); n > 0 {
+		log.Printf("%d queued messages reloaded", n)
+	}
+	return nil
+}
+
+//dirFor returns the directory of the messages with status
+func (q *Queue) dirFor(status string) string {
+	switch status {
+	case StatusDelivered:
+		return q.deliveredDir
+	case StatusFailed:
+		return q.deadDir
+	}
+	return q.dir
+}
+
+//readMessage reads a message stored by writeMessage
+func readMessage(path string) (*QueuedMessage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var qm QueuedMessage
+	if err = json.Unmarshal(data, &qm); err != nil {
+		return nil, err
+	}
+	return &qm, nil
+}
+
+//writeMessage stores the message in dir. The file is written aside and
+//renamed, so a crash never leaves a partial message behind. It is only
+//readable by its owner as it may hold the password of the sender.
+func writeMessage(dir string, qm *QueuedMessage) error {
+	data, err := json.Marshal(qm)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, qm.ID+".json")
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//newQueueID generates the random ID of a queued message
+func newQueueID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+//Enqueue stores the mail and returns its ID. The mail is delivered by
+//the workers once it is safely on disk.
+func (q *Queue) Enqueue(ms mailsender.MailStruct) (string, error) {
+	return q.EnqueueWithCallback(ms, "")
+}
+
+//EnqueueWithCallback is Enqueue keeping the URL receiving the events of
+//the mail
+func (q *Queue) EnqueueWithCallback(ms mailsender.MailStruct, callback string) (string, error) {
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	//the retries must not change the date of the mail
+	if ms.Date.IsZero() {
+		ms.Date = now
+	}
+	qm := &QueuedMessage{ID: id, Mail: ms, Status: StatusQueued, Created: now, Updated: now, NextAttempt: now, Callback: callback}
+	if err = writeMessage(q.dir, qm); err != nil {
+		return "", err
+	}
+
+	q.mu.Lock()
+	q.messages[id] = qm
+	snapshot := *qm
+	q.mu.Unlock()
+	q.signal()
+	q.emit(EventAccepted, snapshot)
+	return id, nil
+}
+
+//signal wakes up a waiting worker
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Start starts the workers
+func (q *Queue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stop != nil {
+		return
+	}
+	q.stop = make(chan struct{})
+	var ctx context.Context
+	ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.worker(ctx, q.stop)
+	}
+	q.wg.Add(1)
+	go q.janitor(q.stop)
+}
+
+//Stop stops the workers, abandoning the deliveries in progress, which
+//are retried like the mails left when the queue is started again
+func (q *Queue) Stop() {
+	q.mu.Lock()
+	stop, cancel := q.stop, q.cancel
+	q.stop, q.cancel = nil, nil
+	q.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		cancel()
+		q.wg.Wait()
+	}
+}
+
+//worker delivers the messages due until stop is closed. ctx is canceled
+//along with stop to abandon the delivery in progress.
+func (q *Queue) worker(ctx context.Context, stop chan struct{}) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		qm, wait := q.claim()
+		if qm == nil {
+			timer := time.NewTimer(wait)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		q.deliver(ctx, qm)
+	}
+}
+
+//janitor removes the finished messages older than the retention time
+func (q *Queue) janitor(stop chan struct{}) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		q.prune()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//prune removes the finished messages older than the retention time
+func (q *Queue) prune() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, qm := range q.messages {
+		if !qm.pending() && qm.Status != StatusSending && time.Since(qm.Updated) > q.retention {
+			delete(q.messages, id)
+			os.Remove(filepath.Join(q.dirFor(qm.Status), id+".json"))
+		}
+	}
+}
+
+//claim returns the message due the earliest, marked as sending, or how
+//long to wait for the next one when none is due
+func (q *Queue) claim() (*QueuedMessage, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	var next *QueuedMessage
+	for _, qm := range q.messages {
+		if qm.pending() && (next == nil || qm.NextAttempt.Before(next.NextAttempt)) {
+			next = qm
+		}
+	}
+	if next == nil {
+		return nil, queueIdleWait
+	}
+	if wait := next.NextAttempt.Sub(now); wait > 0 {
+		if wait > queueIdleWait {
+			wait = queueIdleWait
+		}
+		return nil, wait
+	}
+	next.Status = StatusSending
+	next.Updated = now
+	//another worker may take the next message
+	q.signal()
+	return next, 0
+}
+
+//deliver sends a claimed message and records the outcome. The attempt is
+//abandoned when ctx is done or after the attempt timeout.
+func (q *Queue) deliver(ctx context.Context, qm *QueuedMessage) {
+	start := time.Now()
+	var result *mailsender.Result
+	//an invalid mail fails the same way on every attempt
+	err := qm.Mail.ValidateHeaders()
+	invalid := err != nil
+	if !invalid {
+		attemptCtx, cancel := context.WithTimeout(ctx, q.attemptTime)
+		result, err = q.send(attemptCtx, qm.Mail)
+		cancel()
+	}
+	if err != nil && ctx.Err() != nil {
+		q.abandon(qm, start, err)
+		return
+	}
+
+	q.mu.Lock()
+	qm.Attempts = append(qm.Attempts, newAttempt(start, result, err))
+	qm.Updated = time.Now()
+	retry, failed := splitRejected(result)
+	qm.Failed = append(qm.Failed, failed...)
+	canRetry := time.Since(qm.Created) < q.maxAge
+
+	var event string
+	switch {
+	case err == nil && len(retry) == 0:
+		qm.Status = StatusDelivered
+		qm.LastError = ""
+		event = EventDelivered
+	case canRetry && !invalid && (len(retry) > 0 || isTemporary(err)):
+		qm.Status = StatusDeferred
+		qm.LastError = retryError(err, retry)
+		if len(retry) > 0 {
+			//the recipients that took the message do not get it again
+			qm.Mail.Envelope = nil
+			for _, rejected := range retry {
+				qm.Mail.Envelope = append(qm.Mail.Envelope, rejected.Address)
+			}
+		}
+		qm.NextAttempt = time.Now().Add(q.backoff(len(qm.Attempts)))
+		event = EventDeferred
+		log.Printf("Message %s failed, retrying at %s: %s", qm.ID, qm.NextAttempt.Format(time.RFC3339), qm.LastError)
+	case qm.accepted():
+		//some recipients took the message, the ones left never will
+		qm.Failed = append(qm.Failed, leftRecipients(qm.Mail, result, retry, err)...)
+		qm.Status = StatusDelivered
+		qm.LastError = retryError(err, retry)
+		event = EventDelivered
+		log.Printf("Message %s delivered, %d recipients failed", qm.ID, len(qm.Failed))
+	default:
+		qm.Status = StatusFailed
+		qm.LastError = err.Error()
+		event = outcomeEvent(err)
+		log.Printf("Message %s dead-lettered: %s", qm.ID, qm.LastError)
+	}
+
+	dir := q.dirFor(qm.Status)
+	if err = writeMessage(dir, qm); err != nil {
+		log.Printf("Could not store message %s: %v", qm.ID, err)
+	} else if dir != q.dir {
+		os.Remove(filepath.Join(q.dir, qm.ID+".json"))
+	}
+	snapshot := *qm
+	q.mu.Unlock()
+
+	q.emit(event, snapshot)
+}
+
+//abandon puts back a message whose delivery was interrupted by Stop. It
+//is no outcome of the message, so no event is emitted and the message
+//is sent again as soon as the queue starts.
+func (q *Queue) abandon(qm *QueuedMessage, start time.Time, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qm.Attempts = append(qm.Attempts, newAttempt(start, nil, err))
+	qm.Status = StatusDeferred
+	qm.LastError = err.Error()
+	qm.Updated = time.Now()
+	qm.NextAttempt = qm.Updated
+	if err := writeMessage(q.dir, qm); err != nil {
+		log.Printf("Could not store message %s: %v", qm.ID, err)
+	}
+}
+
+//splitRejected splits the recipients refused in result between the ones
+//refusing the message for now, which may take it later, and the ones
+//refusing it for good
+func splitRejected(result *mailsender.Result) (retry []mailsender.RecipientError, failed []RejectedRecipient) {
+	if result == nil {
+		return nil, nil
+	}
+	for _, rejected := range result.Rejected {
+		if isTemporary(rejected.Err) {
+			retry = append(retry, rejected)
+			continue
+		}
+		failed = append(failed, RejectedRecipient{Address: rejected.Address.Address, Error: rejected.Err.Error()})
+	}
+	return retry, failed
+}
+
+//leftRecipients returns the recipients of a partly delivered message
+//that will not get it: the ones refusing it for now or, when the server
+//answered nothing about them, all those it was sent to
+func leftRecipients(ms mailsender.MailStruct, result *mailsender.Result, retry []mailsender.RecipientError, err error) []RejectedRecipient {
+	var left []RejectedRecipient
+	if result == nil {
+		for _, recipient := range ms.Envelope {
+			left = append(left, RejectedRecipient{Address: recipient.Address, Error: err.Error()})
+		}
+		return left
+	}
+	for _, rejected := range retry {
+		left = append(left, RejectedRecipient{Address: rejected.Address.Address, Error: rejected.Err.Error()})
+	}
+	return left
+}
+
+//retryError returns the error of the attempt, or of the first recipient
+//refusing the message for now when the others took it
+func retryError(err error, retry []mailsender.RecipientError) string {
+	if err != nil {
+		return err.Error()
+	}
+	if len(retry) > 0 {
+		return retry[0].Error()
+	}
+	return ""
+}
+
+//emit passes the event of a message to notify, if it is set
+func (q *Queue) emit(event string, qm QueuedMessage) {
+	if q.notify != nil {
+		q.notify(event, qm)
+	}
+}
+
+//isTemporary tells if sending the mail again later may succeed after
+//err: a temporary reply of the mail server, an attempt running out of
+//time, whatever the stage it was in, a network failure or a file, of an
+//attachment or of the transport, that could not be read or written. Any
+//other error, as a missing OpenPGP key, fails the same way every time.
+func isTemporary(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var smtpErr *mailsender.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Temporary()
+	}
+	return false
+}
+
+//backoff returns the delay before the next attempt after attempts failed
+//ones: retryInitial doubled for each attempt, up to retryMax
+func (q *Queue) backoff(attempts int) time.Duration {
+	delay := q.retryInitial
+	for i := 1; i < attempts && delay < q.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > q.retryMax {
+		delay = q.retryMax
+	}
+	return delay
+}
+
+//Len returns the number of messages waiting to be delivered
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, qm := range q.messages {
+		if qm.pending() || qm.Status == StatusSending {
+			n++
+		}
+	}
+	return n
+}
+
+//MessageFilter selects the messages listed by /messages. The zero
+//value of a field does not filter.
+type MessageFilter struct {
+	Status string
+	//Recipient matches the To, Cc and Bcc addresses, ignoring the case
+	Recipient string
+	//Since and Until limit the time the messages were queued
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+//list returns the messages selected by the filter, the newest first
+func (mf MessageFilter) list(messages map[string]*QueuedMessage) []QueuedMessage {
+	var list []QueuedMessage
+	for _, qm := range messages {
+		if mf.matches(qm) {
+			list = append(list, *qm)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	if mf.Limit > 0 && len(list) > mf.Limit {
+		list = list[:mf.Limit]
+	}
+	return list
+}
+
+//matches tells if qm is selected by the filter
+func (mf MessageFilter) matches(qm *QueuedMessage) bool {
+	if mf.Status != "" && qm.Status != mf.Status {
+		return false
+	}
+	if !mf.Since.IsZero() && qm.Created.Before(mf.Since) {
+		return false
+	}
+	if !mf.Until.IsZero() && qm.Created.After(mf.Until) {
+		return false
+	}
+	if mf.Recipient == "" {
+		return true
+	}
+	for _, recipient := range qm.Mail.Recipients() {
+		if strings.EqualFold(recipient.Address, mf.Recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+//Get returns the message with the id
+func (q *Queue) Get(id string) (QueuedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qm, ok := q.messages[id]
+	if !ok {
+		return QueuedMessage{}, false
+	}
+	return *qm, true
+}
+
+//List returns the messages selected by filter, the newest first
+func (q *Queue) List(filter MessageFilter) []QueuedMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return filter.list(q.messages)
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+//recordingSend is a SendFunc failing with the errors given, in order,
+//then succeeding, and recording the mails it sends
+type recordingSend struct {
+	mu     sync.Mutex
+	errs   []error
+	sent   []mailsender.MailStruct
+	called chan struct{}
+}
+
+func newRecordingSend(errs ...error) *recordingSend {
+	return &recordingSend{errs: errs, called: make(chan struct{}, 100)}
+}
+
+func (rs *recordingSend) send(ctx context.Context, ms mailsender.MailStruct) (*mailsender.Result, error) {
+	rs.mu.Lock()
+	defer func() {
+		rs.mu.Unlock()
+		rs.called <- struct{}{}
+	}()
+	if len(rs.errs) > 0 {
+		err := rs.errs[0]
+		rs.errs = rs.errs[1:]
+		return nil, err
+	}
+	rs.sent = append(rs.sent, ms)
+	return &mailsender.Result{MessageID: ms.MessageID}, nil
+}
+
+//wait waits for n calls of the SendFunc
+func (rs *recordingSend) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-rs.called:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The message was not sent")
+		}
+	}
+}
+
+func newTestQueue(t *testing.T, dir string, send mailsender.SendFunc) *Queue {
+	q, err := NewQueue(QueueSetup{Dir: dir, Workers: 2}, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.retryInitial = 10 * time.Millisecond
+	q.retryMax = 20 * time.Millisecond
+	return q
+}
+
+func queueMail() mailsender.MailStruct {
+	return mailsender.MailStruct{
+		From:      mail.Address{Address: "src@server.com"},
+		To:        []mail.Address{{Address: "dest@server.com"}},
+		MessageID: "1@server.com",
+	}
+}
+
+func TestQueueReloadsAndDelivers(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	rs := newRecordingSend()
+	q := newTestQueue(t, dir, rs.send)
+	id, err := q.Enqueue(queueMail())
+	assert.Nil(err)
+	info, err := os.Stat(filepath.Join(dir, "queue", id+".json"))
+	assert.Nil(err, "The message should be stored before being sent")
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+
+	//a new queue on the same directory, as after a restart
+	q = newTestQueue(t, dir, rs.send)
+	assert.Equal(1, q.Len())
+	q.Start()
+	defer q.Stop()
+	rs.wait(t, 1)
+
+	q.Stop()
+	assert.Equal(0, q.Len())
+	_, err = os.Stat(filepath.Join(dir, "queue", id+".json"))
+	assert.True(os.IsNotExist(err), "The delivered message should leave the queue")
+	qm, err := readMessage(filepath.Join(dir, "delivered", id+".json"))
+	assert.Nil(err, "The delivered message should be kept")
+	assert.Equal(StatusDelivered, qm.Status)
+	assert.Equal("1@server.com", rs.sent[0].MessageID)
+	assert.False(rs.sent[0].Date.IsZero(), "The date should be set when the message is queued")
+}
+
+func TestQueueRetriesTemporaryFailures(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	greylisted := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, Message: "Try again later"}
+	//a file that can not be read is retried too
+	missing := &os.PathError{Op: "open", Path: "/var/spool/invoice.pdf", Err: os.ErrNotExist}
+	rs := newRecordingSend(greylisted, missing, greylisted)
+	q := newTestQueue(t, dir, rs.send)
+	q.Start()
+	defer q.Stop()
+
+	_, err = q.Enqueue(queueMail())
+	assert.Nil(err)
+	rs.wait(t, 4)
+	q.Stop()
+	assert.Equal(1, len(rs.sent))
+	assert.Equal(0, q.Len())
+}
+
+func TestQueueRetriesTemporarilyRejectedRecipients(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ms := queueMail()
+	ms.To = []mail.Address{{Address: "a@server.com"}, {Address: "b@server.com"}, {Address: "c@server.com"}}
+	greylisted := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, Message: "Try again later"}
+	unknown := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550, Message: "No such user"}
+
+	var mu sync.Mutex
+	var envelopes [][]mail.Address
+	called := make(chan struct{}, 10)
+	send := func(ctx context.Context, ms mailsender.MailStruct) (*mailsender.Result, error) {
+		mu.Lock()
+		defer func() {
+			mu.Unlock()
+			called <- struct{}{}
+		}()
+		envelopes = append(envelopes, ms.Envelope)
+		if len(envelopes) == 1 {
+			return &mailsender.Result{
+				Accepted: []mail.Address{ms.To[0]},
+				Rejected: []mailsender.RecipientError{{Address: ms.To[1], Err: greylisted}, {Address: ms.To[2], Err: unknown}},
+			}, nil
+		}
+		return &mailsender.Result{Accepted: ms.Envelope}, nil
+	}
+
+	q := newTestQueue(t, dir, send)
+	q.Start()
+	defer q.Stop()
+	id, err := q.Enqueue(ms)
+	assert.Nil(err)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-called:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The message was not sent")
+		}
+	}
+	q.Stop()
+
+	mu.Lock()
+	assert.Equal(2, len(envelopes))
+	assert.Nil(envelopes[0])
+	assert.Equal([]mail.Address{{Address: "b@server.com"}}, envelopes[1], "Only the greylisted recipient should be retried")
+	envelopes = nil
+	mu.Unlock()
+
+	qm, ok := q.Get(id)
+	assert.True(ok)
+	assert.Equal(StatusDelivered, qm.Status)
+	assert.Equal(3, len(qm.Mail.To), "The headers of the message should not change")
+	assert.Equal([]RejectedRecipient{{Address: "c@server.com", Error: unknown.Error()}}, qm.Failed)
+
+	//at the maximum age the greylisted recipient fails too
+	q = newTestQueue(t, dir, send)
+	q.maxAge = time.Nanosecond
+	id, err = q.Enqueue(ms)
+	assert.Nil(err)
+	q.Start()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The message was not sent")
+	}
+	q.Stop()
+
+	qm, _ = q.Get(id)
+	assert.Equal(StatusDelivered, qm.Status)
+	assert.Equal([]RejectedRecipient{{Address: "c@server.com", Error: unknown.Error()}, {Address: "b@server.com", Error: greylisted.Error()}}, qm.Failed)
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	refused := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550, Message: "No such user"}
+	unreachable := &mailsender.SMTPError{Stage: mailsender.StageDial, Message: "connection refused", Err: errors.New("connection refused")}
+	rs := newRecordingSend(refused, unreachable)
+	q := newTestQueue(t, dir, rs.send)
+	q.Start()
+	defer q.Stop()
+
+	permanent, err := q.Enqueue(queueMail())
+	assert.Nil(err)
+	rs.wait(t, 1)
+	//the second message is too old to be retried
+	q.mu.Lock()
+	q.maxAge = time.Nanosecond
+	q.mu.Unlock()
+	expired, err := q.Enqueue(queueMail())
+	assert.Nil(err)
+	rs.wait(t, 1)
+	q.Stop()
+
+	for _, id := range []string{permanent, expired} {
+		qm, err := readMessage(filepath.Join(dir, "dead", id+".json"))
+		assert.Nil(err, "The message should be dead-lettered")
+		assert.Equal(StatusFailed, qm.Status)
+		assert.Equal(1, len(qm.Attempts))
+		assert.NotEqual("", qm.LastError)
+		_, err = os.Stat(filepath.Join(dir, "queue", id+".json"))
+		assert.True(os.IsNotExist(err))
+	}
+	assert.Equal(0, len(rs.sent))
+
+	//an invalid mail is not sent, nor retried
+	q.maxAge = time.Hour
+	ms := queueMail()
+	ms.Subject = "Invoice\r\nBcc: other@server.com"
+	invalid, err := q.Enqueue(ms)
+	assert.Nil(err)
+	qm, _ := q.claim()
+	if assert.NotNil(qm) {
+		q.deliver(context.Background(), qm)
+	}
+	stored, _ := q.Get(invalid)
+	assert.Equal(StatusFailed, stored.Status)
+	assert.Equal(0, len(rs.called), "The invalid mail should not be sent")
+}
+
+func TestIsTemporary(t *testing.T) {
+	assert := assert.New(t)
+	tests := []struct {
+		err       error
+		temporary bool
+	}{
+		{&mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451}, true},
+		{&mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550}, false},
+		{&mailsender.SMTPError{Stage: mailsender.StageData, Err: context.DeadlineExceeded}, true},
+		{&os.PathError{Op: "open", Path: "/var/spool/invoice.pdf", Err: os.ErrPermission}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{mailsender.ErrNoRecipients, false},
+		{errors.New("No OpenPGP key for dest@server.com"), false},
+		{&mailsender.SMTPError{Stage: mailsender.StageData, Err: errors.New("A mail can not use both S/MIME and OpenPGP")}, false},
+	}
+	for _, test := range tests {
+		assert.Equal(test.temporary, isTemporary(test.err), test.err.Error())
+	}
+}
+
+func TestQueueAbandonsAttempts(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	//the mail server never answers, the attempt lasts as long as ctx
+	started := make(chan struct{}, 10)
+	send := func(ctx context.Context, ms mailsender.MailStruct) (*mailsender.Result, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, &mailsender.SMTPError{Stage: mailsender.StageDial, Message: ctx.Err().Error(), Err: ctx.Err()}
+	}
+	q := newTestQueue(t, dir, send)
+	q.attemptTime = 50 * time.Millisecond
+	q.Start()
+	defer q.Stop()
+
+	id, err := q.Enqueue(queueMail())
+	assert.Nil(err)
+	//the first attempt times out and the mail is retried
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The message was not sent")
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Stop should abandon the attempt in progress")
+	}
+
+	qm, _ := q.Get(id)
+	assert.Equal(StatusDeferred, qm.Status, "The abandoned mail should be retried")
+	if assert.True(len(qm.Attempts) >= 2) {
+		assert.Contains(qm.Attempts[0].Response, context.DeadlineExceeded.Error())
+	}
+}
+
+func TestQueueAbandonsTransactions(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	//the server takes MAIL FROM, then never answers RCPT TO
+	server.Stall("RCPT")
+
+	send := func(ctx context.Context, ms mailsender.MailStruct) (*mailsender.Result, error) {
+		return new(mailsender.Impl).SendMailWithoutAuthContext(ctx, server.Addr, ms)
+	}
+	q := newTestQueue(t, dir, send)
+	var mu sync.Mutex
+	var events []string
+	q.notify = func(event string, qm QueuedMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	q.Start()
+	defer q.Stop()
+
+	id, err := q.Enqueue(queueMail())
+	assert.Nil(err)
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Commands("RCPT") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The message was not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.Stop()
+
+	qm, _ := q.Get(id)
+	assert.Equal(StatusDeferred, qm.Status, "The abandoned mail should be retried")
+	assert.Contains(qm.LastError, context.Canceled.Error())
+	_, err = os.Stat(filepath.Join(dir, "dead", id+".json"))
+	assert.True(os.IsNotExist(err), "The abandoned mail should not be dead-lettered")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal([]string{EventAccepted}, events, "Stopping the queue is no outcome of the mail")
+}
+
+func TestQueueBackoff(t *testing.T) {
+	assert := assert.New(t)
+	q := &Queue{retryInitial: time.Minute, retryMax: 10 * time.Minute}
+	assert.Equal(time.Minute, q.backoff(1))
+	assert.Equal(2*time.Minute, q.backoff(2))
+	assert.Equal(8*time.Minute, q.backoff(4))
+	assert.Equal(10*time.Minute, q.backoff(5))
+	assert.Equal(10*time.Minute, q.backoff(50))
+}
+
+func TestSendMailMessageQueued(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	serv := MailSenderService{Mail: MailSetup{Server: "exampleserver.com:25", DefaultMail: "mail@exampleserver.com"}}
+	//the queue is not started, so the mail stays on disk
+	serv.queue = newTestQueue(t, dir, newRecordingSend().send)
+
+	w := httptest.NewRecorder()
+	body := `{"To":[{"Address":"dest@server.com"}],"Subject":"queued"}`
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	var response AcceptedResponse
+	assert.Nil(json.NewDecoder(w.Body).Decode(&response))
+	assert.Equal("<"+response.MessageID+">", w.Header().Get("Message-ID"))
+	qm, err := readMessage(filepath.Join(dir, "queue", response.ID+".json"))
+	assert.Nil(err)
+	assert.Equal("queued", qm.Mail.Subject)
+	assert.Equal(StatusQueued, qm.Status)
+}
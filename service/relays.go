@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//The strategies choosing the order in which the relays are tried
+const (
+	//StrategyFailover tries the relays by priority, the lowest first
+	StrategyFailover = "failover"
+	//StrategyRoundRobin starts with the next relay for every mail
+	StrategyRoundRobin = "roundrobin"
+	//StrategyWeighted starts with a relay chosen at random by weight
+	StrategyWeighted = "weighted"
+)
+
+//The defaults of the circuit breaker
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 60 * time.Second
+)
+
+//ErrNoRelayAvailable is returned when the circuit breakers of all the
+//relays are open
+var ErrNoRelayAvailable = errors.New("No relay is available")
+
+//Relay is an upstream mail server the mails are sent through. All the
+//relays use the TLS and authentication settings of the mail setup.
+type Relay struct {
+	Server string `json:"server"`
+	//Priority orders the relays for the failover strategy, the lowest first
+	Priority int `json:"priority"`
+	//Weight is the share of the mails the relay gets first with the
+	//weighted strategy, 1 when it is 0
+	Weight int `json:"weight"`
+}
+
+//validateRelays checks the relays and the strategy of the setup
+func (ms MailSetup) validateRelays() error {
+	for _, relay := range ms.Relays {
+		if _, _, err := net.SplitHostPort(relay.Server); err != nil {
+			return fmt.Errorf("Invalid relay %s: %s", relay.Server, err.Error())
+		}
+		if relay.Weight < 0 {
+			return fmt.Errorf("Invalid weight %d for relay %s", relay.Weight, relay.Server)
+		}
+	}
+	switch ms.RelayStrategy {
+	case "", StrategyFailover, StrategyRoundRobin, StrategyWeighted:
+	default:
+		return fmt.Errorf("Invalid relaystrategy %s", ms.RelayStrategy)
+	}
+	if ms.BreakerThreshold < 0 || ms.BreakerCooldown < 0 {
+		return fmt.Errorf("Invalid circuit breaker setup")
+	}
+	return nil
+}
+
+//relayState tracks the consecutive failures of a relay. Its circuit
+//breaker is open, and the relay skipped, until openUntil.
+type relayState struct {
+	Relay
+	failures  int
+	openUntil time.Time
+}
+
+//relaySet chooses the relays a mail is sent through
+type relaySet struct {
+	strategy  string
+	threshold int
+	cooldown  time.Duration
+
+	mu     sync.Mutex
+	relays []*relayState
+	next   int
+}
+
+//newRelaySet creates the relays of the setup, server alone when there
+//is no list of relays
+func newRelaySet(ms MailSetup) *relaySet {
+	rs := &relaySet{
+		strategy:  ms.RelayStrategy,
+		threshold: ms.BreakerThreshold,
+		cooldown:  time.Duration(ms.BreakerCooldown) * time.Second,
+	}
+	if rs.threshold == 0 {
+		rs.threshold = defaultBreakerThreshold
+	}
+	if rs.cooldown == 0 {
+		rs.cooldown = defaultBreakerCooldown
+	}
+
+	relays := ms.Relays
+	if len(relays) == 0 {
+		relays = []Relay{{Server: ms.Server}}
+	}
+	for _, relay := range relays {
+		if relay.Weight == 0 {
+			relay.Weight = 1
+		}
+		rs.relays = append(rs.relays, &relayState{Relay: relay})
+	}
+	if rs.strategy == "" || rs.strategy == StrategyFailover {
+		sort.SliceStable(rs.relays, func(i, j int) bool { return rs.relays[i].Priority < rs.relays[j].Priority })
+	}
+	return rs
+}
+
+//relaySet returns the relays of the service, created on first use
+func (mss *MailSenderService) relaySet() *relaySet {
+	mss.relaysOnce.Do(func() {
+		mss.relays = newRelaySet(mss.Mail)
+	})
+	return mss.relays
+}
+
+//order returns the relays to try for a mail, in the order given by the
+//strategy, leaving out the ones with an open circuit breaker
+func (rs *relaySet) order() []*relayState {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := time.Now()
+	var available []*relayState
+	for _, relay := range rs.relays {
+		if now.After(relay.openUntil) {
+			available = append(available, relay)
+		}
+	}
+	if len(available) < 2 {
+		return available
+	}
+
+	switch rs.strategy {
+	case StrategyRoundRobin:
+		start := rs.next % len(available)
+		rs.next++
+		ordered := make([]*relayState, 0, len(available))
+		ordered = append(ordered, available[start:]...)
+		return append(ordered, available[:start]...)
+	case StrategyWeighted:
+		return weightedOrder(available)
+	}
+	return available
+}
+
+//weightedOrder shuffles the relays so that each of them comes before
+//the others in proportion to its weight
+func weightedOrder(relays []*relayState) []*relayState {
+	remaining := append([]*relayState(nil), relays...)
+	ordered := make([]*relayState, 0, len(relays))
+	for len(remaining) > 0 {
+		total := 0
+		for _, relay := range remaining {
+			total += relay.Weight
+		}
+		pick := rand.Intn(total)
+		for i, relay := range remaining {
+			if pick < relay.Weight {
+				ordered = append(ordered, relay)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+			pick -= relay.Weight
+		}
+	}
+	return ordered
+}
+
+//report records the outcome of sending through relay. Its breaker opens
+//after threshold consecutive failures and, once cooldown has passed,
+//the relay is tried again: a single failure then opens it once more.
+func (rs *relaySet) report(relay *relayState, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if !relayFailed(err) {
+		relay.failures = 0
+		return
+	}
+	relay.failures++
+	if relay.failures >= rs.threshold {
+		relay.openUntil = time.Now().Add(rs.cooldown)
+	}
+}
+
+//relayFailed tells if err means the relay could not take the mail, as
+//opposed to the mail being refused
+func relayFailed(err error) bool {
+	var smtpErr *mailsender.SMTPError
+	if err == nil || !errors.As(err, &smtpErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return smtpErr.Temporary()
+}
+
+//retryOnNextRelay tells if the mail can be sent through the next relay
+//after err. A temporary failure is retried unless it happened while the
+//message was transferred without an answer of the server, as the relay
+//may have taken it.
+func retryOnNextRelay(err error) bool {
+	if !relayFailed(err) {
+		return false
+	}
+	var smtpErr *mailsender.SMTPError
+	errors.As(err, &smtpErr)
+	return smtpErr.Stage != mailsender.StageData || smtpErr.Code != 0
+}
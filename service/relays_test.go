@@ -0,0 +1,115 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+//servers returns the servers of relays in order
+func servers(relays []*relayState) []string {
+	var result []string
+	for _, relay := range relays {
+		result = append(result, relay.Server)
+	}
+	return result
+}
+
+func TestRelayOrder(t *testing.T) {
+	assert := assert.New(t)
+	relays := []Relay{{Server: "a.com:25", Priority: 2}, {Server: "b.com:25", Priority: 1}, {Server: "c.com:25", Priority: 2}}
+
+	rs := newRelaySet(MailSetup{Relays: relays})
+	assert.Equal([]string{"b.com:25", "a.com:25", "c.com:25"}, servers(rs.order()))
+	assert.Equal([]string{"b.com:25", "a.com:25", "c.com:25"}, servers(rs.order()))
+
+	rs = newRelaySet(MailSetup{Relays: relays, RelayStrategy: StrategyRoundRobin})
+	assert.Equal([]string{"a.com:25", "b.com:25", "c.com:25"}, servers(rs.order()))
+	assert.Equal([]string{"b.com:25", "c.com:25", "a.com:25"}, servers(rs.order()))
+	assert.Equal([]string{"c.com:25", "a.com:25", "b.com:25"}, servers(rs.order()))
+
+	relays = []Relay{{Server: "a.com:25", Weight: 9}, {Server: "b.com:25", Weight: 1}}
+	rs = newRelaySet(MailSetup{Relays: relays, RelayStrategy: StrategyWeighted})
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		order := rs.order()
+		assert.Equal(2, len(order))
+		first[order[0].Server]++
+	}
+	assert.True(first["a.com:25"] > 800 && first["b.com:25"] > 50, "Unexpected distribution %v", first)
+
+	rs = newRelaySet(MailSetup{Server: "single.com:25"})
+	assert.Equal([]string{"single.com:25"}, servers(rs.order()))
+}
+
+func TestServiceSendMailFailover(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{
+		Relays:           []Relay{{Server: "first.com:25"}, {Server: "second.com:25", Priority: 1}},
+		BreakerThreshold: 2,
+	}}
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "dest@server.com"}},
+	}
+	unreachable := &mailsender.SMTPError{Stage: mailsender.StageDial, Message: "connection refused", Err: errors.New("connection refused")}
+
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMailWithoutAuth", "first.com:25", mock.Anything).Return((*mailsender.Result)(nil), unreachable).Twice()
+	mockMailSender.On("SendMailWithoutAuth", "second.com:25", mock.Anything).Return(&mailsender.Result{}, nil).Times(3)
+
+	//the temporary failure is retried on the next relay
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	//the breaker of the first relay is now open, so it is left out
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	mockMailSender.AssertExpectations(t)
+
+	//a refused mail is not retried and does not count as a failure
+	refused := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550, Message: "No such user", Err: mailsender.ErrAllRecipientsRejected}
+	serv = MailSenderService{Mail: MailSetup{Relays: []Relay{{Server: "first.com:25"}, {Server: "second.com:25"}}, BreakerThreshold: 1}}
+	mockMailSender = new(MyMailSender)
+	mockMailSender.On("SendMailWithoutAuth", "first.com:25", mock.Anything).Return((*mailsender.Result)(nil), refused).Twice()
+	assert.Equal(refused, serv.SendMail(mockMailSender, ms))
+	assert.Equal(refused, serv.SendMail(mockMailSender, ms))
+	mockMailSender.AssertExpectations(t)
+}
+
+func TestServiceSendMailNoRelayAvailable(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{Server: "only.com:25", BreakerThreshold: 1}}
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "dest@server.com"}},
+	}
+	greylisted := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, Message: "Try again later", Err: mailsender.ErrAllRecipientsRejected}
+
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMailWithoutAuth", "only.com:25", ms).Return((*mailsender.Result)(nil), greylisted).Once()
+	assert.Equal(greylisted, serv.SendMail(mockMailSender, ms))
+
+	err := serv.SendMail(mockMailSender, ms)
+	assert.True(errors.Is(err, ErrNoRelayAvailable), "ErrNoRelayAvailable expected, got %v", err)
+	assert.True(err.(*mailsender.SMTPError).Temporary())
+	mockMailSender.AssertExpectations(t)
+}
+
+func TestCreateMailSenderServiceRelays(t *testing.T) {
+	assert := assert.New(t)
+	config := `{"mailsetup":{"relays":[{"server":"%s"}],"relaystrategy":"%s"},"servicesetup":{"port":8080}}`
+
+	mss, err := NewMailSenderService(fmt.Sprintf(config, "relay.com:25", "roundrobin"))
+	assert.Nil(err, "No server is needed with relays, got %v\n", err)
+	assert.Equal("relay.com:25", mss.Mail.Relays[0].Server)
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, "relay.com", "roundrobin"))
+	assert.NotNil(err, "Error expected for a relay without port, got nil\n")
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, "relay.com:25", "random"))
+	assert.NotNil(err, "Error expected for an unknown strategy, got nil\n")
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -11,8 +12,12 @@ import (
 	"net/http"
 	"net/mail"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/adiclepcea/mailsender"
 )
@@ -21,6 +26,52 @@ import (
 type MailSenderService struct {
 	Mail  MailSetup `json:"mailsetup"`
 	Setup Setup     `json:"servicesetup"`
+
+	tokenSourcesMu sync.Mutex
+	tokenSources   map[string]*TokenSource
+	//resolver replaces the DNS lookups of the direct delivery
+	resolver mailsender.Resolver
+
+	relaysOnce sync.Once
+	relays     *relaySet
+
+	queue *Queue
+
+	webhooksOnce sync.Once
+	webhooks     *webhooks
+
+	//tracked holds the mails sent without the queue
+	trackedOnce sync.Once
+	tracked     *tracker
+
+	templates *mailsender.Templates
+
+	//dkim holds the DKIM signers by domain
+	dkim map[string]*mailsender.DKIMSigner
+	//smime holds the S/MIME signers by domain
+	smime map[string]*mailsender.SMIMESigner
+	//pgpSigner is the unlocked OpenPGP signing key
+	pgpSigner *mailsender.PGPKey
+	//pgpKeys holds the OpenPGP keys of the recipients by address
+	pgpKeys map[string]*mailsender.PGPKey
+	//transport delivers the mails in place of the mail servers and
+	//memory is the same transport when it keeps them in memory
+	transport mailsender.Transport
+	memory    *mailsender.MemoryTransport
+}
+
+//SendRequest is the JSON body of /sendmail: the mail, optionally
+//rendered from a template, and the URL receiving its events
+type SendRequest struct {
+	mailsender.MailStruct
+	TemplateRequest
+	Callback string `json:"callback"`
+}
+
+//AcceptedResponse is the JSON body sent back when a mail is queued
+type AcceptedResponse struct {
+	ID        string `json:"id"`
+	MessageID string `json:"messageid"`
 }
 
 //MailSetup represents the default setup for sending mail
@@ -32,6 +83,65 @@ type MailSetup struct {
 	ServerCAFile    string `json:"mailservercafile"`
 	UseTLS          bool   `json:"usetls"`
 	UseAUTH         bool   `json:"useauth"`
+	//TLSMode is one of none, opportunistic, starttls or implicit.
+	//When it is empty usetls selects between implicit and none.
+	TLSMode mailsender.TLSMode `json:"tlsmode"`
+	//AuthMechanism pins the authentication mechanism (PLAIN, LOGIN,
+	//CRAM-MD5, XOAUTH2 or OAUTHBEARER). When it is empty the mechanism
+	//is chosen from the ones the server advertises.
+	AuthMechanism string `json:"authmechanism"`
+	//Accounts holds the sending accounts authenticating with OAuth2
+	Accounts []OAuth2Account `json:"accounts"`
+	//MessageIDDomain is the domain of the generated Message-IDs.
+	//The domain of the sender is used when it is empty.
+	MessageIDDomain string `json:"messageiddomain"`
+	//Timeouts limits each phase of the SMTP session, in seconds
+	Timeouts TimeoutSetup `json:"timeouts"`
+	//BatchConcurrency is the number of mails of a /sendbatch request
+	//sent at the same time, 4 when it is 0
+	BatchConcurrency int `json:"batchconcurrency"`
+	//Direct delivers the mails straight to the mail exchangers of the
+	//recipients instead of going through server
+	Direct bool `json:"direct"`
+	//LocalName is the host name announced to the mail servers
+	LocalName string `json:"localname"`
+	//Relays replaces server with several mail servers, tried in the
+	//order given by RelayStrategy: failover, the default, roundrobin
+	//or weighted
+	Relays        []Relay `json:"relays"`
+	RelayStrategy string  `json:"relaystrategy"`
+	//BreakerThreshold is the number of consecutive failures after which
+	//a relay is left out for BreakerCooldown seconds
+	BreakerThreshold int `json:"breakerthreshold"`
+	BreakerCooldown  int `json:"breakercooldown"`
+	//DKIM holds the keys signing the mails of the sending domains
+	DKIM []DKIMSetup `json:"dkim"`
+	//SMIME holds the certificates signing the mails of the sending
+	//domains with S/MIME
+	SMIME []SMIMESetup `json:"smime"`
+	//PGP signs and encrypts the mails with OpenPGP
+	PGP PGPSetup `json:"pgp"`
+	//Transport replaces the delivery to the mail servers
+	Transport TransportSetup `json:"transport"`
+}
+
+//TimeoutSetup holds the timeouts of the phases of the SMTP session in
+//seconds. A phase with no timeout is only bounded by the HTTP request.
+type TimeoutSetup struct {
+	Dial    int `json:"dial"`
+	TLS     int `json:"tls"`
+	Command int `json:"command"`
+	Data    int `json:"data"`
+}
+
+//durations converts the timeouts to the ones of mailsender
+func (ts TimeoutSetup) durations() mailsender.Timeouts {
+	return mailsender.Timeouts{
+		Dial:    time.Duration(ts.Dial) * time.Second,
+		TLS:     time.Duration(ts.TLS) * time.Second,
+		Command: time.Duration(ts.Command) * time.Second,
+		Data:    time.Duration(ts.Data) * time.Second,
+	}
 }
 
 //Setup respresents the setup for the service
@@ -40,6 +150,24 @@ type Setup struct {
 	CertFile string `json:"certfile"`
 	KeyFile  string `json:"keyfile"`
 	CAFile   string `json:"cafile"`
+	//Queue makes /sendmail answer once the mail is stored, the mail
+	//being delivered in the background
+	Queue QueueSetup `json:"queue"`
+	//Webhooks receive the events of all the mails
+	Webhooks []WebhookSetup `json:"webhooks"`
+	//WebhookRetries is the number of times a webhook request is retried
+	WebhookRetries int `json:"webhookretries"`
+	//CallbackSecret signs the events sent to the callback URLs given
+	//with the mails, which must be on one of the CallbackHosts. Without
+	//CallbackHosts the mails can not have a callback.
+	CallbackSecret string   `json:"callbacksecret"`
+	CallbackHosts  []string `json:"callbackhosts"`
+	//Templates is the directory of the templates the mails can be
+	//rendered from
+	Templates TemplateSetup `json:"templates"`
+	//Catcher keeps the mails in memory instead of sending them and
+	//shows them in a web interface under /catcher/
+	Catcher bool `json:"catcher"`
 }
 
 //NewMailSenderService initiates MailSenderService struct from a json config file
@@ -51,68 +179,328 @@ func NewMailSenderService(configString string) (*MailSenderService, error) {
 		return nil, err
 	}
 
-	if mss.Mail.Server == "" {
+	if mss.Setup.Catcher {
+		if err := mss.Mail.Transport.capture(); err != nil {
+			return nil, err
+		}
+	}
+
+	if mss.Mail.Server == "" && len(mss.Mail.Relays) == 0 && !mss.Mail.Direct && mss.Mail.Transport.usesSMTP() {
 		return nil, fmt.Errorf("Invalid Mail setup")
 	}
 
+	if mss.Mail.Direct && mss.Mail.UseAUTH {
+		return nil, fmt.Errorf("Direct delivery can not be used with authentication")
+	}
+
 	if mss.Setup.Port == 0 {
 		return nil, fmt.Errorf("Invalid Setup format")
 	}
 
+	if mss.Mail.AuthMechanism != "" && !mailsender.IsAuthMechanism(mss.Mail.AuthMechanism) {
+		return nil, fmt.Errorf("Invalid authmechanism %s", mss.Mail.AuthMechanism)
+	}
+
+	for _, account := range mss.Mail.Accounts {
+		if account.Mail == "" || account.TokenURL == "" || account.RefreshToken == "" {
+			return nil, fmt.Errorf("Invalid account setup for %s", account.Mail)
+		}
+		switch strings.ToUpper(account.Mechanism) {
+		case "", mailsender.AuthXOAuth2, mailsender.AuthOAuthBearer:
+		default:
+			return nil, fmt.Errorf("Invalid mechanism %s for %s", account.Mechanism, account.Mail)
+		}
+	}
+
+	if t := mss.Mail.Timeouts; t.Dial < 0 || t.TLS < 0 || t.Command < 0 || t.Data < 0 {
+		return nil, fmt.Errorf("Invalid timeouts setup")
+	}
+
+	if err := mss.Mail.validateRelays(); err != nil {
+		return nil, err
+	}
+
+	if err := mss.Setup.Queue.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := mss.Setup.validateWebhooks(); err != nil {
+		return nil, err
+	}
+
+	if mss.Mail.BatchConcurrency < 0 {
+		return nil, fmt.Errorf("Invalid batchconcurrency %d", mss.Mail.BatchConcurrency)
+	}
+
+	switch mss.Mail.tlsMode() {
+	case mailsender.TLSNone, mailsender.TLSOpportunistic, mailsender.TLSStartTLS:
+	case mailsender.TLSImplicit:
+		if !mss.Mail.UseAUTH {
+			return nil, fmt.Errorf("Implicit TLS can only be used with authentication")
+		}
+	default:
+		return nil, fmt.Errorf("Invalid tlsmode %s", mss.Mail.TLSMode)
+	}
+
+	if err := mss.loadDKIM(); err != nil {
+		return nil, err
+	}
+
+	if err := mss.loadSMIME(); err != nil {
+		return nil, err
+	}
+
+	if err := mss.loadPGP(); err != nil {
+		return nil, err
+	}
+
+	if err := mss.loadTransport(); err != nil {
+		return nil, err
+	}
+
+	if err := mss.loadTemplates(); err != nil {
+		return nil, err
+	}
+
 	return &mss, nil
 }
 
-//SendMail is the function that performs the actual sending of the mail
+//tlsMode returns the TLS mode to use, falling back to usetls when
+//tlsmode is not set
+func (ms MailSetup) tlsMode() mailsender.TLSMode {
+	if ms.TLSMode != "" {
+		return ms.TLSMode
+	}
+	if ms.UseTLS && ms.UseAUTH {
+		return mailsender.TLSImplicit
+	}
+	return mailsender.TLSNone
+}
+
+//tlsConfig creates the tls configuration used to connect to the mail server
+func (ms MailSetup) tlsConfig(host string) (*tls.Config, error) {
+	if ms.UseInsecureTLS {
+		log.Println("Insecure")
+		//we should not check for certificate validity
+		return mailsender.CreateInsecureTLSConfig(host), nil
+	}
+	if ms.ServerCAFile != "" {
+		log.Println("CA")
+		//we have an own signed certificate
+		if _, err := os.Stat(ms.ServerCAFile); os.IsNotExist(err) {
+			return nil, err
+		}
+		return mailsender.CreateTLSConfigWithCA(host, ms.ServerCAFile)
+	}
+	log.Println("known")
+	//we should use tls with a well known CA
+	return mailsender.CreateTLSConfig(host), nil
+}
+
+//SendMail is the function that performs the actual sending of the mail.
+//For the senders having an OAuth2 account the access token is used as
+//password and, if the server refuses it, the mail is sent once more
+//with a freshly obtained token.
 func (mss *MailSenderService) SendMail(msender mailsender.MailSender, ms mailsender.MailStruct) error {
-	if mss.Mail.UseAUTH {
-		if mss.Mail.UseTLS {
-			var tlsconfig *tls.Config
-			host, _, err := net.SplitHostPort(mss.Mail.Server)
-			if err != nil {
-				return err
+	return mss.SendMailContext(context.Background(), msender, ms)
+}
+
+//SendMailContext is SendMail giving up when ctx is done. The context
+//only reaches the SMTP session when msender is a ContextMailSender.
+func (mss *MailSenderService) SendMailContext(ctx context.Context, msender mailsender.MailSender, ms mailsender.MailStruct) error {
+	_, err := mss.deliver(ctx, msender, ms)
+	return err
+}
+
+//deliver sends the mail, with the access token of the OAuth2 account
+//of the sender if it has one, and returns the result of the server
+func (mss *MailSenderService) deliver(ctx context.Context, msender mailsender.MailSender, ms mailsender.MailStruct) (*mailsender.Result, error) {
+	account, ok := mss.Mail.oauth2Account(ms.From.Address)
+	if !ok || !mss.Mail.UseAUTH || mss.transport != nil {
+		return mss.send(ctx, msender, ms)
+	}
+
+	ts := mss.tokenSource(account)
+	token, err := ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	ms.Password = token
+	result, err := mss.send(ctx, msender, ms)
+	if !isAuthError(err) {
+		return result, err
+	}
+
+	log.Printf("Token of %s refused, refreshing it", account.Mail)
+	if ms.Password, err = ts.Refresh(); err != nil {
+		return nil, err
+	}
+	return mss.send(ctx, msender, ms)
+}
+
+//newDirectSender creates the sender delivering the mails to the mail
+//exchangers of the recipients
+func (mss *MailSenderService) newDirectSender() *mailsender.DirectSender {
+	return &mailsender.DirectSender{
+		Resolver:  mss.resolver,
+		LocalName: mss.Mail.LocalName,
+		Timeouts:  mss.Mail.Timeouts.durations(),
+	}
+}
+
+//send sends the mail through the relays, moving to the next one after
+//a temporary failure, or straight to the mail exchangers in direct mode.
+//The mail is signed with the S/MIME certificate and the DKIM key of the
+//domain of the sender, or with OpenPGP when there is no S/MIME
+//certificate, and encrypted for the recipients having OpenPGP keys.
+//A configured transport replaces msender and the mail servers.
+func (mss *MailSenderService) send(ctx context.Context, msender mailsender.MailSender, ms mailsender.MailStruct) (*mailsender.Result, error) {
+	if signer := mss.smimeSigner(ms.From.Address); signer != nil {
+		ms.SMIME = signer
+		return mss.dispatch(ctx, msender, ms)
+	}
+	copies, err := mss.pgpCopies(ms)
+	if err != nil {
+		return nil, err
+	}
+	if len(copies) == 1 {
+		return mss.dispatch(ctx, msender, copies[0])
+	}
+
+	//the recipients of a copy that can not be sent are refused, as the
+	//others may have got theirs
+	result := &mailsender.Result{MessageID: ms.MessageID}
+	var firstErr error
+	for _, part := range copies {
+		sent, err := mss.dispatch(ctx, msender, part)
+		if sent != nil {
+			result.Bytes += sent.Bytes
+			result.Accepted = append(result.Accepted, sent.Accepted...)
+			result.Rejected = append(result.Rejected, sent.Rejected...)
+		} else {
+			for _, recipient := range part.Envelope {
+				result.Rejected = append(result.Rejected, mailsender.RecipientError{Address: recipient, Err: err})
 			}
-			if mss.Mail.UseInsecureTLS {
-				log.Println("Insecure")
-				//we should not check for certificate validity
-				tlsconfig = mailsender.CreateInsecureTLSConfig(host)
-			} else if mss.Mail.ServerCAFile != "" {
-				log.Println("CA")
-				//we have an own signed certificate
-				if _, err = os.Stat(mss.Mail.ServerCAFile); os.IsNotExist(err) {
-					return err
-				}
-				tlsconfig, err = mailsender.CreateTLSConfigWithCA(host, mss.Mail.ServerCAFile)
-				if err != nil {
-					return err
-				}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(result.Accepted) == 0 {
+		return result, firstErr
+	}
+	return result, nil
+}
+
+//dispatch signs the mail with the DKIM key of the domain of its sender
+//and sends it as send describes
+func (mss *MailSenderService) dispatch(ctx context.Context, msender mailsender.MailSender, ms mailsender.MailStruct) (*mailsender.Result, error) {
+	if signer := mss.dkimSigner(ms.From.Address); signer != nil {
+		ms.DKIM = signer
+	}
+	if mss.transport != nil {
+		return mss.transport.Deliver(ctx, ms)
+	}
+	if mss.Mail.Direct {
+		result, err := mss.newDirectSender().SendContext(ctx, ms)
+		logRejected(result)
+		return result, err
+	}
+
+	relays := mss.relaySet()
+	order := relays.order()
+	//a failed mail is sent again to the next relay, while the Reader
+	//attachments can only be read once
+	if len(order) > 1 {
+		var err error
+		if ms, err = ms.Render(); err != nil {
+			return nil, err
+		}
+	}
+	var result *mailsender.Result
+	err := newNoRelayError()
+	for _, relay := range order {
+		result, err = mss.sendVia(ctx, msender, relay.Server, ms)
+		relays.report(relay, err)
+		if !retryOnNextRelay(err) {
+			break
+		}
+		log.Printf("Relay %s failed: %v", relay.Server, err)
+	}
+	logRejected(result)
+	return result, err
+}
+
+//newNoRelayError builds the temporary error returned when all the relays
+//are left out by their circuit breaker
+func newNoRelayError() error {
+	return &mailsender.SMTPError{Stage: mailsender.StageDial, Message: ErrNoRelayAvailable.Error(), Err: ErrNoRelayAvailable}
+}
+
+//logRejected logs the recipients refused by the server
+func logRejected(result *mailsender.Result) {
+	if result == nil {
+		return
+	}
+	for _, rejected := range result.Rejected {
+		log.Printf("Recipient rejected: %v", rejected)
+	}
+}
+
+//sendVia sends the mail to server using the TLS mode and authentication
+//of the setup
+func (mss *MailSenderService) sendVia(ctx context.Context, msender mailsender.MailSender, server string, ms mailsender.MailStruct) (*mailsender.Result, error) {
+	var result *mailsender.Result
+	var err error
+
+	mode := mss.Mail.tlsMode()
+	ctxSender, withContext := msender.(mailsender.ContextMailSender)
+
+	if mode == mailsender.TLSNone {
+		if mss.Mail.UseAUTH {
+			//we send mail with auth, but without TLS
+			if withContext {
+				result, err = ctxSender.SendMailContext(ctx, server, ms.From.Address, ms.Password, ms)
 			} else {
-				log.Println("known")
-				//we should use tls with a well known CA
-				tlsconfig = mailsender.CreateTLSConfig(host)
-			}
-			log.Printf("%s, user=%s, password=%s", mss.Mail.Server, ms.From.Address, ms.Password)
-			_, err = msender.SendMailTLS(mss.Mail.Server, tlsconfig, ms.From.Address, ms.Password, ms)
-			if err != nil {
-				return err
+				result, err = msender.SendMail(server, ms.From.Address, ms.Password, ms)
 			}
+		} else if withContext {
+			result, err = ctxSender.SendMailWithoutAuthContext(ctx, server, ms)
 		} else {
-			//we send mail with auth, but without TLS
-			_, err := msender.SendMail(mss.Mail.Server, ms.From.Address, ms.Password, ms)
-			if err != nil {
-				return nil
-			}
+			//we send the mail without auth and without tls
+			result, err = msender.SendMailWithoutAuth(server, ms)
 		}
 	} else {
-		//we send the mail without auth and without tls
-		log.Println("aici")
-		_, err := msender.SendMailWithoutAuth(mss.Mail.Server, ms)
+		var tlsconfig *tls.Config
+		var host string
+		host, _, err = net.SplitHostPort(server)
 		if err != nil {
-			log.Printf("err: %v", err)
-			return err
+			return nil, err
+		}
+		if tlsconfig, err = mss.Mail.tlsConfig(host); err != nil {
+			return nil, err
+		}
+		log.Printf("%s, tlsmode=%s, user=%s", server, mode, ms.From.Address)
+		if mode == mailsender.TLSImplicit {
+			if withContext {
+				result, err = ctxSender.SendMailTLSContext(ctx, server, tlsconfig, ms.From.Address, ms.Password, ms)
+			} else {
+				result, err = msender.SendMailTLS(server, tlsconfig, ms.From.Address, ms.Password, ms)
+			}
+		} else {
+			usermail := ""
+			if mss.Mail.UseAUTH {
+				usermail = ms.From.Address
+			}
+			mandatory := mode == mailsender.TLSStartTLS
+			if withContext {
+				result, err = ctxSender.SendMailStartTLSContext(ctx, server, tlsconfig, mandatory, usermail, ms.Password, ms)
+			} else {
+				result, err = msender.SendMailStartTLS(server, tlsconfig, mandatory, usermail, ms.Password, ms)
+			}
 		}
-		log.Println("muc")
 	}
-	return nil
+	return result, err
 }
 
 func validateEmail(email string) bool {
@@ -122,13 +510,17 @@ func validateEmail(email string) bool {
 
 //ValidateMailStruct will validate the mail struct received as json against the rules
 //It will also put the default mail and password values if they are needed
+//and generate the Message-ID of the mail
 func (mss *MailSenderService) ValidateMailStruct(ms *mailsender.MailStruct) (
 	*mailsender.MailStruct, error) {
 
-	if ms.To.Address == "" {
+	if len(ms.Recipients()) == 0 {
 		return nil, fmt.Errorf("No destination address provided")
-	} else if !validateEmail(ms.To.Address) {
-		return nil, fmt.Errorf("%s is not a valid destination address", ms.To.Address)
+	}
+	for _, recipient := range append(ms.Recipients(), ms.Envelope...) {
+		if !validateEmail(recipient.Address) {
+			return nil, fmt.Errorf("%s is not a valid destination address", recipient.Address)
+		}
 	}
 	if ms.From.Address == "" {
 		ms.From = mail.Address{Name: ms.From.Name, Address: mss.Mail.DefaultMail}
@@ -137,50 +529,120 @@ func (mss *MailSenderService) ValidateMailStruct(ms *mailsender.MailStruct) (
 		}
 	} else if !validateEmail(ms.From.Address) {
 		return nil, fmt.Errorf("%s is not a valid mail address", ms.From.String())
-	} else if ms.Password == "" {
+	} else if _, oauth := mss.Mail.oauth2Account(ms.From.Address); ms.Password == "" && !oauth {
 		if mss.Mail.UseAUTH {
 			return nil, fmt.Errorf("No password provided for this address")
 		}
 	}
+	for _, replyTo := range ms.ReplyTo {
+		if !validateEmail(replyTo.Address) {
+			return nil, fmt.Errorf("%s is not a valid reply address", replyTo.Address)
+		}
+	}
+	if err := ms.ValidateHeaders(); err != nil {
+		return nil, err
+	}
+	if ms.MessageID == "" {
+		domain := mss.Mail.MessageIDDomain
+		if domain == "" {
+			domain = ms.From.Address[strings.LastIndex(ms.From.Address, "@")+1:]
+		}
+		ms.MessageID = mailsender.GenerateMessageID(domain)
+	}
 
 	return ms, nil
 
 }
 
+//accept renders and validates a mail received by /sendmail or /sendbatch
+//and checks the URL its events are posted to
+func (mss *MailSenderService) accept(ms *mailsender.MailStruct, tr TemplateRequest, callback string) error {
+	if err := mss.render(ms, tr); err != nil {
+		return err
+	}
+	if _, err := mss.ValidateMailStruct(ms); err != nil {
+		return err
+	}
+	if callback != "" {
+		return validateCallbackURL(callback, mss.Setup.CallbackHosts)
+	}
+	return nil
+}
+
+//sendNow sends a mail that is not queued, tracking it for /messages and
+//posting its accepted event and the one of its outcome to the webhooks
+//and to callback. It returns the id of the mail in /messages.
+func (mss *MailSenderService) sendNow(ctx context.Context, msender mailsender.MailSender, ms mailsender.MailStruct,
+	callback string) (string, *mailsender.Result, error) {
+
+	id, err := mss.tracker().add(ms)
+	if err != nil {
+		return "", nil, err
+	}
+	mss.events().emit(newEvent(EventAccepted, id, ms, nil), callback)
+	start := time.Now()
+	result, err := mss.deliver(ctx, msender, ms)
+	attempt := newAttempt(start, result, err)
+	mss.tracker().finish(id, attempt, result, err)
+	mss.events().emit(newEvent(outcomeEvent(err), id, ms, []Attempt{attempt}), callback)
+	return id, result, err
+}
+
+//tracker returns the tracker of the mails sent without the queue
+func (mss *MailSenderService) tracker() *tracker {
+	mss.trackedOnce.Do(func() {
+		mss.tracked = newTracker()
+	})
+	return mss.tracked
+}
+
 //SendMailMessage is the method that links the REST call to the sendMail method
 func (mss *MailSenderService) SendMailMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Write([]byte("Sorry, only POST allowed!"))
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Sorry, only POST allowed!"))
 		return
 	}
 	decoder := json.NewDecoder(r.Body)
 
-	var ms mailsender.MailStruct
+	var req SendRequest
 
-	err := decoder.Decode(&ms)
+	err := decoder.Decode(&req)
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
+	ms := req.MailStruct
 
-	_, err = mss.ValidateMailStruct(&ms)
-
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+	if err = mss.accept(&ms, req.TemplateRequest, req.Callback); err != nil {
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	msender := &mailsender.Impl{}
-	err = mss.SendMail(msender, ms)
+	if mss.queue != nil {
+		id, err := mss.queue.EnqueueWithCallback(ms, req.Callback)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Message-ID", "<"+ms.MessageID+">")
+		w.Header().Set("Location", "/messages/"+id)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(AcceptedResponse{ID: id, MessageID: ms.MessageID})
+		return
+	}
+
+	//the session is abandoned when the client goes away
+	id, _, err := mss.sendNow(r.Context(), mss.newMailSender(ms.From.Address), ms, req.Callback)
 	log.Println(ms.From)
+	if id != "" {
+		w.Header().Set("Location", "/messages/"+id)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	w.Header().Set("Message-ID", "<"+ms.MessageID+">")
 	w.Write([]byte("OK"))
 }
 
@@ -204,15 +666,71 @@ func loadCA(fileName string) ([]byte, error) {
 	return caCert, nil
 }
 
-//Run starts the service with a REST Api
+//StartQueue creates the outbound queue, if the setup has one, and
+//starts delivering the mails it holds
+func (mss *MailSenderService) StartQueue() error {
+	if mss.Setup.Queue.Dir == "" {
+		return nil
+	}
+	send := func(ctx context.Context, ms mailsender.MailStruct) (*mailsender.Result, error) {
+		return mss.deliver(ctx, mss.newMailSender(ms.From.Address), ms)
+	}
+	queue, err := NewQueue(mss.Setup.Queue, send)
+	if err != nil {
+		return err
+	}
+	queue.notify = mss.notifyQueued
+	mss.queue = queue
+	queue.Start()
+	return nil
+}
+
+//Close stops the queue, abandoning the deliveries in progress that are
+//retried when it starts again, and the webhooks once the events waiting
+//were sent
+func (mss *MailSenderService) Close() {
+	if mss.queue != nil {
+		mss.queue.Stop()
+	}
+	mss.events().close()
+}
+
+//Run starts the service with a REST Api. On SIGINT or SIGTERM it stops
+//taking requests and closes the service.
 func (mss *MailSenderService) Run() error {
 	var caCert []byte
 	var caCertPool *x509.CertPool
 	var err error
-	var server *http.Server
 	var tlsConfig *tls.Config
 
+	if err = mss.StartQueue(); err != nil {
+		log.Fatalf("Queue can't be used: %s", err.Error())
+	}
+	defer mss.Close()
+
+	go mss.watchTemplates(nil)
+
 	http.HandleFunc("/sendmail", mss.SendMailMessage)
+	http.HandleFunc("/sendbatch", mss.SendBatchMessage)
+	http.HandleFunc("/messages", mss.ListMessages)
+	http.HandleFunc("/messages/", mss.GetMessage)
+	http.HandleFunc("/transport/messages", mss.ListCaptured)
+	http.HandleFunc("/transport/messages/", mss.GetCaptured)
+	if mss.Setup.Catcher {
+		http.HandleFunc(catcherPath, mss.Catcher)
+	}
+
+	//the service is closed once the requests in progress are answered
+	server := &http.Server{Addr: fmt.Sprintf(":%d", mss.Setup.Port)}
+	shutdown := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down")
+		server.Shutdown(context.Background())
+		close(shutdown)
+	}()
 
 	//load the CAFile to authenticate the clients if needed
 	if mss.Setup.CAFile != "" {
@@ -243,18 +761,15 @@ func (mss *MailSenderService) Run() error {
 			}
 		}
 		tlsConfig.BuildNameToCertificate()
-		server = &http.Server{
-			TLSConfig: tlsConfig,
-			Addr:      fmt.Sprintf(":%d", mss.Setup.Port),
-		}
-		server.ListenAndServeTLS(mss.Setup.CertFile, mss.Setup.KeyFile)
+		server.TLSConfig = tlsConfig
+		err = server.ListenAndServeTLS(mss.Setup.CertFile, mss.Setup.KeyFile)
 	} else {
 		//start the server without tls
-		server = &http.Server{
-			Addr: fmt.Sprintf(":%d", mss.Setup.Port),
-		}
-		server.ListenAndServe()
+		err = server.ListenAndServe()
 	}
-
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-shutdown
 	return nil
 }
@@ -2,9 +2,13 @@ package service
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/mail"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/adiclepcea/mailsender"
 	"github.com/stretchr/testify/assert"
@@ -16,21 +20,26 @@ type MyMailSender struct {
 	mailsender.MailSender
 }
 
-func (m *MyMailSender) SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms mailsender.MailStruct) (int, error) {
+func (m *MyMailSender) SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms mailsender.MailStruct) (*mailsender.Result, error) {
 	args := m.Called(server, tlsconfig, usermail, pass, ms)
-	return args.Int(0), args.Error(1)
+	return args.Get(0).(*mailsender.Result), args.Error(1)
 }
 
-func (m *MyMailSender) SendMail(server string, usermail string, pass string, ms mailsender.MailStruct) (int, error) {
+func (m *MyMailSender) SendMailStartTLS(server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms mailsender.MailStruct) (*mailsender.Result, error) {
+	args := m.Called(server, tlsconfig, mandatory, usermail, pass, ms)
+	return args.Get(0).(*mailsender.Result), args.Error(1)
+}
+
+func (m *MyMailSender) SendMail(server string, usermail string, pass string, ms mailsender.MailStruct) (*mailsender.Result, error) {
 	args := m.Called(server, usermail, pass, ms)
-	return args.Int(0), args.Error(1)
+	return args.Get(0).(*mailsender.Result), args.Error(1)
 }
 
-func (m *MyMailSender) SendMailWithoutAuth(server string, ms mailsender.MailStruct) (int, error) {
+func (m *MyMailSender) SendMailWithoutAuth(server string, ms mailsender.MailStruct) (*mailsender.Result, error) {
 	log.Println("Called")
 	args := m.Called(server, ms)
 	log.Println("Returning")
-	return args.Int(0), args.Error(1)
+	return args.Get(0).(*mailsender.Result), args.Error(1)
 }
 
 func TestServiceSendMail(t *testing.T) {
@@ -51,13 +60,13 @@ func TestServiceSendMail(t *testing.T) {
 
 	ms := mailsender.MailStruct{}
 	ms.From = mail.Address{Name: "", Address: "src@server.com"}
-	ms.To = mail.Address{Name: "", Address: "dest@server.com"}
+	ms.To = []mail.Address{{Name: "", Address: "dest@server.com"}}
 	ms.Password = "secret"
 
 	mockMailSender := new(MyMailSender)
-	mockMailSender.On("SendMail", "exampleserver.com:654", "src@server.com", "secret", ms).Return(10, nil)
-	mockMailSender.On("SendMailTLS", "exampleserver.com:654", mailsender.CreateInsecureTLSConfig("exampleserver.com"), "src@server.com", "secret", ms).Return(11, nil)
-	mockMailSender.On("SendMailWithoutAuth", "exampleserver.com:654", ms).Return(12, nil)
+	mockMailSender.On("SendMail", "exampleserver.com:654", "src@server.com", "secret", ms).Return(&mailsender.Result{Bytes: 10}, nil)
+	mockMailSender.On("SendMailTLS", "exampleserver.com:654", mailsender.CreateInsecureTLSConfig("exampleserver.com"), "src@server.com", "secret", ms).Return(&mailsender.Result{Bytes: 11}, nil)
+	mockMailSender.On("SendMailWithoutAuth", "exampleserver.com:654", ms).Return(&mailsender.Result{Bytes: 12}, nil)
 
 	err := serv.SendMail(mockMailSender, ms)
 
@@ -110,3 +119,161 @@ func TestCreateMailSenderServiceShouldOK(t *testing.T) {
 	assert.Equal(8080, mss.Setup.Port, "Expected 8080, got %s\n", mss.Setup.Port)
 
 }
+
+func TestValidateMailStructRecipients(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{DefaultMail: "mail@exampleserver.com"}}
+
+	_, err := serv.ValidateMailStruct(&mailsender.MailStruct{})
+	assert.NotNil(err, "Error expected for a mail without recipients, got nil\n")
+
+	ms := mailsender.MailStruct{
+		To:  []mail.Address{{Address: "to@server.com"}},
+		Cc:  []mail.Address{{Address: "cc@server.com"}},
+		Bcc: []mail.Address{{Address: "not an address"}},
+	}
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.NotNil(err, "Error expected for an invalid Bcc address, got nil\n")
+
+	ms.Bcc = []mail.Address{{Address: "bcc@server.com"}}
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.Nil(err, "No error expected for valid recipients, got %v\n", err)
+
+	ms = mailsender.MailStruct{Bcc: []mail.Address{{Address: "bcc@server.com"}}}
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.Nil(err, "No error expected when only Bcc is set, got %v\n", err)
+}
+
+func TestValidateMailStructMessageID(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{DefaultMail: "mail@exampleserver.com"}}
+
+	ms := mailsender.MailStruct{To: []mail.Address{{Address: "to@server.com"}}}
+	_, err := serv.ValidateMailStruct(&ms)
+	assert.Nil(err)
+	assert.True(strings.HasSuffix(ms.MessageID, "@exampleserver.com"), "Unexpected Message-ID %s", ms.MessageID)
+
+	serv.Mail.MessageIDDomain = "mailer.exampleserver.com"
+	ms = mailsender.MailStruct{To: []mail.Address{{Address: "to@server.com"}}}
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.Nil(err)
+	assert.True(strings.HasSuffix(ms.MessageID, "@mailer.exampleserver.com"), "Unexpected Message-ID %s", ms.MessageID)
+
+	ms.MessageID = "given@server.com"
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.Nil(err)
+	assert.Equal("given@server.com", ms.MessageID)
+}
+
+func TestValidateMailStructHeaders(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{Mail: MailSetup{DefaultMail: "mail@exampleserver.com"}}
+
+	var ms mailsender.MailStruct
+	payload := `{"To":[{"Address":"to@server.com"}],"ReplyTo":[{"Address":"tickets@server.com"}],
+		"InReplyTo":"1@server.com","References":["0@server.com","1@server.com"],
+		"Headers":{"X-Ticket":"42","List-Unsubscribe":"<mailto:unsubscribe@server.com>"}}`
+	assert.Nil(json.Unmarshal([]byte(payload), &ms))
+	_, err := serv.ValidateMailStruct(&ms)
+	assert.Nil(err, "No error expected for valid headers, got %v\n", err)
+	assert.Equal("tickets@server.com", ms.ReplyTo[0].Address)
+	assert.Equal("42", ms.Headers["X-Ticket"])
+
+	ms.Headers["X-Ticket"] = "42\r\nBcc: victim@server.com"
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.NotNil(err, "Error expected for a header with a line break, got nil\n")
+
+	ms.Headers = map[string]string{"Content-Type": "text/html"}
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.NotNil(err, "Error expected when setting a reserved header, got nil\n")
+
+	ms.Headers = nil
+	ms.ReplyTo = []mail.Address{{Address: "not an address"}}
+	_, err = serv.ValidateMailStruct(&ms)
+	assert.NotNil(err, "Error expected for an invalid Reply-To, got nil\n")
+}
+
+func TestServiceSendMailStartTLS(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{
+		Setup: Setup{Port: 8080},
+		Mail: MailSetup{
+			Server:         "exampleserver.com:587",
+			UseInsecureTLS: true,
+			UseAUTH:        true,
+			TLSMode:        mailsender.TLSStartTLS,
+		},
+	}
+
+	ms := mailsender.MailStruct{}
+	ms.From = mail.Address{Name: "", Address: "src@server.com"}
+	ms.To = []mail.Address{{Name: "", Address: "dest@server.com"}}
+	ms.Password = "secret"
+	tlsconfig := mailsender.CreateInsecureTLSConfig("exampleserver.com")
+
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMailStartTLS", "exampleserver.com:587", tlsconfig, true, "src@server.com", "secret", ms).Return(&mailsender.Result{}, nil)
+	mockMailSender.On("SendMailStartTLS", "exampleserver.com:587", tlsconfig, false, "", "secret", ms).Return(&mailsender.Result{}, nil)
+
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	serv.Mail.TLSMode = mailsender.TLSOpportunistic
+	serv.Mail.UseAUTH = false
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	mockMailSender.AssertExpectations(t)
+}
+
+func TestCreateMailSenderServiceTLSMode(t *testing.T) {
+	assert := assert.New(t)
+	config := `{"mailsetup":{"server":"exampleserver.com:587","tlsmode":"%s","useauth":%t},"servicesetup":{"port":8080}}`
+
+	mss, err := NewMailSenderService(fmt.Sprintf(config, "starttls", true))
+	assert.Nil(err, "No error expected for tlsmode starttls, got %v\n", err)
+	assert.Equal(mailsender.TLSStartTLS, mss.Mail.TLSMode)
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, "sometimes", true))
+	assert.NotNil(err, "Error expected for an unknown tlsmode, got nil\n")
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, "implicit", false))
+	assert.NotNil(err, "Error expected for implicit tls without auth, got nil\n")
+}
+
+func TestCreateMailSenderServiceAuthMechanism(t *testing.T) {
+	assert := assert.New(t)
+	config := `{"mailsetup":{"server":"exampleserver.com:587","authmechanism":"%s"},"servicesetup":{"port":8080}}`
+
+	mss, err := NewMailSenderService(fmt.Sprintf(config, "LOGIN"))
+	assert.Nil(err, "No error expected for authmechanism LOGIN, got %v\n", err)
+	assert.Equal("LOGIN", mss.Mail.AuthMechanism)
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, "DIGEST-MD5"))
+	assert.NotNil(err, "Error expected for an unsupported authmechanism, got nil\n")
+}
+
+func TestCreateMailSenderServiceTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	config := `{"mailsetup":{"server":"exampleserver.com:587","timeouts":{"dial":%d,"command":30,"data":120}},"servicesetup":{"port":8080}}`
+
+	mss, err := NewMailSenderService(fmt.Sprintf(config, 10))
+	assert.Nil(err, "No error expected for valid timeouts, got %v\n", err)
+
+	impl, ok := mss.newMailSender("src@server.com").(*mailsender.Impl)
+	assert.True(ok)
+	assert.Equal(mailsender.Timeouts{Dial: 10 * time.Second, Command: 30 * time.Second, Data: 120 * time.Second}, impl.Timeouts)
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, -1))
+	assert.NotNil(err, "Error expected for a negative timeout, got nil\n")
+}
+
+func TestCreateMailSenderServiceDirect(t *testing.T) {
+	assert := assert.New(t)
+	config := `{"mailsetup":{"direct":true,"localname":"mail.server.com","useauth":%t},"servicesetup":{"port":8080}}`
+
+	mss, err := NewMailSenderService(fmt.Sprintf(config, false))
+	assert.Nil(err, "No server is needed for direct delivery, got %v\n", err)
+	ds := mss.newDirectSender()
+	assert.Equal("mail.server.com", ds.LocalName)
+	assert.Nil(ds.Resolver)
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, true))
+	assert.NotNil(err, "Error expected for direct delivery with authentication, got nil\n")
+}
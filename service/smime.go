@@ -0,0 +1,43 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//SMIMESetup is the certificate signing with S/MIME the mails sent from
+//a domain
+type SMIMESetup struct {
+	Domain string `json:"domain"`
+	//CertFile is the PEM file of the certificate followed by its chain
+	CertFile string `json:"certfile"`
+	//KeyFile is the PEM file of the RSA or ECDSA private key
+	KeyFile string `json:"keyfile"`
+}
+
+//loadSMIME reads the S/MIME certificates of the setup
+func (mss *MailSenderService) loadSMIME() error {
+	for _, setup := range mss.Mail.SMIME {
+		if setup.Domain == "" || setup.CertFile == "" || setup.KeyFile == "" {
+			return fmt.Errorf("Invalid S/MIME setup for %s", setup.Domain)
+		}
+		signer, err := mailsender.LoadSMIMESigner(setup.CertFile, setup.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Invalid S/MIME certificate for %s: %s", setup.Domain, err.Error())
+		}
+		if mss.smime == nil {
+			mss.smime = make(map[string]*mailsender.SMIMESigner)
+		}
+		mss.smime[strings.ToLower(setup.Domain)] = signer
+	}
+	return nil
+}
+
+//smimeSigner returns the S/MIME signer of the domain of address, nil
+//when the mails of the domain are not signed
+func (mss *MailSenderService) smimeSigner(address string) *mailsender.SMIMESigner {
+	domain := address[strings.LastIndex(address, "@")+1:]
+	return mss.smime[strings.ToLower(domain)]
+}
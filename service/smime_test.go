@@ -0,0 +1,73 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestServiceSMIME(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "smime")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "src@example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.Nil(err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(err)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.Nil(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.Nil(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600))
+	config := `{"mailsetup":{"server":"exampleserver.com:25","smime":[{"domain":"example.com","certfile":%q,"keyfile":%q}]},
+		"servicesetup":{"port":8080}}`
+
+	serv, err := NewMailSenderService(fmt.Sprintf(config, certFile, keyFile))
+	assert.Nil(err)
+	assert.Nil(serv.smimeSigner("src@other.com"))
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@Example.com"},
+		To:   []mail.Address{{Address: "dest@server.com"}},
+	}
+	mockMailSender := new(MyMailSender)
+	mockMailSender.On("SendMailWithoutAuth", "exampleserver.com:25", mock.Anything).Return(&mailsender.Result{}, nil)
+	assert.Nil(serv.SendMail(mockMailSender, ms))
+	sent := mockMailSender.Calls[0].Arguments.Get(1).(mailsender.MailStruct)
+	assert.NotNil(sent.SMIME, "The mail should be signed")
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, keyFile, keyFile))
+	assert.NotNil(err, "Expected an error for a missing certificate")
+
+	keyring := filepath.Join(dir, "keyring")
+	assert.Nil(os.Mkdir(keyring, 0755))
+	assert.Nil(ioutil.WriteFile(filepath.Join(keyring, "alerts.asc"), []byte(pgpPublicKey), 0644))
+	config = `{"mailsetup":{"server":"exampleserver.com:25","smime":[{"domain":"example.com","certfile":%q,"keyfile":%q}],
+		"pgp":{"keyring":%q,"requireencryption":true}},"servicesetup":{"port":8080}}`
+	_, err = NewMailSenderService(fmt.Sprintf(config, certFile, keyFile, keyring))
+	assert.NotNil(err, "The mails signed with S/MIME would not be encrypted")
+}
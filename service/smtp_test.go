@@ -0,0 +1,83 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+//TestServiceSMTP sends through a real SMTP session, where the other
+//tests replace the sender with a mock
+func TestServiceSMTP(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewUnstartedServer()
+	server.STARTTLS = true
+	server.Users = map[string]string{"mail@exampleserver.com": "secret"}
+	server.Start()
+	defer server.Close()
+
+	serv, err := NewMailSenderService(fmt.Sprintf(`{"mailsetup":{"server":%q,"tlsmode":"starttls","insecuretls":true,
+		"useauth":true,"defaultmail":"mail@exampleserver.com","defaultpassword":"secret"},"servicesetup":{"port":8080}}`, server.Addr))
+	assert.Nil(err)
+
+	body := `{"To":[{"Address":"dest@server.com"}],"Subject":"Invoice",
+		"Body":"Attached","Attachments":[{"Filename":"invoice.txt","Data":"SW52b2ljZQ=="}]}`
+	w := httptest.NewRecorder()
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/send", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+	messages := server.Messages()
+	if assert.Equal(1, len(messages)) {
+		m := messages[0]
+		assert.True(m.TLS)
+		assert.Equal("mail@exampleserver.com", m.User)
+		assert.Equal([]string{"dest@server.com"}, m.To)
+		assert.Equal("Invoice", m.Subject)
+		assert.Equal(w.Header().Get("Message-ID"), m.Header.Get("Message-ID"))
+		assert.Equal("Attached", m.Text)
+		if attachment := m.Attachment("invoice.txt"); assert.NotNil(attachment) {
+			assert.Equal("Invoice", string(attachment.Data))
+		}
+	}
+
+	server.FailData(451, "4.3.0 Try again later")
+	w = httptest.NewRecorder()
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/send", bytes.NewBufferString(body)))
+	assert.NotEqual(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), "Try again later")
+}
+
+func TestServiceSMTPFailoverReader(t *testing.T) {
+	assert := assert.New(t)
+	first := mailsendertest.NewServer()
+	defer first.Close()
+	second := mailsendertest.NewServer()
+	defer second.Close()
+	first.FailCommand(".", 451, "4.3.0 Try again later")
+
+	serv := MailSenderService{Mail: MailSetup{Relays: []Relay{{Server: first.Addr}, {Server: second.Addr, Priority: 1}}}}
+	ms := mailsender.MailStruct{
+		From:        mail.Address{Address: "src@server.com"},
+		To:          []mail.Address{{Address: "dest@server.com"}},
+		Subject:     "statement",
+		Attachments: []mailsender.Attachment{mailsender.AttachReader("statement.csv", strings.NewReader("date,amount\n"))},
+	}
+	//the content refused by the first relay is sent again to the second
+	assert.Nil(serv.SendMail(&mailsender.Impl{}, ms))
+
+	assert.Empty(first.Messages())
+	messages := second.Messages()
+	if assert.Equal(1, len(messages)) {
+		if attachment := messages[0].Attachment("statement.csv"); assert.NotNil(attachment) {
+			assert.Equal("date,amount\n", string(attachment.Data))
+		}
+	}
+}
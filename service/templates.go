@@ -0,0 +1,84 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//defaultTemplateReload is the time between two checks of the template files
+const defaultTemplateReload = 5 * time.Second
+
+//TemplateSetup is the directory of the templates the mails can be
+//rendered from, laid out as described by mailsender.Templates
+type TemplateSetup struct {
+	Dir string `json:"dir"`
+	//Reload is the number of seconds between two checks for changed
+	//files, 5 when it is 0
+	Reload int `json:"reload"`
+}
+
+//TemplateRequest names the template a mail is rendered from and the
+//data it is executed with
+type TemplateRequest struct {
+	Template string                 `json:"template"`
+	Locale   string                 `json:"locale"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+//loadTemplates parses the templates of the setup, if there are any
+func (mss *MailSenderService) loadTemplates() error {
+	if mss.Setup.Templates.Dir == "" {
+		return nil
+	}
+	if mss.Setup.Templates.Reload < 0 {
+		return fmt.Errorf("Invalid templates reload %d", mss.Setup.Templates.Reload)
+	}
+	templates, err := mailsender.LoadTemplates(mss.Setup.Templates.Dir)
+	if err != nil {
+		return err
+	}
+	mss.templates = templates
+	return nil
+}
+
+//watchTemplates reloads the templates when their files change, until
+//stop is closed
+func (mss *MailSenderService) watchTemplates(stop <-chan struct{}) {
+	if mss.templates == nil {
+		return
+	}
+	interval := time.Duration(mss.Setup.Templates.Reload) * time.Second
+	if interval == 0 {
+		interval = defaultTemplateReload
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := mss.templates.Reload()
+			if err != nil {
+				log.Printf("Templates not reloaded: %v", err)
+			} else if reloaded {
+				log.Printf("Templates reloaded: %v", mss.templates.Names())
+			}
+		}
+	}
+}
+
+//render sets the subject and the bodies of the mail from the template
+//of the request, when it names one
+func (mss *MailSenderService) render(ms *mailsender.MailStruct, tr TemplateRequest) error {
+	if tr.Template == "" {
+		return nil
+	}
+	if mss.templates == nil {
+		return fmt.Errorf("No templates are configured")
+	}
+	return mss.templates.Render(ms, tr.Template, tr.Locale, tr.Data)
+}
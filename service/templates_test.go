@@ -0,0 +1,117 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTemplates(t *testing.T) (string, *mailsender.Templates) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"welcome/subject.txt":    "Welcome {{.name}}",
+		"welcome/text.txt":       "Hello {{.name}}",
+		"welcome/html.html":      "<p>Hello {{.name}}</p>",
+		"welcome/ro/subject.txt": "Bun venit {{.name}}",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	templates, err := mailsender.LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, templates
+}
+
+func TestSendMailMessageTemplate(t *testing.T) {
+	assert := assert.New(t)
+	dir, templates := newTestTemplates(t)
+	defer os.RemoveAll(dir)
+	queueDir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(queueDir)
+
+	serv := MailSenderService{Mail: MailSetup{Server: "exampleserver.com:25", DefaultMail: "mail@exampleserver.com"}}
+	serv.templates = templates
+	serv.queue = newTestQueue(t, queueDir, newRecordingSend().send)
+
+	w := httptest.NewRecorder()
+	body := `{"To":[{"Address":"dest@server.com"}],"template":"welcome","locale":"ro-RO","data":{"name":"Ana"}}`
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	var response AcceptedResponse
+	assert.Nil(json.NewDecoder(w.Body).Decode(&response))
+	qm, err := readMessage(filepath.Join(queueDir, "queue", response.ID+".json"))
+	assert.Nil(err)
+	assert.Equal("Bun venit Ana", qm.Mail.Subject)
+	assert.Equal("Hello Ana", qm.Mail.Body)
+	assert.Equal("<p>Hello Ana</p>", qm.Mail.HTMLBody)
+
+	for _, body := range []string{
+		`{"To":[{"Address":"dest@server.com"}],"template":"goodbye","data":{"name":"Ana"}}`,
+		`{"To":[{"Address":"dest@server.com"}],"template":"welcome","data":{}}`,
+	} {
+		w = httptest.NewRecorder()
+		serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+		assert.Equal(http.StatusBadRequest, w.Code, "Expected %s to be refused", body)
+	}
+
+	serv.templates = nil
+	w = httptest.NewRecorder()
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusBadRequest, w.Code, "Expected an error without templates")
+}
+
+func TestSendBatchMessageTemplate(t *testing.T) {
+	assert := assert.New(t)
+	dir, templates := newTestTemplates(t)
+	defer os.RemoveAll(dir)
+
+	//nothing listens on the port, so the rendered mail can not be sent
+	serv := MailSenderService{Mail: MailSetup{Server: "127.0.0.1:1", DefaultMail: "mail@exampleserver.com"}}
+	serv.templates = templates
+
+	body := `[{"To":[{"Address":"ana@server.com"}],"template":"welcome","data":{"name":"Ana"}},
+		{"To":[{"Address":"ion@server.com"}],"template":"welcome","data":{"nume":"Ion"}}]`
+	w := httptest.NewRecorder()
+	serv.SendBatchMessage(w, httptest.NewRequest(http.MethodPost, "/sendbatch", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code)
+
+	var items []BatchItemResponse
+	assert.Nil(json.NewDecoder(w.Body).Decode(&items))
+	assert.Equal(2, len(items))
+	assert.Equal(http.StatusServiceUnavailable, items[0].Status)
+	assert.Equal(http.StatusBadRequest, items[1].Status, "The data of the second mail lacks the name")
+}
+
+func TestCreateMailSenderServiceTemplates(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := newTestTemplates(t)
+	defer os.RemoveAll(dir)
+	config := `{"mailsetup":{"server":"exampleserver.com:25"},"servicesetup":{"port":8080,"templates":{"dir":%q}}}`
+
+	mss, err := NewMailSenderService(fmt.Sprintf(config, dir))
+	assert.Nil(err)
+	assert.Equal([]string{"welcome", "welcome/ro"}, mss.templates.Names())
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, filepath.Join(dir, "missing")))
+	assert.NotNil(err, "Expected an error for a missing template directory")
+}
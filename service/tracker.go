@@ -0,0 +1,100 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//maxTracked is the number of mails sent without the queue kept for
+///messages, the oldest being dropped first
+const maxTracked = 10000
+
+//tracker keeps the status of the mails sent without the queue so that
+///messages describes them too. Only the fields shown by /messages are
+//kept, in memory, so the mails are forgotten when the service stops.
+type tracker struct {
+	mu       sync.Mutex
+	messages map[string]*QueuedMessage
+	//order holds the ids, the oldest first
+	order []string
+}
+
+func newTracker() *tracker {
+	return &tracker{messages: make(map[string]*QueuedMessage)}
+}
+
+//add records ms as being sent and returns its id
+func (t *tracker) add(ms mailsender.MailStruct) (string, error) {
+	id, err := newQueueID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	qm := &QueuedMessage{
+		ID: id,
+		Mail: mailsender.MailStruct{
+			MessageID: ms.MessageID,
+			From:      ms.From,
+			To:        ms.To,
+			Cc:        ms.Cc,
+			Bcc:       ms.Bcc,
+			Subject:   ms.Subject,
+		},
+		Status:  StatusSending,
+		Created: now,
+		Updated: now,
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages[id] = qm
+	t.order = append(t.order, id)
+	if len(t.order) > maxTracked {
+		delete(t.messages, t.order[0])
+		t.order = t.order[1:]
+	}
+	return id, nil
+}
+
+//finish records the outcome of the attempt sending the mail with the id
+func (t *tracker) finish(id string, attempt Attempt, result *mailsender.Result, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	qm, ok := t.messages[id]
+	if !ok {
+		return
+	}
+	qm.Attempts = append(qm.Attempts, attempt)
+	qm.Updated = time.Now()
+	if result != nil {
+		for _, rejected := range result.Rejected {
+			qm.Failed = append(qm.Failed, RejectedRecipient{Address: rejected.Address.Address, Error: rejected.Err.Error()})
+		}
+	}
+	if err != nil {
+		qm.Status = StatusFailed
+		qm.LastError = err.Error()
+		return
+	}
+	qm.Status = StatusDelivered
+}
+
+//Get returns the mail with the id
+func (t *tracker) Get(id string) (QueuedMessage, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	qm, ok := t.messages[id]
+	if !ok {
+		return QueuedMessage{}, false
+	}
+	return *qm, true
+}
+
+//List returns the mails selected by filter, the newest first
+func (t *tracker) List(filter MessageFilter) []QueuedMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return filter.list(t.messages)
+}
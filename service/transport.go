@@ -0,0 +1,150 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//The transports the mails can be delivered with
+const (
+	TransportSMTP   = "smtp"
+	TransportFile   = "file"
+	TransportLog    = "log"
+	TransportMemory = "memory"
+)
+
+//TransportSetup replaces the SMTP delivery, so that no real mail
+//leaves a development or staging environment
+type TransportSetup struct {
+	//Type is smtp, the default, file, log or memory
+	Type string `json:"type"`
+	//Dir is the directory the file transport writes the .eml files in
+	Dir string `json:"dir"`
+	//Limit is the number of mails the memory transport keeps, 1000 when
+	//it is 0
+	Limit int `json:"limit"`
+}
+
+//usesSMTP tells if the mails are sent to mail servers
+func (ts TransportSetup) usesSMTP() bool {
+	return ts.Type == "" || ts.Type == TransportSMTP
+}
+
+//loadTransport creates the transport of the setup
+func (mss *MailSenderService) loadTransport() error {
+	setup := mss.Mail.Transport
+	switch setup.Type {
+	case "", TransportSMTP:
+	case TransportFile:
+		if setup.Dir == "" {
+			return fmt.Errorf("The file transport needs a dir")
+		}
+		mss.transport = &mailsender.FileTransport{Dir: setup.Dir}
+	case TransportLog:
+		mss.transport = &mailsender.LogTransport{}
+	case TransportMemory:
+		if setup.Limit < 0 {
+			return fmt.Errorf("Invalid transport limit %d", setup.Limit)
+		}
+		mss.memory = &mailsender.MemoryTransport{Limit: setup.Limit}
+		mss.transport = mss.memory
+	default:
+		return fmt.Errorf("Invalid transport %s", setup.Type)
+	}
+	return nil
+}
+
+//ListCaptured is the method that links GET /transport/messages to the
+//memory transport. The mails can be filtered with the from, recipient
+//and subject parameters, matching parts of them, and with since and
+//until in RFC 3339 format. limit sets how many of them are listed, the
+//newest first. DELETE drops all the mails.
+func (mss *MailSenderService) ListCaptured(w http.ResponseWriter, r *http.Request) {
+	if mss.memory == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("The mails are only kept by the memory transport"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		mss.memory.Clear()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Sorry, only GET and DELETE allowed!"))
+		return
+	}
+
+	query, err := parseMailQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	list := mss.memory.Messages(query)
+	if list == nil {
+		list = []mailsender.CapturedMail{}
+	}
+	writeJSON(w, list)
+}
+
+//GetCaptured is the method that links GET /transport/messages/{id} to
+//the memory transport. It answers the description of the mail, or the
+//mail itself as message/rfc822 for /transport/messages/{id}.eml.
+func (mss *MailSenderService) GetCaptured(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Sorry, only GET allowed!"))
+		return
+	}
+	if mss.memory == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("The mails are only kept by the memory transport"))
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/transport/messages/")
+	raw := strings.HasSuffix(id, ".eml")
+	cm, ok := mss.memory.Message(strings.TrimSuffix(id, ".eml"))
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No mail with the id %s", id))
+		return
+	}
+	if !raw {
+		writeJSON(w, cm)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Write(cm.Raw)
+}
+
+//parseMailQuery reads the query of a /transport/messages request
+func parseMailQuery(r *http.Request) (mailsender.MailQuery, error) {
+	values := r.URL.Query()
+	query := mailsender.MailQuery{
+		From:      values.Get("from"),
+		Recipient: values.Get("recipient"),
+		Subject:   values.Get("subject"),
+		Limit:     defaultListLimit,
+	}
+
+	var err error
+	if since := values.Get("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return query, fmt.Errorf("Invalid since: %s", err.Error())
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return query, fmt.Errorf("Invalid until: %s", err.Error())
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return query, fmt.Errorf("Invalid limit %s", limit)
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceMemoryTransport(t *testing.T) {
+	assert := assert.New(t)
+	//no mail server is needed with another transport
+	serv, err := NewMailSenderService(`{"mailsetup":{"defaultmail":"dev@localhost","transport":{"type":"memory"}},"servicesetup":{"port":8080}}`)
+	assert.Nil(err)
+
+	for _, subject := range []string{"Welcome", "Reset your password"} {
+		body := fmt.Sprintf(`{"To":[{"Address":"user@server.com"}],"Subject":%q,"Body":"Hello"}`, subject)
+		w := httptest.NewRecorder()
+		serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+		assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	serv.ListCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages?subject=password", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	var list []mailsender.CapturedMail
+	assert.Nil(json.NewDecoder(w.Body).Decode(&list))
+	if assert.Equal(1, len(list)) {
+		assert.Equal("dev@localhost", list[0].From)
+		assert.Equal([]string{"user@server.com"}, list[0].Recipients)
+	}
+
+	w = httptest.NewRecorder()
+	serv.GetCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages/"+list[0].ID+".eml", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("message/rfc822", w.Header().Get("Content-Type"))
+	assert.Contains(w.Body.String(), "Subject: Reset your password\r\n")
+	w = httptest.NewRecorder()
+	serv.GetCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages/"+list[0].ID, nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `"subject":"Reset your password"`)
+	w = httptest.NewRecorder()
+	serv.GetCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages/42", nil))
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	serv.ListCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages?limit=0", nil))
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	serv.ListCaptured(w, httptest.NewRequest(http.MethodDelete, "/transport/messages", nil))
+	assert.Equal(http.StatusNoContent, w.Code)
+	w = httptest.NewRecorder()
+	serv.ListCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages", nil))
+	assert.Equal("[]\n", w.Body.String())
+}
+
+func TestServiceTransportSetup(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "transport")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	config := `{"mailsetup":{"defaultmail":"dev@localhost","transport":%s},"servicesetup":{"port":8080}}`
+	serv, err := NewMailSenderService(fmt.Sprintf(config, fmt.Sprintf(`{"type":"file","dir":%q}`, dir)))
+	assert.Nil(err)
+	body := `{"To":[{"Address":"user@server.com"}],"Subject":"Welcome","Body":"Hello"}`
+	w := httptest.NewRecorder()
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(err)
+	assert.Equal(1, len(files))
+
+	w = httptest.NewRecorder()
+	serv.ListCaptured(w, httptest.NewRequest(http.MethodGet, "/transport/messages", nil))
+	assert.Equal(http.StatusNotFound, w.Code, "Only the memory transport keeps the mails")
+
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"type":"log"}`))
+	assert.Nil(err)
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"type":"file"}`))
+	assert.NotNil(err, "The file transport needs a dir")
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"type":"pigeon"}`))
+	assert.NotNil(err)
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"type":"smtp"}`))
+	assert.NotNil(err, "The smtp transport needs a server")
+}
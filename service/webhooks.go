@@ -0,0 +1,386 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+)
+
+//The events sent to the webhooks
+const (
+	//EventAccepted is sent when the service takes a mail
+	EventAccepted = "accepted"
+	//EventDelivered is sent when the mail server takes the mail
+	EventDelivered = "delivered"
+	//EventDeferred is sent when a queued mail will be retried
+	EventDeferred = "deferred"
+	//EventBounced is sent when the mail server refuses the mail
+	EventBounced = "bounced"
+	//EventFailed is sent when the mail can not be delivered for any
+	//other reason, as when it is too old to be retried
+	EventFailed = "failed"
+)
+
+//The headers of the webhook requests
+const (
+	//SignatureHeader holds "sha256=" followed by the hex encoded
+	//HMAC-SHA256 of the timestamp, a dot and the body, keyed with the
+	//secret of the webhook
+	SignatureHeader = "X-Mailsender-Signature"
+	//TimestampHeader holds the Unix time the request was signed at
+	TimestampHeader = "X-Mailsender-Timestamp"
+)
+
+//The defaults of the webhook deliveries
+const (
+	defaultWebhookRetries = 5
+	webhookRetryInitial   = time.Second
+	webhookTimeout        = 10 * time.Second
+	//webhookWorkers is the number of requests sent at the same time and
+	//webhookBacklog the number of requests waiting for a worker, beyond
+	//which the events are dropped
+	webhookWorkers = 4
+	webhookBacklog = 1000
+)
+
+//WebhookSetup is an URL receiving the events of the mails
+type WebhookSetup struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+	//Events lists the events sent to the URL, all of them when it is empty
+	Events []string `json:"events"`
+}
+
+//wants tells if the webhook receives event
+func (ws WebhookSetup) wants(event string) bool {
+	if len(ws.Events) == 0 {
+		return true
+	}
+	for _, e := range ws.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//validateWebhooks checks the webhooks of the setup. Every webhook and
+//the callbacks need a secret, as the receivers could not tell the events
+//from forged ones without the signature.
+func (s Setup) validateWebhooks() error {
+	for _, hook := range s.Webhooks {
+		if err := validateWebhookURL(hook.URL); err != nil {
+			return err
+		}
+		if hook.Secret == "" {
+			return fmt.Errorf("The webhook %s has no secret", hook.URL)
+		}
+		for _, event := range hook.Events {
+			switch event {
+			case EventAccepted, EventDelivered, EventDeferred, EventBounced, EventFailed:
+			default:
+				return fmt.Errorf("Invalid event %s for webhook %s", event, hook.URL)
+			}
+		}
+	}
+	if len(s.CallbackHosts) > 0 && s.CallbackSecret == "" {
+		return fmt.Errorf("The callbacks have no secret")
+	}
+	if s.WebhookRetries < 0 {
+		return fmt.Errorf("Invalid webhookretries %d", s.WebhookRetries)
+	}
+	return nil
+}
+
+//validateWebhookURL checks that rawurl is an http or https URL
+func validateWebhookURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid URL %s", rawurl)
+	}
+	return nil
+}
+
+//validateCallbackURL checks that rawurl, given by a client, is an http
+//or https URL on one of the allowed hosts. Without allowed hosts no
+//callback is accepted, as the service would post to any address the
+//clients give, its internal network included.
+func validateCallbackURL(rawurl string, allowedHosts []string) error {
+	if err := validateWebhookURL(rawurl); err != nil {
+		return err
+	}
+	if len(allowedHosts) == 0 {
+		return fmt.Errorf("Callbacks are not allowed")
+	}
+	u, _ := url.Parse(rawurl)
+	for _, host := range allowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("The callback host %s is not allowed", u.Hostname())
+}
+
+//Event is the JSON body posted to the webhooks
+type Event struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	//ID is the ID of the queued mail, empty when the queue is not used
+	ID          string     `json:"id,omitempty"`
+	MessageID   string     `json:"messageid"`
+	From        string     `json:"from"`
+	Recipients  []string   `json:"recipients"`
+	Attempts    int        `json:"attempts,omitempty"`
+	LastAttempt *Attempt   `json:"lastattempt,omitempty"`
+	NextAttempt *time.Time `json:"nextattempt,omitempty"`
+}
+
+//newEvent builds the event of a mail after the attempts to send it
+func newEvent(event string, id string, ms mailsender.MailStruct, attempts []Attempt) Event {
+	e := Event{Event: event, Time: time.Now(), ID: id, MessageID: ms.MessageID, From: ms.From.Address, Attempts: len(attempts)}
+	for _, recipient := range ms.Recipients() {
+		e.Recipients = append(e.Recipients, recipient.Address)
+	}
+	if len(attempts) > 0 {
+		last := attempts[len(attempts)-1]
+		e.LastAttempt = &last
+	}
+	return e
+}
+
+//events returns the webhooks of the service, created on first use
+func (mss *MailSenderService) events() *webhooks {
+	mss.webhooksOnce.Do(func() {
+		mss.webhooks = newWebhooks(mss.Setup)
+	})
+	return mss.webhooks
+}
+
+//notifyQueued sends the events of the queued messages
+func (mss *MailSenderService) notifyQueued(event string, qm QueuedMessage) {
+	e := newEvent(event, qm.ID, qm.Mail, qm.Attempts)
+	if event == EventDeferred {
+		next := qm.NextAttempt
+		e.NextAttempt = &next
+	}
+	mss.events().emit(e, qm.Callback)
+}
+
+//outcomeEvent returns the event telling the outcome of a final attempt
+//to send a mail
+func outcomeEvent(err error) string {
+	if err == nil {
+		return EventDelivered
+	}
+	var smtpErr *mailsender.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code >= 500 {
+		return EventBounced
+	}
+	return EventFailed
+}
+
+//webhooks posts the events to the configured webhooks and callbacks.
+//The requests are sent in the background by a few workers and retried
+//with an exponential backoff until the receiver answers with a 2xx
+//status. When the webhooks are closed the requests waiting are sent
+//once, without retry.
+type webhooks struct {
+	hooks          []WebhookSetup
+	callbackSecret string
+	client         *http.Client
+	retries        int
+	retryInitial   time.Duration
+
+	requests chan webhookRequest
+	stop     chan struct{}
+	mu       sync.Mutex
+	closed   bool
+	//pending counts the requests not sent yet and workers the running
+	//workers
+	pending sync.WaitGroup
+	workers sync.WaitGroup
+}
+
+//webhookRequest is an event waiting to be posted to url
+type webhookRequest struct {
+	url    string
+	secret string
+	body   []byte
+}
+
+//newWebhooks creates the webhooks of the setup and starts their workers
+func newWebhooks(setup Setup) *webhooks {
+	wh := &webhooks{
+		hooks:          setup.Webhooks,
+		callbackSecret: setup.CallbackSecret,
+		client:         &http.Client{Timeout: webhookTimeout},
+		retries:        setup.WebhookRetries,
+		retryInitial:   webhookRetryInitial,
+		requests:       make(chan webhookRequest, webhookBacklog),
+		stop:           make(chan struct{}),
+	}
+	if wh.retries == 0 {
+		wh.retries = defaultWebhookRetries
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		wh.workers.Add(1)
+		go wh.worker()
+	}
+	return wh
+}
+
+//emit sends the event to the webhooks wanting it and to callback, the
+//URL given with the mail, if it is set
+func (wh *webhooks) emit(event Event, callback string) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Could not encode the %s event of %s: %v", event.Event, event.MessageID, err)
+		return
+	}
+	for _, hook := range wh.hooks {
+		if hook.wants(event.Event) {
+			wh.post(hook.URL, hook.Secret, body)
+		}
+	}
+	if callback != "" {
+		wh.post(callback, wh.callbackSecret, body)
+	}
+}
+
+//post hands body to the workers, dropping it when too many requests
+//are waiting or the webhooks are closed
+func (wh *webhooks) post(url string, secret string, body []byte) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.closed {
+		log.Printf("Webhook %s dropped, the webhooks are closed", url)
+		return
+	}
+	wh.pending.Add(1)
+	select {
+	case wh.requests <- webhookRequest{url: url, secret: secret, body: body}:
+	default:
+		wh.pending.Done()
+		log.Printf("Webhook %s dropped, %d requests are waiting", url, webhookBacklog)
+	}
+}
+
+//worker sends the requests until the webhooks are closed, then sends
+//the ones left
+func (wh *webhooks) worker() {
+	defer wh.workers.Done()
+	for {
+		select {
+		case req := <-wh.requests:
+			wh.send(req)
+		case <-wh.stop:
+			wh.drain()
+			return
+		}
+	}
+}
+
+//send posts req, retrying on failure until the webhooks are closed
+func (wh *webhooks) send(req webhookRequest) {
+	defer wh.pending.Done()
+	delay := wh.retryInitial
+	for attempt := 1; ; attempt++ {
+		err := wh.postOnce(req.url, req.secret, req.body)
+		if err == nil {
+			return
+		}
+		if attempt > wh.retries {
+			log.Printf("Webhook %s given up: %v", req.url, err)
+			return
+		}
+		log.Printf("Webhook %s failed, retrying in %s: %v", req.url, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-wh.stop:
+			timer.Stop()
+			log.Printf("Webhook %s given up on close: %v", req.url, err)
+			return
+		}
+		delay *= 2
+	}
+}
+
+//drain posts the requests waiting once each
+func (wh *webhooks) drain() {
+	for {
+		select {
+		case req := <-wh.requests:
+			if err := wh.postOnce(req.url, req.secret, req.body); err != nil {
+				log.Printf("Webhook %s given up on close: %v", req.url, err)
+			}
+			wh.pending.Done()
+		default:
+			return
+		}
+	}
+}
+
+//close stops the workers once the requests waiting were sent
+func (wh *webhooks) close() {
+	wh.mu.Lock()
+	if !wh.closed {
+		wh.closed = true
+		close(wh.stop)
+	}
+	wh.mu.Unlock()
+	wh.workers.Wait()
+}
+
+//postOnce sends one signed request
+func (wh *webhooks) postOnce(url string, secret string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Status %s", resp.Status)
+	}
+	return nil
+}
+
+//wait waits for the requests handed to the workers
+func (wh *webhooks) wait() {
+	wh.pending.Wait()
+}
+
+//Sign returns the value of the SignatureHeader of a webhook request, so
+//that the receivers can check it
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/stretchr/testify/assert"
+)
+
+//eventReceiver is a webhook endpoint failing the first requests, then
+//recording the events it gets along with their signature
+type eventReceiver struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	failures int
+	events   []Event
+	badSigns int
+	received chan struct{}
+}
+
+func newEventReceiver(secret string, failures int) *eventReceiver {
+	er := &eventReceiver{secret: secret, failures: failures, received: make(chan struct{}, 100)}
+	er.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		er.mu.Lock()
+		defer er.mu.Unlock()
+		if er.failures > 0 {
+			er.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if Sign(er.secret, r.Header.Get(TimestampHeader), body) != r.Header.Get(SignatureHeader) {
+			er.badSigns++
+		}
+		var event Event
+		json.Unmarshal(body, &event)
+		er.events = append(er.events, event)
+		er.received <- struct{}{}
+	}))
+	return er
+}
+
+//wait waits for n events and returns the names of all the events received
+func (er *eventReceiver) wait(t *testing.T, n int) []string {
+	for i := 0; i < n; i++ {
+		select {
+		case <-er.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The event was not received")
+		}
+	}
+	er.mu.Lock()
+	defer er.mu.Unlock()
+	var names []string
+	for _, event := range er.events {
+		names = append(names, event.Event)
+	}
+	return names
+}
+
+func TestWebhookSignedAndRetried(t *testing.T) {
+	assert := assert.New(t)
+	receiver := newEventReceiver("secret", 2)
+	defer receiver.Close()
+
+	wh := newWebhooks(Setup{Webhooks: []WebhookSetup{{URL: receiver.URL, Secret: "secret"}}})
+	defer wh.close()
+	wh.retryInitial = 10 * time.Millisecond
+	wh.emit(newEvent(EventDelivered, "", queueMail(), nil), "")
+
+	assert.Equal([]string{EventDelivered}, receiver.wait(t, 1))
+	wh.wait()
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	assert.Equal(0, receiver.badSigns)
+	assert.Equal("1@server.com", receiver.events[0].MessageID)
+	assert.Equal([]string{"dest@server.com"}, receiver.events[0].Recipients)
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	assert := assert.New(t)
+	receiver := newEventReceiver("secret", 10)
+	defer receiver.Close()
+
+	wh := newWebhooks(Setup{Webhooks: []WebhookSetup{{URL: receiver.URL, Secret: "secret"}}, WebhookRetries: 1})
+	defer wh.close()
+	wh.retryInitial = time.Millisecond
+	wh.emit(newEvent(EventFailed, "", queueMail(), nil), "")
+	wh.wait()
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	assert.Equal(8, receiver.failures, "Expected one request and one retry")
+	assert.Len(receiver.events, 0)
+}
+
+func TestWebhookEventsFiltered(t *testing.T) {
+	assert := assert.New(t)
+	receiver := newEventReceiver("secret", 0)
+	defer receiver.Close()
+
+	wh := newWebhooks(Setup{Webhooks: []WebhookSetup{{URL: receiver.URL, Secret: "secret", Events: []string{EventBounced}}}})
+	defer wh.close()
+	wh.emit(newEvent(EventAccepted, "", queueMail(), nil), "")
+	wh.emit(newEvent(EventBounced, "", queueMail(), nil), "")
+	wh.wait()
+
+	assert.Equal([]string{EventBounced}, receiver.wait(t, 1))
+}
+
+func TestWebhookClose(t *testing.T) {
+	assert := assert.New(t)
+	receiver := newEventReceiver("secret", 1)
+	defer receiver.Close()
+
+	wh := newWebhooks(Setup{Webhooks: []WebhookSetup{{URL: receiver.URL, Secret: "secret"}}})
+	wh.retryInitial = time.Hour
+	wh.emit(newEvent(EventDelivered, "", queueMail(), nil), "")
+	for {
+		receiver.mu.Lock()
+		failures := receiver.failures
+		receiver.mu.Unlock()
+		if failures == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//the retry waiting is given up, the close does not wait for it
+	start := time.Now()
+	wh.close()
+	assert.True(time.Since(start) < time.Second, "The close should not wait for the retries")
+	wh.wait()
+
+	wh.emit(newEvent(EventFailed, "", queueMail(), nil), "")
+	wh.wait()
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	assert.Len(receiver.events, 0, "No event should be sent once the webhooks are closed")
+}
+
+func TestOutcomeEvent(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(EventDelivered, outcomeEvent(nil))
+	assert.Equal(EventBounced, outcomeEvent(&mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 550}))
+	assert.Equal(EventFailed, outcomeEvent(&mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451}))
+}
+
+func TestQueuedMailEventsToCallback(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "queue")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	receiver := newEventReceiver("callbacks", 0)
+	defer receiver.Close()
+
+	serv := MailSenderService{
+		Mail:  MailSetup{Server: "exampleserver.com:25", DefaultMail: "mail@exampleserver.com"},
+		Setup: Setup{CallbackSecret: "callbacks", CallbackHosts: []string{"127.0.0.1"}},
+	}
+	busy := &mailsender.SMTPError{Stage: mailsender.StageRcpt, Code: 451, Message: "Try again later"}
+	serv.queue = newTestQueue(t, dir, newRecordingSend(busy).send)
+	serv.queue.notify = serv.notifyQueued
+	serv.queue.Start()
+	defer serv.Close()
+
+	w := httptest.NewRecorder()
+	body := `{"To":[{"Address":"dest@server.com"}],"Subject":"tracked","callback":"` + receiver.URL + `"}`
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	events := receiver.wait(t, 3)
+	serv.events().wait()
+	//the requests are concurrent, so the events may arrive in any order
+	sort.Strings(events)
+	assert.Equal([]string{EventAccepted, EventDeferred, EventDelivered}, events)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	assert.Equal(0, receiver.badSigns)
+	for _, event := range receiver.events {
+		if event.Event == EventDeferred {
+			assert.NotNil(event.NextAttempt)
+			assert.Equal(451, event.LastAttempt.Code)
+		}
+	}
+}
+
+func TestSendMailMessageCallbackHosts(t *testing.T) {
+	assert := assert.New(t)
+	serv := MailSenderService{
+		Mail:  MailSetup{Server: "exampleserver.com:25", DefaultMail: "mail@exampleserver.com"},
+		Setup: Setup{CallbackHosts: []string{"hooks.example.com"}},
+	}
+
+	for _, callback := range []string{"http://other.example.com/events", "ftp://hooks.example.com/events"} {
+		w := httptest.NewRecorder()
+		body := `{"To":[{"Address":"dest@server.com"}],"callback":"` + callback + `"}`
+		serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+		assert.Equal(http.StatusBadRequest, w.Code, "Expected %s to be refused", callback)
+	}
+
+	//without allowed hosts no callback is accepted
+	serv.Setup.CallbackHosts = nil
+	w := httptest.NewRecorder()
+	body := `{"To":[{"Address":"dest@server.com"}],"callback":"http://169.254.169.254/latest"}`
+	serv.SendMailMessage(w, httptest.NewRequest(http.MethodPost, "/sendmail", bytes.NewBufferString(body)))
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "Callbacks are not allowed")
+}
+
+func TestCreateMailSenderServiceWebhooks(t *testing.T) {
+	assert := assert.New(t)
+	config := `{"mailsetup":{"server":"exampleserver.com:25"},"servicesetup":{"port":8080,"webhooks":[%s]}}`
+
+	_, err := NewMailSenderService(fmt.Sprintf(config, `{"url":"https://hooks.example.com/mail","secret":"s","events":["delivered","bounced"]}`))
+	assert.Nil(err)
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"url":"hooks.example.com","secret":"s"}`))
+	assert.NotNil(err, "Expected an error for a webhook without scheme")
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"url":"https://hooks.example.com/mail","secret":"s","events":["opened"]}`))
+	assert.NotNil(err, "Expected an error for an unknown event")
+	_, err = NewMailSenderService(fmt.Sprintf(config, `{"url":"https://hooks.example.com/mail"}`))
+	assert.NotNil(err, "Expected an error for a webhook without secret")
+
+	_, err = NewMailSenderService(`{"mailsetup":{"server":"exampleserver.com:25"},"servicesetup":{"port":8080,"callbackhosts":["hooks.example.com"]}}`)
+	assert.NotNil(err, "Expected an error for callbacks without secret")
+}
@@ -0,0 +1,323 @@
+package mailsender
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+//Timeouts limits the time spent in each phase of sending a mail.
+//A zero value leaves the phase limited only by the deadline of the
+//context, if there is one.
+type Timeouts struct {
+	//Dial limits the connection to the server, including its greeting
+	Dial time.Duration
+	//TLS limits the TLS handshake, both for implicit TLS and STARTTLS
+	TLS time.Duration
+	//Command limits each of the other SMTP commands
+	Command time.Duration
+	//Data limits the transfer of the message, from DATA to the final reply
+	Data time.Duration
+}
+
+//session is an SMTP session with the server. Every blocking operation
+//is bounded by the timeout of its phase and aborted when ctx is done.
+type session struct {
+	ctx      context.Context
+	timeouts Timeouts
+	host     string
+	//conn is the TCP connection, never replaced by the TLS one over it,
+	//so that the watcher can move its deadline at any time
+	conn   net.Conn
+	client *smtp.Client
+	tls    bool
+
+	stopWatch func()
+	closeOnce sync.Once
+	closed    bool
+
+	//messages counts the mails sent on the session and idleSince
+	//tells when it was returned to its Pool
+	messages  int
+	idleSince time.Time
+	//content tells if the content of the last mail started to be
+	//written, after which its Reader attachments are consumed
+	content bool
+}
+
+//dialSession connects to server and prepares the session according
+//to mode: TLS right away for TLSImplicit, STARTTLS for the others.
+//localName is sent with EHLO, localhost when it is empty.
+func dialSession(ctx context.Context, server string, mode TLSMode, tlsconfig *tls.Config, timeouts Timeouts, localName string) (*session, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, newSMTPError(StageDial, err)
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, newSMTPError(StageDial, err)
+	}
+
+	//as tls.Dial does, the server name defaults to the host
+	if tlsconfig == nil {
+		tlsconfig = CreateTLSConfig(host)
+	} else if tlsconfig.ServerName == "" {
+		tlsconfig = tlsconfig.Clone()
+		tlsconfig.ServerName = host
+	}
+
+	dialCtx := ctx
+	if timeouts.Dial > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeouts.Dial)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", server)
+	if err != nil {
+		return nil, newSMTPError(StageDial, err)
+	}
+
+	s := &session{timeouts: timeouts, host: host, conn: conn}
+	s.watch(ctx)
+
+	//the deadlines of conn bound the TLS connection as well
+	client := conn
+	if mode == TLSImplicit {
+		s.phase(timeouts.TLS)
+		tlsConn := tls.Client(conn, tlsconfig)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, s.fail(StageTLS, err)
+		}
+		client = tlsConn
+		s.tls = true
+	}
+
+	s.phase(timeouts.Dial)
+	if s.client, err = smtp.NewClient(client, host); err != nil {
+		return nil, s.fail(StageDial, err)
+	}
+	if localName != "" {
+		s.phase(timeouts.Command)
+		if err = s.client.Hello(localName); err != nil {
+			return nil, s.fail(StageDial, err)
+		}
+	}
+
+	if mode == TLSStartTLS || mode == TLSOpportunistic {
+		s.phase(timeouts.Command)
+		ok, _ := s.client.Extension("STARTTLS")
+		if !ok && mode == TLSStartTLS {
+			return nil, s.fail(StageTLS, ErrStartTLSNotSupported)
+		}
+		if ok {
+			s.phase(timeouts.TLS)
+			if err = s.client.StartTLS(tlsconfig); err != nil {
+				return nil, s.fail(StageTLS, err)
+			}
+			s.tls = true
+		}
+	}
+
+	return s, nil
+}
+
+//watch binds the session to ctx: its blocking operations are aborted
+//when ctx is done by moving the deadline of the connection in the past
+func (s *session) watch(ctx context.Context) {
+	s.unwatch()
+	s.ctx = ctx
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			s.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	//waiting for the watcher keeps it from moving the deadline of a
+	//session already bound to another context
+	s.stopWatch = func() {
+		close(done)
+		<-exited
+	}
+}
+
+//unwatch detaches the session from its context
+func (s *session) unwatch() {
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
+	}
+	s.ctx = context.Background()
+}
+
+//phase sets the deadline for the next phase of the session: the
+//earliest of the phase timeout and the deadline of the context
+func (s *session) phase(timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if ctxDeadline, ok := s.ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	s.conn.SetDeadline(deadline)
+	//the watcher may have fired before the deadline was overwritten
+	if s.ctx.Err() != nil {
+		s.conn.SetDeadline(time.Unix(1, 0))
+	}
+}
+
+//fail closes the session after an error in stage. When the context
+//is done, its error is reported instead of the resulting i/o timeout.
+func (s *session) fail(stage Stage, err error) error {
+	ctx := s.ctx
+	s.abort()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return newSMTPError(stage, ctxErr)
+	}
+	//the deadline of the connection may pass before the one of ctx
+	//is noticed
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return newSMTPError(stage, context.DeadlineExceeded)
+	}
+	return newSMTPError(stage, err)
+}
+
+//authenticate logs in with auth
+func (s *session) authenticate(auth smtp.Auth) error {
+	s.phase(s.timeouts.Command)
+	if err := s.client.Auth(auth); err != nil {
+		return s.fail(StageAuth, err)
+	}
+	return nil
+}
+
+//send runs one mail transaction on the session. A refused recipient
+//does not end the session, any other error does.
+func (s *session) send(ms MailStruct) (*Result, error) {
+	return s.sendTo(ms, ms.envelope())
+}
+
+//sendTo sends the mail to recipients only, whatever its headers list
+func (s *session) sendTo(ms MailStruct, recipients []mail.Address) (*Result, error) {
+	s.content = false
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+
+	if err := ms.ValidateHeaders(); err != nil {
+		return nil, err
+	}
+
+	s.phase(s.timeouts.Command)
+	if err := s.client.Mail(ms.From.Address); err != nil {
+		return nil, s.commandError(StageMail, err)
+	}
+
+	setDefaults(&ms)
+	result := &Result{MessageID: ms.MessageID}
+
+	for _, recipient := range recipients {
+		s.phase(s.timeouts.Command)
+		if err := s.client.Rcpt(recipient.Address); err != nil {
+			//a reply from the server only refuses this recipient,
+			//anything else means the session can not be used anymore
+			if _, ok := err.(*textproto.Error); !ok {
+				return nil, s.fail(StageRcpt, err)
+			}
+			result.Rejected = append(result.Rejected, RecipientError{Address: recipient, Err: newSMTPError(StageRcpt, err)})
+			continue
+		}
+		result.Accepted = append(result.Accepted, recipient)
+	}
+
+	if len(result.Accepted) == 0 {
+		s.reset()
+		return result, allRejectedError(result.Rejected)
+	}
+
+	s.phase(s.timeouts.Data)
+	writer, err := s.client.Data()
+
+	if err != nil {
+		return nil, s.commandError(StageData, err)
+	}
+
+	s.content = true
+	counter := &countingWriter{Writer: writer}
+	err = writeMessage(counter, ms)
+
+	if err != nil {
+		//closing the writer would end the DATA command and deliver the
+		//partial message, so the connection is dropped instead
+		return nil, s.fail(StageData, err)
+	}
+
+	//the server only confirms the message after the final dot
+	if err = writer.Close(); err != nil {
+		return nil, s.commandError(StageData, err)
+	}
+
+	result.Bytes = counter.N
+	s.messages++
+
+	return result, nil
+}
+
+//commandError handles the failure of a command: a reply from the
+//server leaves the session usable after a reset, anything else ends it
+func (s *session) commandError(stage Stage, err error) error {
+	if _, ok := err.(*textproto.Error); ok {
+		s.reset()
+		return newSMTPError(stage, err)
+	}
+	return s.fail(stage, err)
+}
+
+//noop checks that the server still answers on the session
+func (s *session) noop() error {
+	s.phase(s.timeouts.Command)
+	if err := s.client.Noop(); err != nil {
+		return s.fail(StageMail, err)
+	}
+	return nil
+}
+
+//reset aborts the current mail transaction
+func (s *session) reset() error {
+	s.phase(s.timeouts.Command)
+	if err := s.client.Reset(); err != nil {
+		return s.fail(StageMail, err)
+	}
+	return nil
+}
+
+//abort drops the connection without ending the session
+func (s *session) abort() {
+	s.closeOnce.Do(func() {
+		s.unwatch()
+		s.conn.Close()
+		s.closed = true
+	})
+}
+
+//close ends the session with QUIT
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		if s.client != nil {
+			s.phase(s.timeouts.Command)
+			s.client.Quit()
+		}
+		s.unwatch()
+		s.conn.Close()
+		s.closed = true
+	})
+}
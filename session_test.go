@@ -0,0 +1,139 @@
+package mailsender_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/mail"
+	"testing"
+	"time"
+
+	"github.com/adiclepcea/mailsender"
+	"github.com/adiclepcea/mailsender/mailsendertest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendMailTimeouts(t *testing.T) {
+	assert := assert.New(t)
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+	}
+
+	cases := []struct {
+		stall string
+		stage mailsender.Stage
+	}{
+		{"GREETING", mailsender.StageDial},
+		{"MAIL", mailsender.StageMail},
+		{"DATA", mailsender.StageData},
+	}
+
+	for _, c := range cases {
+		server := mailsendertest.NewServer()
+		server.Stall(c.stall)
+		impl := mailsender.Impl{Timeouts: mailsender.Timeouts{Dial: 100 * time.Millisecond, Command: 100 * time.Millisecond, Data: 100 * time.Millisecond}}
+
+		start := time.Now()
+		_, err := impl.SendMailWithoutAuth(server.Addr, ms)
+		assert.True(time.Since(start) < 2*time.Second, "The timeout was not applied for %s", c.stall)
+
+		smtpErr, ok := err.(*mailsender.SMTPError)
+		if assert.True(ok, "SMTPError expected for %s, got %v", c.stall, err) {
+			assert.Equal(c.stage, smtpErr.Stage)
+			assert.True(smtpErr.Temporary(), "A timeout should be temporary")
+		}
+		server.Close()
+	}
+}
+
+func TestSendMailContext(t *testing.T) {
+	assert := assert.New(t)
+	server := mailsendertest.NewServer()
+	defer server.Close()
+	server.Stall("RCPT")
+
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+	}
+	impl := mailsender.Impl{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := impl.SendMailWithoutAuthContext(ctx, server.Addr, ms)
+	assert.True(errors.Is(err, context.DeadlineExceeded), "Deadline exceeded expected, got %v", err)
+	assert.Equal(mailsender.StageRcpt, err.(*mailsender.SMTPError).Stage)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err = impl.SendMailContext(ctx, server.Addr, "", "", ms)
+	assert.True(errors.Is(err, context.Canceled), "Canceled expected, got %v", err)
+	assert.True(time.Since(start) < 2*time.Second, "The cancellation was not applied")
+
+	_, err = impl.SendMailTLSContext(ctx, server.Addr, nil, "", "", ms)
+	assert.True(errors.Is(err, context.Canceled), "A done context should not connect, got %v", err)
+
+	server.Reset()
+	_, err = impl.SendMailStartTLSContext(context.Background(), server.Addr, nil, false, "", "", ms)
+	assert.Nil(err, "No error expected, got %v", err)
+}
+
+func TestSendMailTLSContext(t *testing.T) {
+	assert := assert.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.Nil(err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(err)
+
+	//the server completes the TLS handshake, then never greets
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	assert.Nil(err)
+	defer listener.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+		<-done
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	ms := mailsender.MailStruct{
+		From: mail.Address{Address: "src@server.com"},
+		To:   []mail.Address{{Address: "to@server.com"}},
+	}
+	impl := mailsender.Impl{}
+	_, err = impl.SendMailTLSContext(ctx, listener.Addr().String(), &tls.Config{RootCAs: roots}, "", "", ms)
+	assert.True(errors.Is(err, context.Canceled), "Canceled expected, got %v", err)
+}
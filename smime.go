@@ -0,0 +1,422 @@
+package mailsender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net/textproto"
+	"sort"
+	"time"
+)
+
+//The object identifiers of the PKCS #7 (CMS) structures, RFC 5652
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAttrContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256     = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAES256CBC           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	asn1NULL               = asn1.RawValue{Tag: asn1.TagNull}
+	sha256Algorithm        = pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	rsaEncryptionAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1NULL}
+)
+
+//contentInfo wraps the PKCS #7 structures
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    issuerAndSerialNumber
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+//SMIMESigner signs mails with S/MIME, as described in RFC 8551. The mail
+//is sent as multipart/signed, its content followed by a detached PKCS #7
+//signature.
+type SMIMESigner struct {
+	//Certificate is the certificate of the sender, holding the public
+	//key of Key
+	Certificate *x509.Certificate
+	//Key is an *rsa.PrivateKey or an *ecdsa.PrivateKey
+	Key crypto.Signer
+	//Chain holds the intermediate certificates sent with the signature
+	Chain []*x509.Certificate
+}
+
+//LoadSMIMESigner reads the signer from PEM files: certFile holds the
+//certificate of the sender followed by its chain and keyFile the RSA or
+//ECDSA private key
+func LoadSMIMESigner(certFile string, keyFile string) (*SMIMESigner, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificate found in %s", certFile)
+	}
+
+	if data, err = ioutil.ReadFile(keyFile); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM encoded key found in %s", keyFile)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer := &SMIMESigner{Certificate: certs[0], Chain: certs[1:]}
+	signer.Key, _ = key.(crypto.Signer)
+	if _, err = signer.signatureAlgorithm(); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+//signatureAlgorithm returns the algorithm of the signatures of the key
+func (s *SMIMESigner) signatureAlgorithm() (pkix.AlgorithmIdentifier, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return rsaEncryptionAlgorithm, nil
+	case *ecdsa.PrivateKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("Unsupported S/MIME key type %T", s.Key)
+}
+
+//Sign returns the DER encoded detached PKCS #7 signature of content
+func (s *SMIMESigner) Sign(content []byte) ([]byte, error) {
+	if s.Certificate == nil || s.Key == nil {
+		return nil, fmt.Errorf("The S/MIME signer needs a certificate and a key")
+	}
+	algorithm, err := s.signatureAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(content)
+	attrs, err := signedAttributes(digest[:], time.Now())
+	if err != nil {
+		return nil, err
+	}
+	//the signature covers the attributes encoded as a SET, RFC 5652 5.4
+	attrsDigest := sha256.Sum256(attrs)
+	signature, err := s.Key.Sign(randReader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	signedAttrs := append([]byte{0xa0}, attrs[1:]...)
+
+	var certificates []byte
+	for _, cert := range append([]*x509.Certificate{s.Certificate}, s.Chain...) {
+		certificates = append(certificates, cert.Raw...)
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Algorithm},
+		EncapContentInfo: contentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certificates},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerial(s.Certificate),
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttrs:        asn1.RawValue{FullBytes: signedAttrs},
+			SignatureAlgorithm: algorithm,
+			Signature:          signature,
+		}},
+	}
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+//signedAttributes encodes, as a DER SET, the content type, signing time
+//and message digest attributes of a signature
+func signedAttributes(digest []byte, signingTime time.Time) ([]byte, error) {
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrSigningTime, signingTime.UTC()},
+		{oidAttrMessageDigest, digest},
+	}
+	var attrs [][]byte
+	for _, v := range values {
+		value, err := asn1.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(struct {
+			Type   asn1.ObjectIdentifier
+			Values asn1.RawValue
+		}{v.oid, asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value}})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	//DER orders the elements of a SET OF by their encoding
+	sort.Slice(attrs, func(i, j int) bool { return bytes.Compare(attrs[i], attrs[j]) < 0 })
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(attrs, nil)})
+}
+
+func issuerAndSerial(cert *x509.Certificate) issuerAndSerialNumber {
+	return issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber}
+}
+
+//marshalContentInfo encodes content in a ContentInfo of contentType
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content interface{}) ([]byte, error) {
+	inner, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: contentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+//EncryptSMIME returns the DER encoded PKCS #7 enveloped data holding
+//content encrypted with AES-256-CBC for the recipients, who must have
+//RSA certificates. The content key is encrypted with RSA PKCS #1 v1.5,
+//the key transport all the mail clients support.
+func EncryptSMIME(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("No S/MIME recipient certificate")
+	}
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(randReader, key); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(randReader, iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	//PKCS #7 padding, a full block when the content is already aligned
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte(nil), content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	ed := envelopedData{Version: 0}
+	for _, cert := range recipients {
+		public, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("The S/MIME certificate of %s does not hold an RSA key", cert.Subject.CommonName)
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(randReader, public, key)
+		if err != nil {
+			return nil, err
+		}
+		ed.RecipientInfos = append(ed.RecipientInfos, keyTransRecipientInfo{
+			Version:                0,
+			RID:                    issuerAndSerial(cert),
+			KeyEncryptionAlgorithm: rsaEncryptionAlgorithm,
+			EncryptedKey:           encryptedKey,
+		})
+	}
+
+	parameters, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	ed.EncryptedContentInfo = encryptedContentInfo{
+		ContentType:                oidData,
+		ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: parameters}},
+		EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+	}
+	return marshalContentInfo(oidEnvelopedData, ed)
+}
+
+//renderEntity writes the MIME entity built by part, headers included,
+//with its lines ending in CRLF as they are sent. The signature and the
+//encryption apply to these exact bytes.
+func renderEntity(part mimePart) ([]byte, error) {
+	var buf bytes.Buffer
+	err := part(func(header textproto.MIMEHeader) (io.Writer, error) {
+		return &buf, writeHeaders(&buf, sortedFields(header))
+	})
+	if err != nil {
+		return nil, err
+	}
+	entity := bytes.Replace(buf.Bytes(), []byte("\r\n"), []byte("\n"), -1)
+	return bytes.Replace(entity, []byte("\n"), []byte("\r\n"), -1), nil
+}
+
+//signedPart builds the multipart/signed entity holding the content
+//entity built by part and its detached S/MIME signature
+func signedPart(part mimePart, signer *SMIMESigner) mimePart {
+	return multipartSigned(part, "application/pkcs7-signature", "sha-256", func(entity []byte) (mimePart, error) {
+		signature, err := signer.Sign(entity)
+		if err != nil {
+			return nil, err
+		}
+		return smimePart(signature, "application/pkcs7-signature", "smime.p7s"), nil
+	})
+}
+
+//multipartSigned builds the multipart/signed entity, RFC 1847, holding
+//the content entity built by part followed by the signature part that
+//sign returns for its exact bytes
+func multipartSigned(part mimePart, protocol string, micalg string, sign func(entity []byte) (mimePart, error)) mimePart {
+	return func(create partCreator) error {
+		entity, err := renderEntity(part)
+		if err != nil {
+			return err
+		}
+		signature, err := sign(entity)
+		if err != nil {
+			return err
+		}
+		boundary, err := randomBoundary()
+		if err != nil {
+			return err
+		}
+
+		w, err := create(textproto.MIMEHeader{
+			"Content-Type": {mime.FormatMediaType("multipart/signed", map[string]string{
+				"protocol": protocol,
+				"micalg":   micalg,
+				"boundary": boundary,
+			})},
+		})
+		if err != nil {
+			return err
+		}
+		//the content is written as it is, the multipart writer would
+		//reformat its header
+		if _, err = io.WriteString(w, "--"+boundary+"\r\n"); err != nil {
+			return err
+		}
+		if _, err = w.Write(entity); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, "\r\n--"+boundary+"\r\n"); err != nil {
+			return err
+		}
+		err = signature(func(header textproto.MIMEHeader) (io.Writer, error) {
+			return w, writeHeaders(w, sortedFields(header))
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "\r\n--"+boundary+"--\r\n")
+		return err
+	}
+}
+
+//encryptedPart builds the application/pkcs7-mime entity holding the
+//entity built by part encrypted for the recipients
+func encryptedPart(part mimePart, recipients []*x509.Certificate) mimePart {
+	return func(create partCreator) error {
+		entity, err := renderEntity(part)
+		if err != nil {
+			return err
+		}
+		enveloped, err := EncryptSMIME(entity, recipients)
+		if err != nil {
+			return err
+		}
+		return smimePart(enveloped, `application/pkcs7-mime; smime-type=enveloped-data`, "smime.p7m")(create)
+	}
+}
+
+//smimePart builds the base64 encoded entity of a PKCS #7 structure
+func smimePart(der []byte, contentType string, filename string) mimePart {
+	return func(create partCreator) error {
+		w, err := create(textproto.MIMEHeader{
+			"Content-Type":              {contentType + `; name="` + filename + `"`},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {`attachment; filename="` + filename + `"`},
+		})
+		if err != nil {
+			return err
+		}
+		encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: w})
+		if _, err = encoder.Write(der); err != nil {
+			return err
+		}
+		return encoder.Close()
+	}
+}
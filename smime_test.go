@@ -0,0 +1,325 @@
+package mailsender
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestCertificate creates a certificate for key, signed by parent or
+//self-signed when parent is nil
+func newTestCertificate(t *testing.T, name string, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func smimeMail() MailStruct {
+	return MailStruct{
+		From:        mail.Address{Address: "src@server.com"},
+		To:          []mail.Address{{Address: "to@server.com"}},
+		Subject:     "Report",
+		Body:        "The report\nis attached",
+		Attachments: []Attachment{AttachBytes("report.csv", []byte("a,b\n1,2\n"))},
+	}
+}
+
+//parseContentInfo decodes a PKCS #7 ContentInfo of contentType into v
+func parseContentInfo(t *testing.T, der []byte, contentType asn1.ObjectIdentifier, v interface{}) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(der, &ci)
+	if err != nil || len(rest) > 0 {
+		t.Fatalf("Invalid ContentInfo: %v", err)
+	}
+	if !ci.ContentType.Equal(contentType) {
+		t.Fatalf("Expected content type %v, got %v", contentType, ci.ContentType)
+	}
+	if _, err = asn1.Unmarshal(ci.Content.Bytes, v); err != nil {
+		t.Fatalf("Invalid content: %v", err)
+	}
+}
+
+//signedParts splits a multipart/signed body in the exact bytes of the
+//signed entity and the DER of the signature
+func signedParts(t *testing.T, msg *mail.Message) ([]byte, []byte) {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/signed" {
+		t.Fatalf("Expected multipart/signed, got %s", msg.Header.Get("Content-Type"))
+	}
+	if params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("Invalid multipart/signed parameters: %v", params)
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	delimiter := []byte("--" + params["boundary"] + "\r\n")
+	start := bytes.Index(body, delimiter) + len(delimiter)
+	end := bytes.Index(body[start:], []byte("\r\n--"+params["boundary"])) + start
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	reader.NextPart()
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(part.Header.Get("Content-Type"), "application/pkcs7-signature") {
+		t.Fatalf("Expected the signature, got %s", part.Header.Get("Content-Type"))
+	}
+	encoded, _ := ioutil.ReadAll(part)
+	der, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body[start:end], der
+}
+
+//verifySignature checks the detached signature of content and returns
+//the certificates sent with it
+func verifySignature(t *testing.T, content []byte, der []byte, algorithm x509.SignatureAlgorithm) []*x509.Certificate {
+	var sd signedData
+	parseContentInfo(t, der, oidSignedData, &sd)
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		t.Fatalf("Expected one signer, got %d", len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	if si.SID.SerialNumber.Cmp(certs[0].SerialNumber) != 0 {
+		t.Fatalf("The signer is not the first certificate")
+	}
+
+	//the attributes are signed with the SET tag
+	attrs := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	if err = certs[0].CheckSignature(algorithm, attrs, si.Signature); err != nil {
+		t.Fatalf("Invalid signature: %v", err)
+	}
+
+	var parsed []struct {
+		Type   asn1.ObjectIdentifier
+		Values asn1.RawValue
+	}
+	if _, err = asn1.UnmarshalWithParams(attrs, &parsed, "set"); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	for _, attr := range parsed {
+		if attr.Type.Equal(oidAttrMessageDigest) {
+			var value []byte
+			asn1.Unmarshal(attr.Values.Bytes, &value)
+			if !bytes.Equal(value, digest[:]) {
+				t.Fatalf("The message digest does not match the content")
+			}
+			return certs
+		}
+	}
+	t.Fatalf("No message digest attribute")
+	return nil
+}
+
+//decrypt opens the enveloped data with the key of cert
+func decrypt(t *testing.T, der []byte, cert *x509.Certificate, key *rsa.PrivateKey) []byte {
+	var ed envelopedData
+	parseContentInfo(t, der, oidEnvelopedData, &ed)
+	var contentKey []byte
+	for _, ri := range ed.RecipientInfos {
+		if ri.RID.SerialNumber.Cmp(cert.SerialNumber) == 0 && bytes.Equal(ri.RID.Issuer.FullBytes, cert.RawIssuer) {
+			var err error
+			if contentKey, err = rsa.DecryptPKCS1v15(rand.Reader, key, ri.EncryptedKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if contentKey == nil {
+		t.Fatalf("No recipient info for %s", cert.Subject.CommonName)
+	}
+
+	eci := ed.EncryptedContentInfo
+	if !eci.ContentEncryptionAlgorithm.Algorithm.Equal(oidAES256CBC) {
+		t.Fatalf("Unexpected algorithm %v", eci.ContentEncryptionAlgorithm.Algorithm)
+	}
+	var iv []byte
+	asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv)
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := append([]byte(nil), eci.EncryptedContent.Bytes...)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, content)
+	return content[:len(content)-int(content[len(content)-1])]
+}
+
+func TestSMIMESignRSA(t *testing.T) {
+	assert := assert.New(t)
+	caKey := newRSAKey(t)
+	ca := newTestCertificate(t, "CA", caKey, nil, nil)
+	key := newRSAKey(t)
+	cert := newTestCertificate(t, "src@server.com", key, ca, caKey)
+
+	ms := smimeMail()
+	ms.SMIME = &SMIMESigner{Certificate: cert, Key: key, Chain: []*x509.Certificate{ca}}
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	assert.Equal("Report", msg.Header.Get("Subject"))
+	content, signature := signedParts(t, msg)
+	certs := verifySignature(t, content, signature, x509.SHA256WithRSA)
+	assert.Equal(2, len(certs), "The chain should be sent with the signature")
+
+	//the signed content is the multipart/mixed entity of the mail
+	inner, err := mail.ReadMessage(bytes.NewReader(content))
+	assert.Nil(err)
+	assert.True(strings.HasPrefix(inner.Header.Get("Content-Type"), "multipart/mixed"))
+	assert.Contains(string(content), "The report\r\nis attached")
+}
+
+func TestSMIMESignECDSA(t *testing.T) {
+	assert := assert.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	cert := newTestCertificate(t, "src@server.com", key, nil, nil)
+
+	ms := smimeMail()
+	ms.SMIME = &SMIMESigner{Certificate: cert, Key: key}
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	content, signature := signedParts(t, msg)
+	assert.Equal(1, len(verifySignature(t, content, signature, x509.ECDSAWithSHA256)))
+}
+
+func TestSMIMEEncrypt(t *testing.T) {
+	assert := assert.New(t)
+	keys := []*rsa.PrivateKey{newRSAKey(t), newRSAKey(t)}
+	certs := []*x509.Certificate{
+		newTestCertificate(t, "to@server.com", keys[0], nil, nil),
+		newTestCertificate(t, "cc@server.com", keys[1], nil, nil),
+	}
+	signKey := newRSAKey(t)
+	signCert := newTestCertificate(t, "src@server.com", signKey, nil, nil)
+
+	ms := smimeMail()
+	ms.SMIMERecipients = certs
+	ms.SMIME = &SMIMESigner{Certificate: signCert, Key: signKey}
+	var buf bytes.Buffer
+	assert.Nil(writeMessage(&buf, ms))
+	assert.NotContains(buf.String(), "The report")
+
+	msg, err := mail.ReadMessage(&buf)
+	assert.Nil(err)
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.Nil(err)
+	assert.Equal("application/pkcs7-mime", mediaType)
+	assert.Equal("enveloped-data", params["smime-type"])
+	assert.Equal("base64", msg.Header.Get("Content-Transfer-Encoding"))
+	encoded, _ := ioutil.ReadAll(msg.Body)
+	der, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+	assert.Nil(err)
+
+	for i := range certs {
+		content := decrypt(t, der, certs[i], keys[i])
+		//the mail is signed, then encrypted
+		signed, err := mail.ReadMessage(bytes.NewReader(content))
+		assert.Nil(err)
+		signedContent, signature := signedParts(t, signed)
+		verifySignature(t, signedContent, signature, x509.SHA256WithRSA)
+		assert.Contains(string(signedContent), "The report")
+	}
+}
+
+func TestSMIMEEncryptErrors(t *testing.T) {
+	assert := assert.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	cert := newTestCertificate(t, "to@server.com", key, nil, nil)
+
+	_, err = EncryptSMIME([]byte("content"), []*x509.Certificate{cert})
+	assert.NotNil(err, "Expected an error for a recipient without RSA key")
+	_, err = EncryptSMIME([]byte("content"), nil)
+	assert.NotNil(err, "Expected an error without recipients")
+}
+
+func TestLoadSMIMESigner(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "smime")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	caKey := newRSAKey(t)
+	ca := newTestCertificate(t, "CA", caKey, nil, nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(err)
+	cert := newTestCertificate(t, "src@server.com", key, ca, caKey)
+	ecKey, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	assert.Nil(ioutil.WriteFile(certFile, chain, 0644))
+	assert.Nil(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecKey}), 0600))
+
+	signer, err := LoadSMIMESigner(certFile, keyFile)
+	assert.Nil(err)
+	assert.Equal(cert.Raw, signer.Certificate.Raw)
+	assert.Equal(1, len(signer.Chain))
+	assert.IsType(&ecdsa.PrivateKey{}, signer.Key)
+
+	_, err = LoadSMIMESigner(keyFile, keyFile)
+	assert.NotNil(err, "Expected an error without certificate")
+	_, err = LoadSMIMESigner(certFile, certFile)
+	assert.NotNil(err, "Expected an error without key")
+}
@@ -0,0 +1,315 @@
+package mailsender
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+//ErrTemplateNotFound is returned when rendering a template that does
+//not exist
+var ErrTemplateNotFound = errors.New("Template not found")
+
+//The files of a template
+const (
+	subjectFile = "subject.txt"
+	textFile    = "text.txt"
+	htmlFile    = "html.html"
+)
+
+//The directories holding the templates shared by all the mails
+var sharedDirs = []string{"layouts", "partials"}
+
+//Templates renders mails from the named templates of a directory. Each
+//template is a subdirectory holding subject.txt, text.txt and html.html,
+//the first two parsed with text/template and the last with html/template.
+//The text and HTML templates of the layouts and partials directories,
+//.txt and .html files, can be used from all of them.
+//
+//A template can be localised with subdirectories named after the
+//locales, such as welcome/fr or welcome/pt-BR, holding the files that
+//differ from the default ones.
+type Templates struct {
+	dir string
+
+	mu    sync.RWMutex
+	mails map[string]*mailTemplate
+	stamp string
+}
+
+//mailTemplate holds the parsed files of a template in a locale
+type mailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+//LoadTemplates parses the templates of dir
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{dir: dir}
+	if _, err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+//Reload parses the templates again if any of their files changed since
+//they were loaded and tells if it did. When the new files can not be
+//parsed the templates loaded before are kept.
+func (t *Templates) Reload() (bool, error) {
+	stamp, err := dirStamp(t.dir)
+	if err != nil {
+		return false, err
+	}
+	t.mu.RLock()
+	unchanged := stamp == t.stamp
+	t.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	mails, err := parseTemplates(t.dir)
+	if err != nil {
+		return false, err
+	}
+	t.mu.Lock()
+	t.mails = mails
+	t.stamp = stamp
+	t.mu.Unlock()
+	return true, nil
+}
+
+//Names returns the names of the templates, with their locales as
+//name/locale
+func (t *Templates) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.mails))
+	for name := range t.mails {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//Render sets the Subject, Body and HTMLBody of the mail from the template
+//name executed with data. The template of locale is used if there is
+//one, then the one of its language, then the default one. A template
+//using a key missing from data is an error.
+func (t *Templates) Render(ms *MailStruct, name string, locale string, data interface{}) error {
+	mt := t.lookup(name, locale)
+	if mt == nil {
+		return fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	var buf bytes.Buffer
+	if mt.subject != nil {
+		if err := mt.subject.ExecuteTemplate(&buf, subjectFile, data); err != nil {
+			return err
+		}
+		//a subject is a single line
+		ms.Subject = strings.Join(strings.Fields(buf.String()), " ")
+	}
+	if mt.text != nil {
+		buf.Reset()
+		if err := mt.text.ExecuteTemplate(&buf, textFile, data); err != nil {
+			return err
+		}
+		ms.Body = buf.String()
+	}
+	if mt.html != nil {
+		buf.Reset()
+		if err := mt.html.ExecuteTemplate(&buf, htmlFile, data); err != nil {
+			return err
+		}
+		ms.HTMLBody = buf.String()
+	}
+	return nil
+}
+
+//lookup returns the template of name in locale, falling back to the
+//language of the locale and then to the default template
+func (t *Templates) lookup(name string, locale string) *mailTemplate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if locale != "" {
+		if mt, ok := t.mails[name+"/"+locale]; ok {
+			return mt
+		}
+		if i := strings.IndexAny(locale, "-_"); i > 0 {
+			if mt, ok := t.mails[name+"/"+locale[:i]]; ok {
+				return mt
+			}
+		}
+	}
+	return t.mails[name]
+}
+
+//dirStamp describes the files of dir, their names, sizes and times, so
+//that a change can be noticed
+func dirStamp(dir string) (string, error) {
+	var stamp strings.Builder
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&stamp, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return stamp.String(), err
+}
+
+//parseTemplates parses all the templates of dir
+func parseTemplates(dir string) (map[string]*mailTemplate, error) {
+	text := texttemplate.New("").Option("missingkey=error")
+	html := htmltemplate.New("").Option("missingkey=error")
+	for _, shared := range sharedDirs {
+		if err := parseShared(filepath.Join(dir, shared), text, html); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	mails := make(map[string]*mailTemplate)
+	for _, entry := range entries {
+		if !entry.IsDir() || isShared(entry.Name()) {
+			continue
+		}
+		name := entry.Name()
+		base, err := parseMailTemplate(filepath.Join(dir, name), nil, text, html)
+		if err != nil {
+			return nil, err
+		}
+		mails[name] = base
+
+		locales, err := ioutil.ReadDir(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, locale := range locales {
+			if !locale.IsDir() {
+				continue
+			}
+			mt, err := parseMailTemplate(filepath.Join(dir, name, locale.Name()), base, text, html)
+			if err != nil {
+				return nil, err
+			}
+			mails[name+"/"+locale.Name()] = mt
+		}
+	}
+	return mails, nil
+}
+
+func isShared(name string) bool {
+	for _, shared := range sharedDirs {
+		if name == shared {
+			return true
+		}
+	}
+	return false
+}
+
+//parseShared adds the .txt files of dir to text and the .html ones to
+//html, named after the files. A missing directory is not an error.
+func parseShared(dir string, text *texttemplate.Template, html *htmltemplate.Template) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".txt":
+			_, err = text.New(entry.Name()).Parse(string(content))
+		case ".html":
+			_, err = html.New(entry.Name()).Parse(string(content))
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid template %s: %s", filepath.Join(dir, entry.Name()), err.Error())
+		}
+	}
+	return nil
+}
+
+//parseMailTemplate parses the files of the template in dir on top of
+//the shared templates. The files missing from dir are taken from
+//fallback, when it is set.
+func parseMailTemplate(dir string, fallback *mailTemplate, text *texttemplate.Template, html *htmltemplate.Template) (*mailTemplate, error) {
+	mt := &mailTemplate{}
+	if fallback != nil {
+		*mt = *fallback
+	}
+
+	var err error
+	if content, ok, readErr := readOptional(filepath.Join(dir, subjectFile)); readErr != nil {
+		return nil, readErr
+	} else if ok {
+		if mt.subject, err = parseText(text, subjectFile, content); err != nil {
+			return nil, fmt.Errorf("Invalid template %s: %s", filepath.Join(dir, subjectFile), err.Error())
+		}
+	}
+	if content, ok, readErr := readOptional(filepath.Join(dir, textFile)); readErr != nil {
+		return nil, readErr
+	} else if ok {
+		if mt.text, err = parseText(text, textFile, content); err != nil {
+			return nil, fmt.Errorf("Invalid template %s: %s", filepath.Join(dir, textFile), err.Error())
+		}
+	}
+	if content, ok, readErr := readOptional(filepath.Join(dir, htmlFile)); readErr != nil {
+		return nil, readErr
+	} else if ok {
+		shared, err := html.Clone()
+		if err == nil {
+			mt.html, err = shared.New(htmlFile).Parse(content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template %s: %s", filepath.Join(dir, htmlFile), err.Error())
+		}
+	}
+
+	if fallback == nil && mt.text == nil && mt.html == nil {
+		return nil, fmt.Errorf("The template %s has neither %s nor %s", dir, textFile, htmlFile)
+	}
+	return mt, nil
+}
+
+//parseText parses content as name on top of a copy of the shared templates
+func parseText(shared *texttemplate.Template, name string, content string) (*texttemplate.Template, error) {
+	t, err := shared.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return t.New(name).Parse(content)
+}
+
+//readOptional reads a file, telling if it exists
+func readOptional(path string) (string, bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(content), true, nil
+}
@@ -0,0 +1,140 @@
+package mailsender
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//writeTemplates creates the files, given by their path, of a template
+//directory
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTemplateDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTemplates(t, dir, map[string]string{
+		"layouts/base.html":      `<html><body>{{block "content" .}}{{end}}{{template "footer.html" .}}</body></html>`,
+		"partials/footer.html":   `<p>{{.Company}}</p>`,
+		"partials/signature.txt": `-- {{.Company}}`,
+		"welcome/subject.txt":    "Welcome,\n {{.Name}}\n",
+		"welcome/text.txt":       "Hello {{.Name}}\n{{template \"signature.txt\" .}}",
+		"welcome/html.html":      `{{template "base.html" .}}{{define "content"}}<h1>Hello {{.Name}}</h1>{{end}}`,
+		"welcome/fr/subject.txt": "Bienvenue {{.Name}}",
+		"welcome/fr/text.txt":    "Bonjour {{.Name}}",
+	})
+	return dir
+}
+
+func TestRenderTemplate(t *testing.T) {
+	assert := assert.New(t)
+	dir := newTemplateDir(t)
+	defer os.RemoveAll(dir)
+
+	templates, err := LoadTemplates(dir)
+	assert.Nil(err)
+	assert.Equal([]string{"welcome", "welcome/fr"}, templates.Names())
+
+	var ms MailStruct
+	data := map[string]string{"Name": "<Ana>", "Company": "Example"}
+	assert.Nil(templates.Render(&ms, "welcome", "", data))
+	assert.Equal("Welcome, <Ana>", ms.Subject)
+	assert.Equal("Hello <Ana>\n-- Example", ms.Body)
+	assert.Equal("<html><body><h1>Hello &lt;Ana&gt;</h1><p>Example</p></body></html>", ms.HTMLBody)
+}
+
+func TestRenderTemplateLocale(t *testing.T) {
+	assert := assert.New(t)
+	dir := newTemplateDir(t)
+	defer os.RemoveAll(dir)
+
+	templates, err := LoadTemplates(dir)
+	assert.Nil(err)
+
+	data := map[string]string{"Name": "Ana", "Company": "Example"}
+	var ms MailStruct
+	assert.Nil(templates.Render(&ms, "welcome", "fr-CA", data))
+	assert.Equal("Bienvenue Ana", ms.Subject)
+	assert.Equal("Bonjour Ana", ms.Body)
+	//the HTML is taken from the default template
+	assert.Contains(ms.HTMLBody, "<h1>Hello Ana</h1>")
+
+	ms = MailStruct{}
+	assert.Nil(templates.Render(&ms, "welcome", "de", data))
+	assert.Equal("Welcome, Ana", ms.Subject)
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	assert := assert.New(t)
+	dir := newTemplateDir(t)
+	defer os.RemoveAll(dir)
+
+	templates, err := LoadTemplates(dir)
+	assert.Nil(err)
+
+	var ms MailStruct
+	err = templates.Render(&ms, "goodbye", "", nil)
+	assert.True(errors.Is(err, ErrTemplateNotFound), "Expected ErrTemplateNotFound, got %v", err)
+	err = templates.Render(&ms, "welcome", "", map[string]string{"Name": "Ana"})
+	assert.NotNil(err, "Expected an error for the missing Company")
+}
+
+func TestReloadTemplates(t *testing.T) {
+	assert := assert.New(t)
+	dir := newTemplateDir(t)
+	defer os.RemoveAll(dir)
+
+	templates, err := LoadTemplates(dir)
+	assert.Nil(err)
+	reloaded, err := templates.Reload()
+	assert.Nil(err)
+	assert.False(reloaded, "Nothing changed, no reload expected")
+
+	//a broken template keeps the ones loaded before
+	writeTemplates(t, dir, map[string]string{"welcome/text.txt": "Hi {{.Name"})
+	reloaded, err = templates.Reload()
+	assert.NotNil(err)
+	assert.False(reloaded)
+
+	writeTemplates(t, dir, map[string]string{"welcome/text.txt": "Hi {{.Name}}"})
+	//the time of the file may not have changed, its size did
+	os.Chtimes(filepath.Join(dir, "welcome", "text.txt"), time.Now(), time.Now().Add(time.Second))
+	reloaded, err = templates.Reload()
+	assert.Nil(err)
+	assert.True(reloaded)
+
+	var ms MailStruct
+	assert.Nil(templates.Render(&ms, "welcome", "", map[string]string{"Name": "Ana", "Company": "Example"}))
+	assert.Equal("Hi Ana", ms.Body)
+}
+
+func TestLoadTemplatesInvalid(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "templates")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{"empty/subject.txt": "Only a subject"})
+	_, err = LoadTemplates(dir)
+	assert.NotNil(err, "Expected an error for a template without body")
+
+	_, err = LoadTemplates(filepath.Join(dir, "missing"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,275 @@
+package mailsender
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//defaultMemoryLimit is the number of mails a MemoryTransport keeps
+//when its Limit is 0
+const defaultMemoryLimit = 1000
+
+//Transport delivers the mails in place of an SMTP server, as needed in
+//development and staging environments where no real mail must leave
+type Transport interface {
+	Deliver(ctx context.Context, ms MailStruct) (*Result, error)
+}
+
+//TransportSender is a MailSender handing the mails to Transport. The
+//server, the TLS configuration and the credentials it is given are
+//ignored.
+type TransportSender struct {
+	Transport Transport
+}
+
+//SendMailTLS delivers the mail through the transport
+func (ts *TransportSender) SendMailTLS(server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(context.Background(), ms)
+}
+
+//SendMailTLSContext delivers the mail through the transport
+func (ts *TransportSender) SendMailTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(ctx, ms)
+}
+
+//SendMailStartTLS delivers the mail through the transport
+func (ts *TransportSender) SendMailStartTLS(server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(context.Background(), ms)
+}
+
+//SendMailStartTLSContext delivers the mail through the transport
+func (ts *TransportSender) SendMailStartTLSContext(ctx context.Context, server string, tlsconfig *tls.Config, mandatory bool, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(ctx, ms)
+}
+
+//SendMail delivers the mail through the transport
+func (ts *TransportSender) SendMail(server string, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(context.Background(), ms)
+}
+
+//SendMailContext delivers the mail through the transport
+func (ts *TransportSender) SendMailContext(ctx context.Context, server string, usermail string, pass string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(ctx, ms)
+}
+
+//SendMailWithoutAuth delivers the mail through the transport
+func (ts *TransportSender) SendMailWithoutAuth(server string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(context.Background(), ms)
+}
+
+//SendMailWithoutAuthContext delivers the mail through the transport
+func (ts *TransportSender) SendMailWithoutAuthContext(ctx context.Context, server string, ms MailStruct) (*Result, error) {
+	return ts.Transport.Deliver(ctx, ms)
+}
+
+//renderMail builds the message as it would be sent over SMTP and the
+//result of a delivery accepting all the recipients
+func renderMail(ctx context.Context, ms MailStruct) (MailStruct, []byte, *Result, error) {
+	if err := ctx.Err(); err != nil {
+		return ms, nil, nil, err
+	}
+	recipients := ms.envelope()
+	if len(recipients) == 0 {
+		return ms, nil, nil, ErrNoRecipients
+	}
+	ms, err := ms.Render()
+	if err != nil {
+		return ms, nil, nil, err
+	}
+	return ms, ms.rendered, &Result{MessageID: ms.MessageID, Bytes: len(ms.rendered), Accepted: recipients}, nil
+}
+
+//FileTransport writes each mail as a .eml file in Dir, created when
+//missing. The files are named after the time and the Message-ID of the
+//mails, so they sort in the order they were sent.
+type FileTransport struct {
+	Dir string
+}
+
+//unsafeFilename matches the characters left out of the file names
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+//Deliver writes the mail in a new file
+func (ft *FileTransport) Deliver(ctx context.Context, ms MailStruct) (*Result, error) {
+	ms, data, result, err := renderMail(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(ft.Dir, 0755); err != nil {
+		return nil, err
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + unsafeFilename.ReplaceAllString(ms.MessageID, "_") + ".eml"
+	if err = ioutil.WriteFile(filepath.Join(ft.Dir, name), data, 0644); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//LogTransport logs a summary of each mail, without sending it, to
+//Logger or to the standard logger when it is nil
+type LogTransport struct {
+	Logger *log.Logger
+}
+
+//Deliver logs the sender, the recipients, the subject and the size of
+//the mail
+func (lt *LogTransport) Deliver(ctx context.Context, ms MailStruct) (*Result, error) {
+	ms, _, result, err := renderMail(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	var recipients []string
+	for _, recipient := range result.Accepted {
+		recipients = append(recipients, recipient.Address)
+	}
+	summary := fmt.Sprintf("Mail <%s> from %s to %s: %q, %d bytes, %d attachments",
+		ms.MessageID, ms.From.Address, strings.Join(recipients, ", "), ms.Subject, result.Bytes, len(ms.Attachments))
+	if lt.Logger != nil {
+		lt.Logger.Println(summary)
+	} else {
+		log.Println(summary)
+	}
+	return result, nil
+}
+
+//CapturedMail is a mail kept by a MemoryTransport
+type CapturedMail struct {
+	ID        string `json:"id"`
+	MessageID string `json:"messageid"`
+	From      string `json:"from"`
+	//Recipients holds the To, Cc and Bcc addresses
+	Recipients []string  `json:"recipients"`
+	Subject    string    `json:"subject"`
+	Captured   time.Time `json:"captured"`
+	Size       int       `json:"size"`
+	//Raw is the message as it would have been sent
+	Raw []byte `json:"-"`
+}
+
+//MailQuery selects captured mails. From, Recipient and Subject match
+//parts of the addresses and of the subject, ignoring the case.
+type MailQuery struct {
+	From      string
+	Recipient string
+	Subject   string
+	//Since and Until limit the time the mails were captured
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+//matches tells if cm is selected by the query
+func (q MailQuery) matches(cm *CapturedMail) bool {
+	contains := func(s string, part string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(part))
+	}
+	if q.From != "" && !contains(cm.From, q.From) {
+		return false
+	}
+	if q.Subject != "" && !contains(cm.Subject, q.Subject) {
+		return false
+	}
+	if !q.Since.IsZero() && cm.Captured.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && cm.Captured.After(q.Until) {
+		return false
+	}
+	if q.Recipient == "" {
+		return true
+	}
+	for _, recipient := range cm.Recipients {
+		if contains(recipient, q.Recipient) {
+			return true
+		}
+	}
+	return false
+}
+
+//MemoryTransport keeps the mails in memory to be queried. Once Limit
+//mails, 1000 when it is 0, are kept the oldest ones are dropped.
+type MemoryTransport struct {
+	Limit int
+
+	mu    sync.Mutex
+	mails []*CapturedMail
+	next  int
+}
+
+//Deliver keeps the mail
+func (mt *MemoryTransport) Deliver(ctx context.Context, ms MailStruct) (*Result, error) {
+	ms, data, result, err := renderMail(ctx, ms)
+	if err != nil {
+		return nil, err
+	}
+	cm := &CapturedMail{
+		MessageID: ms.MessageID,
+		From:      ms.From.Address,
+		Subject:   ms.Subject,
+		Captured:  time.Now(),
+		Size:      len(data),
+		Raw:       data,
+	}
+	for _, recipient := range result.Accepted {
+		cm.Recipients = append(cm.Recipients, recipient.Address)
+	}
+
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.next++
+	cm.ID = strconv.Itoa(mt.next)
+	mt.mails = append(mt.mails, cm)
+	limit := mt.Limit
+	if limit <= 0 {
+		limit = defaultMemoryLimit
+	}
+	if len(mt.mails) > limit {
+		mt.mails = append([]*CapturedMail(nil), mt.mails[len(mt.mails)-limit:]...)
+	}
+	return result, nil
+}
+
+//Messages returns the mails selected by query, the newest first
+func (mt *MemoryTransport) Messages(query MailQuery) []CapturedMail {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	var list []CapturedMail
+	for i := len(mt.mails) - 1; i >= 0; i-- {
+		if query.Limit > 0 && len(list) == query.Limit {
+			break
+		}
+		if query.matches(mt.mails[i]) {
+			list = append(list, *mt.mails[i])
+		}
+	}
+	return list
+}
+
+//Message returns the mail with the given ID
+func (mt *MemoryTransport) Message(id string) (CapturedMail, bool) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	for _, cm := range mt.mails {
+		if cm.ID == id {
+			return *cm, true
+		}
+	}
+	return CapturedMail{}, false
+}
+
+//Clear drops all the mails
+func (mt *MemoryTransport) Clear() {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.mails = nil
+}
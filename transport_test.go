@@ -0,0 +1,106 @@
+package mailsender
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func transportMail(subject string, to string) MailStruct {
+	return MailStruct{
+		From:    mail.Address{Address: "src@example.com"},
+		To:      []mail.Address{{Address: to}},
+		Bcc:     []mail.Address{{Address: "audit@example.com"}},
+		Subject: subject,
+		Body:    "Hello",
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "transport")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	sender := &TransportSender{Transport: &FileTransport{Dir: filepath.Join(dir, "mails")}}
+	for _, subject := range []string{"First", "Second"} {
+		result, err := sender.SendMail("ignored:25", "user", "pass", transportMail(subject, "to@server.com"))
+		assert.Nil(err)
+		assert.Equal(2, len(result.Accepted))
+		assert.NotEqual("", result.MessageID)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "mails"))
+	assert.Nil(err)
+	assert.Equal(2, len(files))
+	for i, subject := range []string{"First", "Second"} {
+		assert.True(strings.HasSuffix(files[i].Name(), ".eml"))
+		data, err := ioutil.ReadFile(filepath.Join(dir, "mails", files[i].Name()))
+		assert.Nil(err)
+		m, err := mail.ReadMessage(bytes.NewReader(data))
+		assert.Nil(err)
+		assert.Equal(subject, m.Header.Get("Subject"), "The files should sort in the order of the mails")
+		assert.Equal("", m.Header.Get("Bcc"))
+	}
+
+	_, err = sender.SendMailWithoutAuth("ignored:25", MailStruct{From: mail.Address{Address: "src@example.com"}})
+	assert.Equal(ErrNoRecipients, err)
+}
+
+func TestLogTransport(t *testing.T) {
+	assert := assert.New(t)
+	var buf bytes.Buffer
+	sender := &TransportSender{Transport: &LogTransport{Logger: log.New(&buf, "", 0)}}
+	result, err := sender.SendMailWithoutAuth("ignored:25", transportMail("Report", "to@server.com"))
+	assert.Nil(err)
+	assert.Contains(buf.String(), "Mail <"+result.MessageID+"> from src@example.com to to@server.com, audit@example.com: \"Report\"")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = sender.SendMailWithoutAuthContext(ctx, "ignored:25", transportMail("Report", "to@server.com"))
+	assert.Equal(context.Canceled, err)
+}
+
+func TestMemoryTransport(t *testing.T) {
+	assert := assert.New(t)
+	memory := &MemoryTransport{Limit: 3}
+	sender := &TransportSender{Transport: memory}
+	for _, subject := range []string{"Dropped", "Invoice", "Reminder", "Invoice paid"} {
+		_, err := sender.SendMailTLS("ignored:465", nil, "user", "pass", transportMail(subject, strings.ToLower(subject[:1])+"@server.com"))
+		assert.Nil(err)
+	}
+
+	all := memory.Messages(MailQuery{})
+	assert.Equal(3, len(all), "The oldest mail should be dropped")
+	assert.Equal("Invoice paid", all[0].Subject, "The newest mail comes first")
+	assert.Equal("4", all[0].ID)
+	assert.Equal([]string{"i@server.com", "audit@example.com"}, all[0].Recipients)
+
+	invoices := memory.Messages(MailQuery{Subject: "INVOICE"})
+	assert.Equal(2, len(invoices))
+	assert.Equal(1, len(memory.Messages(MailQuery{Subject: "invoice", Limit: 1})))
+	assert.Equal(1, len(memory.Messages(MailQuery{Recipient: "r@"})))
+	assert.Equal(3, len(memory.Messages(MailQuery{Recipient: "AUDIT", From: "src@"})))
+	assert.Equal(0, len(memory.Messages(MailQuery{Since: time.Now().Add(time.Minute)})))
+
+	cm, ok := memory.Message(invoices[1].ID)
+	assert.True(ok)
+	m, err := mail.ReadMessage(bytes.NewReader(cm.Raw))
+	assert.Nil(err)
+	assert.Equal("<"+cm.MessageID+">", m.Header.Get("Message-ID"))
+	assert.Equal(len(cm.Raw), cm.Size)
+	_, ok = memory.Message("1")
+	assert.False(ok)
+
+	memory.Clear()
+	assert.Equal(0, len(memory.Messages(MailQuery{})))
+}